@@ -0,0 +1,460 @@
+/*
+实现了AT命令引擎.
+
+引擎串行发送AT命令, 收集中间响应直至最终结果码(OK, ERROR, +CME ERROR等),
+并把错误结果转换为对应的Go错误. 需要数据输入的命令(例如AT+CMGS)收到"> "
+提示后发送数据. 主动上报的结果码(URC)交给注册的处理函数.
+命令超时后, 发送下一条命令之前先用AT重新同步, 丢弃超时命令迟到的结果.
+*/
+package atcmd
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 命令未指定超时时使用的超时时间.
+var DefaultTimeout = time.Second * 5
+
+// 日志接口, log4go的Logger满足此接口.
+type Logger interface {
+	Debug(arg0 interface{}, args ...interface{})
+}
+
+// AT命令.
+type Command struct {
+	Cmd string // 命令, 不含结尾的\r
+
+	// 中间响应的前缀, 例如"+CSQ:". 以此前缀开头的行总是属于命令,
+	// 即使同时注册了同前缀的URC处理函数.
+	Prefix string
+
+	// 收到"> "提示后发送的数据, 引擎在结尾加上Ctrl-Z.
+	Data []byte
+
+	// 拨号, 接听和挂断命令(ATD, ATA, ATH)设置. 只有这些命令把NO CARRIER,
+	// BUSY, NO ANSWER和NO DIALTONE当作最终结果码, 其他命令执行时收到的
+	// 这些结果码是通话结束的URC.
+	CallResult bool
+
+	Timeout time.Duration
+}
+
+// AT命令的响应.
+type Response struct {
+	Lines  []string // 中间响应行
+	Result string   // 最终结果码
+}
+
+// 返回第一个以prefix开头的中间响应去掉前缀后的内容.
+func (r *Response) Value(prefix string) (string, bool) {
+	for _, l := range r.Lines {
+		if strings.HasPrefix(l, prefix) {
+			return strings.TrimSpace(l[len(prefix):]), true
+		}
+	}
+	return "", false
+}
+
+// 返回所有以prefix开头的中间响应去掉前缀后的内容.
+func (r *Response) Values(prefix string) []string {
+	values := []string{}
+	for _, l := range r.Lines {
+		if strings.HasPrefix(l, prefix) {
+			values = append(values, strings.TrimSpace(l[len(prefix):]))
+		}
+	}
+	return values
+}
+
+// URC处理函数, lines为URC行, 带PDU的URC还包括随后的PDU行.
+// 处理函数在接收协程中调用, 不能阻塞, 也不能发送AT命令.
+type URCHandler func(lines []string)
+
+type urcEntry struct {
+	prefix  string
+	pdu     bool
+	handler URCHandler
+}
+
+// 正在执行的命令
+type call struct {
+	cmd    *Command
+	resp   Response
+	prompt chan struct{} // 收到"> "时关闭
+	result chan error
+	done   bool
+	sync   bool // 重新同步, 吸收所有的最终结果码
+}
+
+// AT命令引擎.
+type Engine struct {
+	rw     io.ReadWriter
+	logger Logger
+
+	cmdLock sync.Mutex // 串行化命令
+	stale   bool       // 上一条命令超时, 由cmdLock保护
+
+	lock      sync.Mutex
+	pending   *call
+	urcs      []*urcEntry
+	unhandled URCHandler
+	urcBody   *urcEntry // 等待PDU行的URC
+	urcLines  []string
+	err       error
+	done      chan struct{}
+}
+
+// 在rw上构建AT命令引擎并启动接收协程.
+// rw 通常是没有调用StartRecv的serial.SerialPort, 或者复用器的通道.
+// logger 日志, 可以为nil.
+func New(rw io.ReadWriter, logger Logger) *Engine {
+	e := &Engine{
+		rw:     rw,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+	go e.recvThread()
+	return e
+}
+
+func (e *Engine) debug(format string, args ...interface{}) {
+	if e.logger != nil {
+		e.logger.Debug(format, args...)
+	}
+}
+
+// 注册URC处理函数, 以prefix开头的行交给h处理.
+func (e *Engine) HandleURC(prefix string, h URCHandler) {
+	e.handle(&urcEntry{prefix: prefix, handler: h})
+}
+
+// 注册带PDU的URC处理函数(例如+CMT:), URC行和随后的PDU行一起交给h处理.
+func (e *Engine) HandleURCWithPDU(prefix string, h URCHandler) {
+	e.handle(&urcEntry{prefix: prefix, pdu: true, handler: h})
+}
+
+// 注册处理其他未请求的行的函数.
+func (e *Engine) HandleUnsolicited(h URCHandler) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.unhandled = h
+}
+
+func (e *Engine) handle(u *urcEntry) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for i, o := range e.urcs {
+		if o.prefix == u.prefix {
+			e.urcs[i] = u
+			return
+		}
+	}
+	e.urcs = append(e.urcs, u)
+}
+
+// 接收协程退出时关闭.
+func (e *Engine) Done() <-chan struct{} {
+	return e.done
+}
+
+// 返回接收协程退出的原因.
+func (e *Engine) Err() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.err
+}
+
+// 发送AT命令并等待最终结果码.
+// timeout 为0时使用DefaultTimeout.
+func (e *Engine) Command(cmd string, timeout time.Duration) (*Response, error) {
+	return e.Send(&Command{Cmd: cmd, Timeout: timeout})
+}
+
+// 发送AT命令并等待最终结果码.
+// return 响应, 错误; 最终结果码为错误时返回对应的错误, 例如*CMEError.
+func (e *Engine) Send(c *Command) (*Response, error) {
+	e.cmdLock.Lock()
+	defer e.cmdLock.Unlock()
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	p := &call{
+		cmd:    c,
+		prompt: make(chan struct{}),
+		result: make(chan error, 1),
+	}
+
+	// 超时命令的结果可能迟到, 不能当作这条命令的结果
+	if e.stale {
+		if err := e.resync(timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := e.setPending(p); err != nil {
+		return nil, err
+	}
+	defer e.setPending(nil)
+
+	e.debug(`GSMAT: -> "%s"`, c.Cmd)
+	if _, err := e.rw.Write([]byte(c.Cmd + "\r")); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	if c.Data != nil {
+		select {
+		case <-p.prompt:
+		case err := <-p.result:
+			return &p.resp, err
+		case <-timer.C:
+			// 取消数据输入
+			e.rw.Write([]byte{0x1B})
+			e.stale = true
+			return &p.resp, ErrTimeout
+		case <-e.done:
+			return &p.resp, ErrClosed
+		}
+
+		e.debug(`GSMAT: -> data %d bytes`, len(c.Data))
+		buf := make([]byte, len(c.Data)+1)
+		copy(buf, c.Data)
+		buf[len(c.Data)] = 0x1A
+		if _, err := e.rw.Write(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	select {
+	case err := <-p.result:
+		if err != nil {
+			e.debug(`GSMAT: <- error "%v"`, err)
+		}
+		return &p.resp, err
+	case <-timer.C:
+		e.debug(`GSMAT: "%s" timeout`, c.Cmd)
+		e.stale = true
+		return &p.resp, ErrTimeout
+	case <-e.done:
+		return &p.resp, ErrClosed
+	}
+}
+
+func (e *Engine) setPending(p *call) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if p != nil && e.err != nil {
+		return ErrClosed
+	}
+	e.pending = p
+	return nil
+}
+
+// 重新同步时最后一个结果码之后的静默时间
+const resyncQuiet = time.Millisecond * 100
+
+// 命令超时后重新同步: 模块按顺序应答, 发送AT后丢弃收到的所有行,
+// 直到收到结果码并且之后resyncQuiet内没有新的结果码.
+func (e *Engine) resync(timeout time.Duration) error {
+	p := &call{
+		cmd:    &Command{Cmd: "AT"},
+		prompt: make(chan struct{}),
+		result: make(chan error, 1),
+		sync:   true,
+	}
+	if err := e.setPending(p); err != nil {
+		return err
+	}
+	defer e.setPending(nil)
+
+	e.debug(`GSMAT: -> "AT" resync`)
+	if _, err := e.rw.Write([]byte("AT\r")); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.result:
+	case <-timer.C:
+		e.debug(`GSMAT: resync timeout`)
+		return ErrTimeout
+	case <-e.done:
+		return ErrClosed
+	}
+
+	for {
+		select {
+		case <-p.result:
+		case <-time.After(resyncQuiet):
+			e.stale = false
+			return nil
+		case <-e.done:
+			return ErrClosed
+		}
+	}
+}
+
+func (e *Engine) recvThread() {
+	var err error
+	defer func() {
+		e.lock.Lock()
+		e.err = err
+		e.lock.Unlock()
+		close(e.done)
+	}()
+
+	buf := make([]byte, 1024)
+	line := []byte{}
+	for {
+		var n int
+		n, err = e.rw.Read(buf)
+		if err != nil {
+			if t, ok := err.(interface{ Timeout() bool }); ok && t.Timeout() {
+				continue
+			}
+			e.debug("GSMAT: recvThread %v", err)
+			return
+		}
+
+		for _, c := range buf[:n] {
+			if c == '\n' {
+				// 引号中的换行属于字符串, 例如多行的+CUSD菜单
+				if inQuote(line) && len(line) < maxQuotedLine {
+					line = append(bytes.TrimRight(line, "\r"), c)
+					continue
+				}
+				e.handleLine(strings.TrimSpace(string(line)))
+				line = line[:0]
+				continue
+			}
+
+			line = append(line, c)
+			// "> "提示没有行结束符
+			if c == ' ' && strings.TrimLeft(string(line), "\r") == "> " && e.handlePrompt() {
+				line = line[:0]
+			}
+		}
+	}
+}
+
+// 跨行的字符串最大长度, 超过时不再等待结束的引号
+const maxQuotedLine = 4096
+
+// 判断响应行(以+开头)是否在未结束的字符串中.
+func inQuote(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, "\r"), []byte("+")) && bytes.Count(line, []byte{'"'})%2 == 1
+}
+
+// 处理"> "提示, 返回是否有命令在等待提示.
+func (e *Engine) handlePrompt() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	p := e.pending
+	if p == nil || p.cmd.Data == nil || p.done {
+		return false
+	}
+	select {
+	case <-p.prompt:
+		return false
+	default:
+	}
+
+	e.debug(`GSMAT: <- "> "`)
+	close(p.prompt)
+	return true
+}
+
+func (e *Engine) handleLine(l string) {
+	if l == "" {
+		return
+	}
+
+	e.lock.Lock()
+
+	// 带PDU的URC的第二行
+	if u := e.urcBody; u != nil {
+		lines := append(e.urcLines, l)
+		e.urcBody = nil
+		e.urcLines = nil
+		e.lock.Unlock()
+		e.debug(`GSMAT: <- URC %q`, lines)
+		u.handler(lines)
+		return
+	}
+
+	p := e.pending
+	if p != nil && p.done {
+		p = nil
+	}
+
+	if p != nil {
+		if l == p.cmd.Cmd {
+			// 回显
+			e.lock.Unlock()
+			return
+		}
+		if p.cmd.Prefix != "" && strings.HasPrefix(l, p.cmd.Prefix) {
+			p.resp.Lines = append(p.resp.Lines, l)
+			e.lock.Unlock()
+			e.debug(`GSMAT: <- "%s"`, l)
+			return
+		}
+		if final, err := finalResult(l, p.cmd.CallResult); final && p.sync {
+			select {
+			case p.result <- err:
+			default:
+			}
+			e.lock.Unlock()
+			e.debug(`GSMAT: Drop <- "%s"`, l)
+			return
+		} else if final {
+			p.resp.Result = l
+			p.done = true
+			p.result <- err
+			e.lock.Unlock()
+			e.debug(`GSMAT: <- "%s"`, l)
+			return
+		}
+	}
+
+	for _, u := range e.urcs {
+		if !strings.HasPrefix(l, u.prefix) {
+			continue
+		}
+		if u.pdu {
+			e.urcBody = u
+			e.urcLines = []string{l}
+			e.lock.Unlock()
+			return
+		}
+		e.lock.Unlock()
+		e.debug(`GSMAT: <- URC "%s"`, l)
+		u.handler([]string{l})
+		return
+	}
+
+	if p != nil {
+		p.resp.Lines = append(p.resp.Lines, l)
+		e.lock.Unlock()
+		e.debug(`GSMAT: <- "%s"`, l)
+		return
+	}
+
+	h := e.unhandled
+	e.lock.Unlock()
+	if h != nil {
+		h([]string{l})
+	} else {
+		e.debug(`GSMAT: Drop <- "%s"`, l)
+	}
+}
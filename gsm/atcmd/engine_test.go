@@ -0,0 +1,293 @@
+package atcmd
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 在net.Pipe上模拟模块, reply按收到的命令返回应答.
+func newTestEngine(t *testing.T, reply func(cmd string) string) (*Engine, net.Conn) {
+	host, modem := net.Pipe()
+	go func() {
+		r := bufio.NewReader(modem)
+		cmd := []byte{}
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			// 命令以\r结束, 数据以Ctrl-Z结束
+			if c != '\r' && c != 0x1A {
+				cmd = append(cmd, c)
+				continue
+			}
+			if resp := reply(strings.TrimSpace(string(cmd))); resp != "" {
+				modem.Write([]byte(resp))
+			}
+			cmd = cmd[:0]
+		}
+	}()
+	e := New(host, nil)
+	t.Cleanup(func() {
+		host.Close()
+		modem.Close()
+	})
+	return e, modem
+}
+
+func TestCallEndURCDuringCommand(t *testing.T) {
+	e, _ := newTestEngine(t, func(cmd string) string {
+		switch {
+		case strings.HasPrefix(cmd, "AT+CMGS="):
+			return "\r\n> "
+		case strings.HasPrefix(cmd, "0011"):
+			// 通话在短信发送过程中结束
+			return "\r\nNO CARRIER\r\n\r\nBUSY\r\n\r\n+CMGS: 42\r\n\r\nOK\r\n"
+		}
+		return "\r\nOK\r\n"
+	})
+
+	urcs := make(chan string, 4)
+	for _, code := range []string{"NO CARRIER", "BUSY"} {
+		e.HandleURC(code, func(lines []string) { urcs <- lines[0] })
+	}
+
+	resp, err := e.Send(&Command{Cmd: "AT+CMGS=20", Prefix: "+CMGS:", Data: []byte("0011"), Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("AT+CMGS: %v", err)
+	}
+	if v, _ := resp.Value("+CMGS:"); v != "42" {
+		t.Fatalf("+CMGS = %q, want 42", v)
+	}
+
+	for _, want := range []string{"NO CARRIER", "BUSY"} {
+		select {
+		case got := <-urcs:
+			if got != want {
+				t.Fatalf("URC %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("URC %q not delivered", want)
+		}
+	}
+}
+
+func TestCallResultFinal(t *testing.T) {
+	e, _ := newTestEngine(t, func(cmd string) string {
+		switch cmd {
+		case "ATD112;":
+			return "\r\nBUSY\r\n"
+		case "ATA":
+			return "\r\nNO CARRIER\r\n"
+		}
+		return "\r\nOK\r\n"
+	})
+
+	if _, err := e.Send(&Command{Cmd: "ATD112;", CallResult: true, Timeout: time.Second}); err != ErrBusy {
+		t.Fatalf("ATD: %v, want %v", err, ErrBusy)
+	}
+	if _, err := e.Send(&Command{Cmd: "ATA", CallResult: true, Timeout: time.Second}); err != ErrNoCarrier {
+		t.Fatalf("ATA: %v, want %v", err, ErrNoCarrier)
+	}
+	// 不是通话命令时不是最终结果码, 命令超时
+	if _, err := e.Send(&Command{Cmd: "ATA", Timeout: time.Millisecond * 200}); err != ErrTimeout {
+		t.Fatalf("ATA without CallResult: %v, want %v", err, ErrTimeout)
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want error
+	}{
+		{"ERROR", ErrError},
+		{"+CME ERROR: 10", &CMEError{Code: CME_SIM_NOT_INSERTED, Text: "SIM not inserted"}},
+		{"+CME ERROR: SIM PIN required", &CMEError{Code: CME_SIM_PIN_REQUIRED, Text: "SIM PIN required"}},
+		{"+CME ERROR: 765", &CMEError{Code: 765, Text: "unknown"}},
+		{"+CME ERROR: invalid input value", &CMEError{Code: -1, Text: "invalid input value"}},
+		{"+CMS ERROR: 500", &CMSError{Code: CMS_UNKNOWN, Text: "unknown error"}},
+		{"+CMS ERROR: 321", &CMSError{Code: CMS_INVALID_INDEX, Text: "invalid memory index"}},
+		{"+CMS ERROR: SMSC address unknown", &CMSError{Code: CMS_SMSC_UNKNOWN, Text: "SMSC address unknown"}},
+	} {
+		e, _ := newTestEngine(t, func(cmd string) string {
+			return "\r\n" + c.line + "\r\n"
+		})
+		_, err := e.Command("AT+CMGR=1", time.Second)
+		switch want := c.want.(type) {
+		case *CMEError:
+			if got, ok := err.(*CMEError); !ok || *got != *want {
+				t.Errorf("%q: %#v, want %#v", c.line, err, want)
+			}
+		case *CMSError:
+			if got, ok := err.(*CMSError); !ok || *got != *want {
+				t.Errorf("%q: %#v, want %#v", c.line, err, want)
+			}
+		default:
+			if err != want {
+				t.Errorf("%q: %v, want %v", c.line, err, want)
+			}
+		}
+	}
+
+	if !IsCME(&CMEError{Code: CME_SIM_BUSY}, CME_SIM_BUSY) || IsCME(ErrError, CME_SIM_BUSY) {
+		t.Error("IsCME")
+	}
+	if !IsCMS(&CMSError{Code: CMS_MEMORY_FULL}, CMS_MEMORY_FULL) || IsCMS(&CMEError{Code: CMS_MEMORY_FULL}, CMS_MEMORY_FULL) {
+		t.Error("IsCMS")
+	}
+}
+
+func TestPromptData(t *testing.T) {
+	received := make(chan string, 4)
+	e, _ := newTestEngine(t, func(cmd string) string {
+		received <- cmd
+		switch {
+		case cmd == "AT+CMGS=18":
+			return "\r\n> "
+		case cmd == "AT+CMGW=18":
+			// 不给提示
+			return ""
+		case strings.HasPrefix(cmd, "0011"):
+			return "\r\n+CMGS: 7\r\n\r\nOK\r\n"
+		}
+		return "\r\nOK\r\n"
+	})
+
+	pdu := "0011000B916407281553F80000AA0AE8329BFD4697D9EC37"
+	resp, err := e.Send(&Command{Cmd: "AT+CMGS=18", Prefix: "+CMGS:", Data: []byte(pdu), Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := resp.Value("+CMGS:"); v != "7" {
+		t.Fatalf("+CMGS = %q", v)
+	}
+	for _, want := range []string{"AT+CMGS=18", pdu} {
+		if got := <-received; got != want {
+			t.Fatalf("modem received %q, want %q", got, want)
+		}
+	}
+
+	// 没有提示时超时, 用ESC取消数据输入
+	_, err = e.Send(&Command{Cmd: "AT+CMGW=18", Data: []byte(pdu), Timeout: time.Millisecond * 200})
+	if err != ErrTimeout {
+		t.Fatalf("AT+CMGW without prompt: %v", err)
+	}
+	if got := <-received; got != "AT+CMGW=18" {
+		t.Fatalf("modem received %q", got)
+	}
+	if _, err := e.Command("AT+CMGF=0", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != "\x1bAT" {
+		t.Fatalf("modem received %q, want ESC and the resync", got)
+	}
+}
+
+func TestIntermediateLines(t *testing.T) {
+	e, _ := newTestEngine(t, func(cmd string) string {
+		switch cmd {
+		case "ATI":
+			return "\r\nSIM800 R14.18\r\n\r\nOK\r\n"
+		case "AT+CMGL=4":
+			return "\r\n+CMGL: 1,1,,24\r\n0791683108200505F0040D91\r\n+CMGL: 2,1,,24\r\n0791683108200505F0040D92\r\n\r\nOK\r\n"
+		case "AT+CPMS?":
+			return "\r\n+CPMS: \"SM\",3,50,\"SM\",3,50,\"SM\",3,50\r\n\r\nOK\r\n"
+		}
+		return "\r\nOK\r\n"
+	})
+	// 与命令前缀相同的URC
+	e.HandleURC("+CPMS:", func(lines []string) { t.Errorf("URC %q", lines) })
+
+	for _, c := range []struct {
+		cmd, prefix string
+		want        []string
+	}{
+		{"ATI", "", []string{"SIM800 R14.18"}},
+		{"AT+CMGL=4", "+CMGL:", []string{"+CMGL: 1,1,,24", "0791683108200505F0040D91", "+CMGL: 2,1,,24", "0791683108200505F0040D92"}},
+		{"AT+CPMS?", "+CPMS:", []string{`+CPMS: "SM",3,50,"SM",3,50,"SM",3,50`}},
+	} {
+		resp, err := e.Send(&Command{Cmd: c.cmd, Prefix: c.prefix, Timeout: time.Second})
+		if err != nil {
+			t.Fatalf("%s: %v", c.cmd, err)
+		}
+		if strings.Join(resp.Lines, "|") != strings.Join(c.want, "|") || resp.Result != "OK" {
+			t.Fatalf("%s: lines %q, result %q", c.cmd, resp.Lines, resp.Result)
+		}
+	}
+}
+
+func TestURCDuringCommand(t *testing.T) {
+	e, _ := newTestEngine(t, func(cmd string) string {
+		if cmd == "AT+CSQ" {
+			return "\r\n+CMTI: \"SM\",3\r\n+CSQ: 20,99\r\n\r\n+CMT: ,24\r\n07913396050036F0040B913396\r\n\r\nRING\r\n\r\nOK\r\n"
+		}
+		return "\r\nOK\r\n"
+	})
+
+	urcs := make(chan []string, 4)
+	e.HandleURC("+CMTI:", func(lines []string) { urcs <- lines })
+	e.HandleURCWithPDU("+CMT:", func(lines []string) { urcs <- lines })
+	e.HandleURC("RING", func(lines []string) { urcs <- lines })
+
+	resp, err := e.Send(&Command{Cmd: "AT+CSQ", Prefix: "+CSQ:", Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(resp.Lines, "|") != "+CSQ: 20,99" {
+		t.Fatalf("lines %q", resp.Lines)
+	}
+
+	for _, want := range []string{`+CMTI: "SM",3`, "+CMT: ,24|07913396050036F0040B913396", "RING"} {
+		select {
+		case got := <-urcs:
+			if strings.Join(got, "|") != want {
+				t.Fatalf("URC %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("URC %q not delivered", want)
+		}
+	}
+}
+
+func TestLateResultAfterTimeout(t *testing.T) {
+	e, _ := newTestEngine(t, func(cmd string) string {
+		switch cmd {
+		case "AT+COPS=?":
+			// 应答超过命令的超时时间
+			time.Sleep(time.Millisecond * 300)
+			return "\r\n+COPS: (2,\"CHN-UNICOM\",\"UNICOM\",\"46001\",7)\r\n\r\nOK\r\n"
+		case "AT+CSQ":
+			return "\r\n+CSQ: 20,99\r\n\r\nOK\r\n"
+		case "AT+CMGD=1":
+			// 没有应答
+			return ""
+		}
+		return "\r\nOK\r\n"
+	})
+
+	if _, err := e.Send(&Command{Cmd: "AT+COPS=?", Prefix: "+COPS:", Timeout: time.Millisecond * 100}); err != ErrTimeout {
+		t.Fatalf("AT+COPS=?: %v, want %v", err, ErrTimeout)
+	}
+	resp, err := e.Send(&Command{Cmd: "AT+CSQ", Prefix: "+CSQ:", Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := resp.Value("+CSQ:"); v != "20,99" {
+		t.Fatalf("+CSQ = %q, lines %q: the late result was taken", v, resp.Lines)
+	}
+
+	// 超时的命令一直没有应答
+	if _, err := e.Send(&Command{Cmd: "AT+CMGD=1", Timeout: time.Millisecond * 100}); err != ErrTimeout {
+		t.Fatalf("AT+CMGD: %v, want %v", err, ErrTimeout)
+	}
+	resp, err = e.Send(&Command{Cmd: "AT+CSQ", Prefix: "+CSQ:", Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := resp.Value("+CSQ:"); v != "20,99" {
+		t.Fatalf("+CSQ = %q, lines %q", v, resp.Lines)
+	}
+}
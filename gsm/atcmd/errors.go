@@ -0,0 +1,192 @@
+package atcmd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 最终结果码对应的错误
+var (
+	ErrError      = errors.New("ERROR")
+	ErrNoCarrier  = errors.New("NO CARRIER")
+	ErrBusy       = errors.New("BUSY")
+	ErrNoAnswer   = errors.New("NO ANSWER")
+	ErrNoDialtone = errors.New("NO DIALTONE")
+
+	ErrTimeout = errors.New("AT command timeout")
+	ErrClosed  = errors.New("AT engine closed")
+)
+
+// 常用的+CME ERROR错误码(3GPP TS 27.007 9.2)
+const (
+	CME_PHONE_FAILURE      = 0
+	CME_NOT_ALLOWED        = 3
+	CME_NOT_SUPPORTED      = 4
+	CME_SIM_NOT_INSERTED   = 10
+	CME_SIM_PIN_REQUIRED   = 11
+	CME_SIM_PUK_REQUIRED   = 12
+	CME_SIM_FAILURE        = 13
+	CME_SIM_BUSY           = 14
+	CME_SIM_WRONG          = 15
+	CME_INCORRECT_PASSWORD = 16
+	CME_SIM_PIN2_REQUIRED  = 17
+	CME_SIM_PUK2_REQUIRED  = 18
+	CME_MEMORY_FULL        = 20
+	CME_INVALID_INDEX      = 21
+	CME_NOT_FOUND          = 22
+	CME_NO_NETWORK         = 30
+	CME_NETWORK_TIMEOUT    = 31
+	CME_EMERGENCY_ONLY     = 32
+	CME_UNKNOWN            = 100
+)
+
+var cmeTexts = map[int]string{
+	CME_PHONE_FAILURE:      "phone failure",
+	CME_NOT_ALLOWED:        "operation not allowed",
+	CME_NOT_SUPPORTED:      "operation not supported",
+	CME_SIM_NOT_INSERTED:   "SIM not inserted",
+	CME_SIM_PIN_REQUIRED:   "SIM PIN required",
+	CME_SIM_PUK_REQUIRED:   "SIM PUK required",
+	CME_SIM_FAILURE:        "SIM failure",
+	CME_SIM_BUSY:           "SIM busy",
+	CME_SIM_WRONG:          "SIM wrong",
+	CME_INCORRECT_PASSWORD: "incorrect password",
+	CME_SIM_PIN2_REQUIRED:  "SIM PIN2 required",
+	CME_SIM_PUK2_REQUIRED:  "SIM PUK2 required",
+	CME_MEMORY_FULL:        "memory full",
+	CME_INVALID_INDEX:      "invalid index",
+	CME_NOT_FOUND:          "not found",
+	CME_NO_NETWORK:         "no network service",
+	CME_NETWORK_TIMEOUT:    "network timeout",
+	CME_EMERGENCY_ONLY:     "network not allowed - emergency calls only",
+	CME_UNKNOWN:            "unknown",
+}
+
+// 常用的+CMS ERROR错误码(3GPP TS 27.005 3.2.5)
+const (
+	CMS_ME_FAILURE          = 300
+	CMS_SMS_SERVICE_FAILURE = 301
+	CMS_NOT_ALLOWED         = 302
+	CMS_NOT_SUPPORTED       = 303
+	CMS_INVALID_PDU_PARAM   = 304
+	CMS_INVALID_TEXT_PARAM  = 305
+	CMS_SIM_NOT_INSERTED    = 310
+	CMS_SIM_PIN_REQUIRED    = 311
+	CMS_SIM_FAILURE         = 313
+	CMS_SIM_BUSY            = 314
+	CMS_MEMORY_FAILURE      = 320
+	CMS_INVALID_INDEX       = 321
+	CMS_MEMORY_FULL         = 322
+	CMS_SMSC_UNKNOWN        = 330
+	CMS_NO_NETWORK          = 331
+	CMS_NETWORK_TIMEOUT     = 332
+	CMS_UNKNOWN             = 500
+)
+
+var cmsTexts = map[int]string{
+	CMS_ME_FAILURE:          "ME failure",
+	CMS_SMS_SERVICE_FAILURE: "SMS service of ME reserved",
+	CMS_NOT_ALLOWED:         "operation not allowed",
+	CMS_NOT_SUPPORTED:       "operation not supported",
+	CMS_INVALID_PDU_PARAM:   "invalid PDU mode parameter",
+	CMS_INVALID_TEXT_PARAM:  "invalid text mode parameter",
+	CMS_SIM_NOT_INSERTED:    "SIM not inserted",
+	CMS_SIM_PIN_REQUIRED:    "SIM PIN required",
+	CMS_SIM_FAILURE:         "SIM failure",
+	CMS_SIM_BUSY:            "SIM busy",
+	CMS_MEMORY_FAILURE:      "memory failure",
+	CMS_INVALID_INDEX:       "invalid memory index",
+	CMS_MEMORY_FULL:         "memory full",
+	CMS_SMSC_UNKNOWN:        "SMSC address unknown",
+	CMS_NO_NETWORK:          "no network service",
+	CMS_NETWORK_TIMEOUT:     "network timeout",
+	CMS_UNKNOWN:             "unknown error",
+}
+
+// 移动设备错误(+CME ERROR).
+// 模块工作在AT+CMEE=2时只返回文字, 表中找不到对应的错误码时Code为-1.
+type CMEError struct {
+	Code int
+	Text string
+}
+
+func (e *CMEError) Error() string {
+	return fmt.Sprintf("+CME ERROR: %d (%s)", e.Code, e.Text)
+}
+
+// 短信服务错误(+CMS ERROR).
+type CMSError struct {
+	Code int
+	Text string
+}
+
+func (e *CMSError) Error() string {
+	return fmt.Sprintf("+CMS ERROR: %d (%s)", e.Code, e.Text)
+}
+
+// 判断err是否为指定错误码的+CME ERROR.
+func IsCME(err error, code int) bool {
+	var e *CMEError
+	return errors.As(err, &e) && e.Code == code
+}
+
+// 判断err是否为指定错误码的+CMS ERROR.
+func IsCMS(err error, code int) bool {
+	var e *CMSError
+	return errors.As(err, &e) && e.Code == code
+}
+
+// 解析错误码, 数字或者表中的文字.
+func parseCode(s string, texts map[int]string) (int, string) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.Atoi(s); err == nil {
+		text, ok := texts[n]
+		if !ok {
+			text = "unknown"
+		}
+		return n, text
+	}
+	for n, text := range texts {
+		if strings.EqualFold(text, s) {
+			return n, s
+		}
+	}
+	return -1, s
+}
+
+// 判断是否为最终结果码, 是则返回对应的错误(成功时为nil).
+// callResult 为false时通话结束的结果码不是最终结果码.
+func finalResult(line string, callResult bool) (bool, error) {
+	if !callResult {
+		switch line {
+		case "NO CARRIER", "BUSY", "NO ANSWER", "NO DIALTONE":
+			return false, nil
+		}
+	}
+
+	switch {
+	case line == "OK":
+		return true, nil
+	case line == "CONNECT" || strings.HasPrefix(line, "CONNECT "):
+		return true, nil
+	case line == "ERROR":
+		return true, ErrError
+	case line == "NO CARRIER":
+		return true, ErrNoCarrier
+	case line == "BUSY":
+		return true, ErrBusy
+	case line == "NO ANSWER":
+		return true, ErrNoAnswer
+	case line == "NO DIALTONE":
+		return true, ErrNoDialtone
+	case strings.HasPrefix(line, "+CME ERROR:"):
+		code, text := parseCode(line[len("+CME ERROR:"):], cmeTexts)
+		return true, &CMEError{Code: code, Text: text}
+	case strings.HasPrefix(line, "+CMS ERROR:"):
+		code, text := parseCode(line[len("+CMS ERROR:"):], cmsTexts)
+		return true, &CMSError{Code: code, Text: text}
+	}
+	return false, nil
+}
@@ -0,0 +1,38 @@
+package atcmd
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 把AT响应的参数列表按逗号分开, 引号内的逗号不分开, 并去掉引号.
+// 例如 `"+8613800000000",145,,"name"` 分为 +8613800000000 145 "" name.
+func SplitParams(s string) []string {
+	params := []string{}
+	var cur strings.Builder
+	quoted := false
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			params = append(params, strings.TrimSpace(cur.String()))
+			cur.Reset()
+		default:
+			cur.WriteRune(c)
+		}
+	}
+	return append(params, strings.TrimSpace(cur.String()))
+}
+
+// 返回参数列表中第i个参数的整数值, 不存在或不是整数时返回def.
+func IntParam(params []string, i int, def int) int {
+	if i >= len(params) {
+		return def
+	}
+	n, err := strconv.Atoi(params[i])
+	if err != nil {
+		return def
+	}
+	return n
+}
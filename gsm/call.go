@@ -0,0 +1,305 @@
+package gsm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xiqingping/golibs/gsm/atcmd"
+)
+
+// 通话状态, 0到5与+CLCC的<stat>相同.
+type CallState int
+
+const (
+	CALL_ACTIVE CallState = iota
+	CALL_HELD
+	CALL_DIALING
+	CALL_ALERTING
+	CALL_INCOMING
+	CALL_WAITING
+
+	// 通话结束的原因
+	CALL_ENDED // 挂断或NO CARRIER
+	CALL_BUSY
+	CALL_NO_ANSWER
+	CALL_NO_DIALTONE
+)
+
+func (s CallState) String() string {
+	switch s {
+	case CALL_ACTIVE:
+		return "active"
+	case CALL_HELD:
+		return "held"
+	case CALL_DIALING:
+		return "dialing"
+	case CALL_ALERTING:
+		return "alerting"
+	case CALL_INCOMING:
+		return "incoming"
+	case CALL_WAITING:
+		return "waiting"
+	case CALL_ENDED:
+		return "ended"
+	case CALL_BUSY:
+		return "busy"
+	case CALL_NO_ANSWER:
+		return "no answer"
+	case CALL_NO_DIALTONE:
+		return "no dialtone"
+	}
+	return "unknown"
+}
+
+// 通话是否已结束.
+func (s CallState) Ended() bool {
+	return s >= CALL_ENDED
+}
+
+// 通话查询(AT+CLCC)的轮询间隔
+const CALL_POLL_INTERVAL = time.Second
+
+// 拨号和接听的超时时间
+const CALL_TIMEOUT = time.Second * 60
+
+// 一个通话(+CLCC).
+type Call struct {
+	ID       int
+	Incoming bool
+	State    CallState
+	Voice    bool // <mode>为0
+	Number   string
+	Type     int // 号码类型, 145为国际号码
+}
+
+// 通话状态变化, 连接, 占线, 无应答和挂断都通过此事件通知.
+type CallEvent struct {
+	Call
+}
+
+func (*CallEvent) isEvent() {}
+
+// 结束通话的最终结果码对应的状态, 不是时返回false.
+func callEndState(err error) (CallState, bool) {
+	switch err {
+	case atcmd.ErrNoCarrier:
+		return CALL_ENDED, true
+	case atcmd.ErrBusy:
+		return CALL_BUSY, true
+	case atcmd.ErrNoAnswer:
+		return CALL_NO_ANSWER, true
+	case atcmd.ErrNoDialtone:
+		return CALL_NO_DIALTONE, true
+	}
+	return 0, false
+}
+
+// 查询当前通话.
+func (g *Gsm) Calls() ([]Call, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.calls()
+}
+
+func (g *Gsm) calls() ([]Call, error) {
+	resp, err := g.mAT.Send(&atcmd.Command{Cmd: "AT+CLCC", Prefix: "+CLCC:", Timeout: time.Second * 2})
+	if err != nil {
+		return nil, err
+	}
+
+	calls := []Call{}
+	for _, v := range resp.Values("+CLCC:") {
+		// <id>,<dir>,<stat>,<mode>,<mpty>[,<number>,<type>[,<alpha>]]
+		params := atcmd.SplitParams(v)
+		c := Call{
+			ID:       atcmd.IntParam(params, 0, 0),
+			Incoming: atcmd.IntParam(params, 1, 0) == 1,
+			State:    CallState(atcmd.IntParam(params, 2, 0)),
+			Voice:    atcmd.IntParam(params, 3, 0) == 0,
+			Type:     atcmd.IntParam(params, 6, 0),
+		}
+		if len(params) > 5 {
+			c.Number = params[5]
+		}
+		calls = append(calls, c)
+	}
+	return calls, nil
+}
+
+// 检查号码是否可以拨打.
+func checkDialNumber(number string) error {
+	if number == "" {
+		return fmt.Errorf("Empty dial number")
+	}
+	for i, c := range number {
+		if !(c >= '0' && c <= '9' || c == '*' || c == '#' || c == '+' && i == 0) {
+			return fmt.Errorf(`Invalid dial number "%s"`, number)
+		}
+	}
+	return nil
+}
+
+// 拨打语音电话, 对方接听, 占线, 无应答等通过CallEvent通知.
+// 模块在接通后才返回时, 占线和无应答也作为错误返回.
+func (g *Gsm) Dial(number string) error {
+	if err := checkDialNumber(number); err != nil {
+		return err
+	}
+
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+
+	g.mCallLock.Lock()
+	g.mCallEnd = CALL_ENDED
+	g.mCallLock.Unlock()
+
+	_, err := g.mAT.Send(&atcmd.Command{Cmd: "ATD" + number + ";", CallResult: true, Timeout: CALL_TIMEOUT})
+	if state, ok := callEndState(err); ok {
+		g.emit(&CallEvent{Call{Number: number, State: state, Voice: true}})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	g.mCallLock.Lock()
+	g.mDialNumber = number
+	g.mCallLock.Unlock()
+	g.watchCalls()
+	return nil
+}
+
+// 接听来电.
+func (g *Gsm) Answer() error {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	_, err := g.mAT.Send(&atcmd.Command{Cmd: "ATA", CallResult: true, Timeout: CALL_TIMEOUT})
+	if state, ok := callEndState(err); ok {
+		g.setCallEnd(state)
+	}
+	g.watchCalls()
+	return err
+}
+
+// 挂断所有通话.
+func (g *Gsm) Hangup() error {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	_, err := g.mAT.Send(&atcmd.Command{Cmd: "ATH", CallResult: true, Timeout: time.Second * 5})
+	return err
+}
+
+// 在通话中发送DTMF, digits为0-9, *, #和A-D.
+func (g *Gsm) SendDTMF(digits string) error {
+	for _, c := range strings.ToUpper(digits) {
+		if !(c >= '0' && c <= '9' || c == '*' || c == '#' || c >= 'A' && c <= 'D') {
+			return fmt.Errorf(`Invalid DTMF digits "%s"`, digits)
+		}
+	}
+
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	for _, c := range strings.ToUpper(digits) {
+		if _, err := g.mAT.Command(fmt.Sprintf("AT+VTS=%c", c), time.Second*5); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 记录通话结束的原因, 通话消失时随CallEvent送出.
+func (g *Gsm) setCallEnd(state CallState) {
+	g.mCallLock.Lock()
+	defer g.mCallLock.Unlock()
+	g.mCallEnd = state
+}
+
+// 开始轮询通话状态, 没有通话后自动停止.
+// 可以在接收协程中调用.
+func (g *Gsm) watchCalls() {
+	g.mCallLock.Lock()
+	defer g.mCallLock.Unlock()
+	if g.mCallPolling {
+		return
+	}
+	g.mCallPolling = true
+	go g.pollCalls()
+}
+
+func (g *Gsm) pollCalls() {
+	failures := 0
+	for {
+		select {
+		case <-time.After(CALL_POLL_INTERVAL):
+		case <-g.mAT.Done():
+			return
+		}
+
+		g.mMutex.Lock()
+		calls, err := g.calls()
+		g.mMutex.Unlock()
+
+		if err != nil {
+			g.mLogger.Warn(`GSMCALL: Query calls error "%v"`, err)
+			if failures++; failures >= 3 {
+				g.stopCalls()
+				return
+			}
+			continue
+		}
+		failures = 0
+
+		if !g.updateCalls(calls) {
+			return
+		}
+	}
+}
+
+// 停止轮询, 清除通话状态.
+func (g *Gsm) stopCalls() {
+	g.mCallLock.Lock()
+	defer g.mCallLock.Unlock()
+	g.resetCalls()
+}
+
+// 清除通话状态, 调用者持有mCallLock.
+func (g *Gsm) resetCalls() {
+	g.mCalls = make(map[int]Call)
+	g.mDialNumber = ""
+	g.mCallEnd = CALL_ENDED
+	g.mCallPolling = false
+}
+
+// 比较通话状态并发送CallEvent, 返回是否继续轮询.
+func (g *Gsm) updateCalls(calls []Call) bool {
+	g.mCallLock.Lock()
+	defer g.mCallLock.Unlock()
+
+	current := map[int]Call{}
+	for _, c := range calls {
+		current[c.ID] = c
+		if old, ok := g.mCalls[c.ID]; !ok || old.State != c.State {
+			g.emit(&CallEvent{c})
+		}
+	}
+	for id, c := range g.mCalls {
+		if _, ok := current[id]; !ok {
+			c.State = g.mCallEnd
+			g.emit(&CallEvent{c})
+		}
+	}
+	if len(current) > 0 {
+		g.mDialNumber = ""
+	} else if len(g.mCalls) == 0 && g.mDialNumber != "" {
+		// 拨出的通话在查询到之前就结束了
+		g.emit(&CallEvent{Call{Number: g.mDialNumber, State: g.mCallEnd, Voice: true}})
+	}
+	g.mCalls = current
+
+	if len(current) > 0 {
+		return true
+	}
+	g.resetCalls()
+	return false
+}
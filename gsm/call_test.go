@@ -0,0 +1,92 @@
+package gsm
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCalls(t *testing.T) {
+	g, _ := newTestGsm(t, func(cmd string) string {
+		if cmd != "AT+CLCC" {
+			return "\r\nERROR\r\n"
+		}
+		return "\r\n+CLCC: 1,0,0,0,0,\"+8613800138000\",145,\"\"\r\n" +
+			"+CLCC: 2,1,5,0,0,\"10086\",129\r\n" +
+			"+CLCC: 3,1,4,1,0\r\n\r\nOK\r\n"
+	})
+
+	calls, err := g.Calls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Call{
+		{ID: 1, State: CALL_ACTIVE, Voice: true, Number: "+8613800138000", Type: 145},
+		{ID: 2, Incoming: true, State: CALL_WAITING, Voice: true, Number: "10086", Type: 129},
+		{ID: 3, Incoming: true, State: CALL_INCOMING},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("calls %+v, want %+v", calls, want)
+	}
+}
+
+// 每一步是一次AT+CLCC查询的结果, 以及随后送出的CallEvent.
+func TestUpdateCalls(t *testing.T) {
+	type step struct {
+		dial   string    // 拨出但还没有查询到的号码
+		end    CallState // 查询前收到的结束原因
+		calls  []Call
+		events string // id:number:state
+		more   bool
+	}
+	call := func(id int, state CallState) Call {
+		return Call{ID: id, State: state, Voice: true, Number: "10086"}
+	}
+
+	for _, c := range []struct {
+		name  string
+		steps []step
+	}{
+		{"dial", []step{
+			{dial: "10086", calls: []Call{call(1, CALL_DIALING)}, events: "1:10086:dialing", more: true},
+			{calls: []Call{call(1, CALL_ALERTING)}, events: "1:10086:alerting", more: true},
+			{calls: []Call{call(1, CALL_ACTIVE)}, events: "1:10086:active", more: true},
+			{calls: []Call{call(1, CALL_ACTIVE)}, more: true},
+			{calls: nil, events: "1:10086:ended"},
+		}},
+		{"busy before the first query", []step{
+			{dial: "10086", end: CALL_BUSY, events: "0:10086:busy"},
+		}},
+		{"no answer", []step{
+			{dial: "10086", calls: []Call{call(1, CALL_ALERTING)}, events: "1:10086:alerting", more: true},
+			{end: CALL_NO_ANSWER, events: "1:10086:no answer"},
+		}},
+		{"waiting call", []step{
+			{calls: []Call{call(1, CALL_ACTIVE), call(2, CALL_WAITING)}, events: "1:10086:active,2:10086:waiting", more: true},
+			{calls: []Call{call(1, CALL_HELD), call(2, CALL_ACTIVE)}, events: "1:10086:held,2:10086:active", more: true},
+			{calls: []Call{call(2, CALL_ACTIVE)}, events: "1:10086:ended", more: true},
+			{events: "2:10086:ended"},
+		}},
+	} {
+		g := &Gsm{mChanEvents: make(chan Event, EVENT_BUFFER_SIZE), mCalls: map[int]Call{}, mCallEnd: CALL_ENDED}
+		for i, s := range c.steps {
+			if s.dial != "" {
+				g.mDialNumber = s.dial
+			}
+			if s.end != 0 {
+				g.setCallEnd(s.end)
+			}
+			more := g.updateCalls(s.calls)
+
+			events := []string{}
+			for len(g.mChanEvents) > 0 {
+				ev := (<-g.mChanEvents).(*CallEvent)
+				events = append(events, fmt.Sprintf("%d:%s:%v", ev.ID, ev.Number, ev.State))
+			}
+			if got := strings.Join(events, ","); got != s.events || more != s.more {
+				t.Errorf("%s, step %d: events %q, continue %v, want %q, %v", c.name, i, got, more, s.events, s.more)
+			}
+		}
+	}
+}
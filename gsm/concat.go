@@ -0,0 +1,226 @@
+package gsm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xlab/at/sms"
+)
+
+// 长短信重组的默认超时时间, 超时后不完整的长短信被丢弃.
+// 存储模式下已收到的分段仍留在存储器中, 下次Init时重新读出.
+const SMS_REASSEMBLY_TIMEOUT = time.Minute * 3
+
+// 长短信的标识: 发送者, 参考号, 总条数
+type concatKey struct {
+	sender string
+	ref    int
+	total  int
+}
+
+// 正在重组的长短信
+type partialSMS struct {
+	msg   *sms.Message // 第一条收到的分段, 重组后替换内容
+	parts []string
+	index []int // 存储模式下各分段在存储器中的位置, 没有时为-1
+	count int
+	timer *time.Timer
+}
+
+// 设置发送长短信时是否使用16位参考号, 默认使用8位参考号.
+func (g *Gsm) SetConcatRef16(on bool) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	g.mConcatRef16 = on
+}
+
+// 设置长短信重组的超时时间, 从收到第一条分段开始计算.
+// d <= 0 时使用SMS_REASSEMBLY_TIMEOUT.
+func (g *Gsm) SetReassemblyTimeout(d time.Duration) {
+	g.mPartsLock.Lock()
+	defer g.mPartsLock.Unlock()
+	if d <= 0 {
+		d = SMS_REASSEMBLY_TIMEOUT
+	}
+	g.mReassemblyTimeout = d
+}
+
+// 生成下一个长短信参考号.
+func (g *Gsm) nextConcatRef() int {
+	g.mConcatRef++
+	if g.mConcatRef16 {
+		return g.mConcatRef & 0xFFFF
+	}
+	return g.mConcatRef & 0xFF
+}
+
+// 收到长短信的一个分段, 收齐后作为一条短信送出.
+// index 分段在存储器中的位置, 送出后删除; 直接上报的短信为-1.
+func (g *Gsm) addPart(msg *sms.Message, d *deliverPDU, index int) {
+	c := d.concat
+	if c.total < 1 || c.seq < 1 || c.seq > c.total {
+		g.mLogger.Warn(`GSMSMS: Invalid concatenated sms part %d/%d from "%v"`, c.seq, c.total, d.sender)
+		return
+	}
+
+	key := concatKey{sender: d.sender, ref: c.ref, total: c.total}
+
+	g.mPartsLock.Lock()
+	if g.mPartsClosed {
+		g.mPartsLock.Unlock()
+		return
+	}
+	p, ok := g.mParts[key]
+	if !ok {
+		p = &partialSMS{msg: msg, parts: make([]string, c.total), index: make([]int, c.total)}
+		for i := range p.index {
+			p.index[i] = -1
+		}
+		p.timer = time.AfterFunc(g.mReassemblyTimeout, func() { g.expirePart(key, p) })
+		g.mParts[key] = p
+	}
+	if p.parts[c.seq-1] == "" {
+		p.count++
+	}
+	p.parts[c.seq-1] = d.text
+	p.index[c.seq-1] = index
+	if c.seq == 1 {
+		p.msg = msg
+	}
+
+	if p.count < c.total {
+		g.mPartsLock.Unlock()
+		return
+	}
+	p.timer.Stop()
+	delete(g.mParts, key)
+	g.mPartsLock.Unlock()
+
+	p.msg.Text = strings.Join(p.parts, "")
+	if stored := p.storedIndex(); len(stored) > 0 {
+		if g.deliverSMSWait(p.msg) {
+			g.deleteStored(stored)
+		} else {
+			g.releaseStored(stored)
+		}
+		return
+	}
+	g.deliverSMS(p.msg)
+}
+
+// 返回已保存在存储器中的分段位置.
+func (p *partialSMS) storedIndex() []int {
+	stored := []int{}
+	for _, index := range p.index {
+		if index >= 0 {
+			stored = append(stored, index)
+		}
+	}
+	return stored
+}
+
+// 重组超时, 丢弃不完整的长短信.
+// 存储器中的分段不删除, 直到重组完成或者被DeleteSMS删除.
+func (g *Gsm) expirePart(key concatKey, p *partialSMS) {
+	g.mPartsLock.Lock()
+	defer g.mPartsLock.Unlock()
+	if g.mParts[key] != p {
+		return
+	}
+	delete(g.mParts, key)
+	stored := p.storedIndex()
+	for _, index := range stored {
+		delete(g.mTaken, index)
+	}
+	g.mLogger.Warn(`GSMSMS: Drop incomplete sms from "%v", %d of %d parts received, %d kept in storage`,
+		key.sender, p.count, key.total, len(stored))
+}
+
+// 存储器中index位置的短信已被删除, 重组完成时不再删除这个位置.
+func (g *Gsm) forgetStored(index int) {
+	g.mPartsLock.Lock()
+	defer g.mPartsLock.Unlock()
+	delete(g.mTaken, index)
+	for _, p := range g.mParts {
+		for i := range p.index {
+			if p.index[i] == index {
+				p.index[i] = -1
+			}
+		}
+	}
+}
+
+// 把短信送到接收通道, 没有接收者时丢弃.
+func (g *Gsm) deliverSMS(msg *sms.Message) {
+	g.mChanLock.RLock()
+	defer g.mChanLock.RUnlock()
+	if g.mChanClosed {
+		return
+	}
+
+	select {
+	case g.mChanSMS <- msg:
+	default:
+		g.mLogger.Debug(`GSMSMS: Drop [%v]"%v"`, string(msg.Address), msg.Text)
+	}
+}
+
+// 把短信送到接收通道, 等待被接收, 模块关闭时返回false.
+func (g *Gsm) deliverSMSWait(msg *sms.Message) bool {
+	g.mChanLock.RLock()
+	defer g.mChanLock.RUnlock()
+	if g.mChanClosed {
+		return false
+	}
+
+	select {
+	case g.mChanSMS <- msg:
+		return true
+	case <-g.mAT.Done():
+		return false
+	}
+}
+
+// 停止重组, 之后不再向短信和事件通道发送.
+func (g *Gsm) closeParts() {
+	g.mChanLock.Lock()
+	g.mChanClosed = true
+	g.mChanLock.Unlock()
+
+	g.mPartsLock.Lock()
+	defer g.mPartsLock.Unlock()
+	g.mPartsClosed = true
+	for key, p := range g.mParts {
+		p.timer.Stop()
+		delete(g.mParts, key)
+	}
+}
+
+// 把短信内容编码为一条或多条(长短信)SMS-SUBMIT的PDU.
+func (g *Gsm) encodeSMS(num, msg string) ([]int, [][]byte, error) {
+	ucs2 := !isGSM7(msg)
+	headerLen := 6
+	if g.mConcatRef16 {
+		headerLen = 7
+	}
+
+	texts := splitText(msg, ucs2, headerLen)
+	if len(texts) > 255 {
+		return nil, nil, fmt.Errorf("SMS too long, %d parts", len(texts))
+	}
+
+	lens := make([]int, len(texts))
+	pdus := make([][]byte, len(texts))
+	if len(texts) == 1 {
+		lens[0], pdus[0] = encodeSubmit(num, msg, ucs2, nil, false, g.mStatusReport)
+		return lens, pdus, nil
+	}
+
+	ref := g.nextConcatRef()
+	for i, text := range texts {
+		c := &concatInfo{ref: ref, total: len(texts), seq: i + 1}
+		lens[i], pdus[i] = encodeSubmit(num, text, ucs2, c, g.mConcatRef16, g.mStatusReport)
+	}
+	return lens, pdus, nil
+}
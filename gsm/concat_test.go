@@ -0,0 +1,121 @@
+package gsm
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	l4g "github.com/alecthomas/log4go"
+	"github.com/xlab/at/sms"
+)
+
+func newConcatTestGsm(timeout time.Duration) *Gsm {
+	return &Gsm{
+		mLogger:            &l4g.Logger{},
+		mChanSMS:           make(chan *sms.Message, 4),
+		mParts:             map[concatKey]*partialSMS{},
+		mReassemblyTimeout: timeout,
+		mConcatRef16:       true,
+	}
+}
+
+// 把长短信的第i个分段交给重组.
+func addTestPart(t *testing.T, g *Gsm, pdus [][]byte, i int) {
+	d, err := decodeDeliver(toDeliver(pdus[i]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.addPart(&sms.Message{}, d, -1)
+}
+
+func TestReassemble(t *testing.T) {
+	g := newConcatTestGsm(time.Minute)
+	text := strings.Repeat("long message ", 30)
+	_, pdus, err := g.encodeSMS("10086", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pdus) != 3 {
+		t.Fatalf("%d parts, want 3", len(pdus))
+	}
+
+	// 乱序并且重复
+	for _, i := range []int{2, 0, 0, 1} {
+		addTestPart(t, g, pdus, i)
+	}
+
+	select {
+	case m := <-g.mChanSMS:
+		if m.Text != text {
+			t.Fatalf("got %q, want %q", m.Text, text)
+		}
+	default:
+		t.Fatal("message not reassembled")
+	}
+	if len(g.mParts) != 0 {
+		t.Fatalf("%d partial messages left", len(g.mParts))
+	}
+}
+
+func TestReassembleTimeout(t *testing.T) {
+	g := newConcatTestGsm(50 * time.Millisecond)
+	_, pdus, err := g.encodeSMS("10086", strings.Repeat("long message ", 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addTestPart(t, g, pdus, 0)
+	time.Sleep(200 * time.Millisecond)
+
+	g.mPartsLock.Lock()
+	defer g.mPartsLock.Unlock()
+	if len(g.mParts) != 0 || len(g.mChanSMS) != 0 {
+		t.Fatal("incomplete message not dropped")
+	}
+}
+
+// 存储模式下超时的分段留在存储器中, 被删除的位置在重组完成时不再删除.
+func TestReassembleStoredParts(t *testing.T) {
+	var lock sync.Mutex
+	cmds := []string{}
+	g, _ := newTestGsm(t, func(cmd string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		cmds = append(cmds, cmd)
+		return "\r\nOK\r\n"
+	})
+	_, pdus, err := g.encodeSMS("10086", strings.Repeat("long message ", 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := make([]*deliverPDU, len(pdus))
+	for i := range pdus {
+		if parts[i], err = decodeDeliver(toDeliver(pdus[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	part := func(i, index int) { g.addPart(&sms.Message{}, parts[i], index) }
+
+	g.SetReassemblyTimeout(50 * time.Millisecond)
+	part(0, 3)
+	time.Sleep(200 * time.Millisecond)
+
+	g.SetReassemblyTimeout(time.Minute)
+	part(0, 4)
+	part(1, 5)
+	if err := g.DeleteSMS(5); err != nil {
+		t.Fatal(err)
+	}
+	go part(2, 6)
+	if _, err := g.RecvSMS(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if got, want := strings.Join(cmds, ","), "AT+CMGD=5,AT+CMGD=4,AT+CMGD=6"; got != want {
+		t.Fatalf("commands %q, want %q", got, want)
+	}
+}
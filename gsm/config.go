@@ -0,0 +1,169 @@
+package gsm
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// GSM模块的初始化配置, 零值字段使用默认值.
+type Config struct {
+	// 关闭回显(ATE0)的最多尝试次数, 默认3
+	EchoRetries int
+
+	// 初始化命令的超时时间, 默认1秒
+	CommandTimeout time.Duration
+
+	// 关闭回显之后, 短信设置之前依次发送的命令, 任一失败时Init返回错误
+	InitCommands []string
+
+	// 初始化最后依次发送的命令, 任一失败时Init返回错误
+	PostInitCommands []string
+
+	// 不删除存储器中的短信(AT+CMGD=1,4), 存储模式下总是不删除
+	SkipSMSWipe bool
+
+	// 按顺序等待注册的服务, 用"|"分隔的服务任一注册即可, 例如"CGREG|CEREG".
+	// nil时为{"CREG", "CGREG"}; 只收发短信时可以只等待"CREG";
+	// 空切片时不等待注册.
+	Registration []string
+
+	// 等待注册时的查询次数, 默认8
+	RegistrationRetries int
+
+	// 等待注册时的查询间隔, 默认5秒
+	RegistrationInterval time.Duration
+
+	// USSD中7位字母表的文本使用打包后的十六进制字符串, 例如华为模块
+	USSDPacked bool
+
+	// 查询SIM卡号的命令, 默认"AT+CCID"
+	ICCIDCommand string
+
+	// SIM卡需要PIN时Init自动输入, 为空时Init返回SIMError
+	PIN string
+
+	// 查询PIN和PUK剩余次数的厂商命令, nil时不支持
+	PINCounter *PINCounter
+
+	// 设置首选接入技术的厂商命令, 多条命令用";"分隔, 空字符串表示不需要设置;
+	// nil时使用AT+WS46
+	RATCommands map[RAT]string
+}
+
+// 复制配置, 包括其中的切片.
+func (c *Config) clone() *Config {
+	cp := *c
+	cp.InitCommands = append([]string(nil), c.InitCommands...)
+	cp.PostInitCommands = append([]string(nil), c.PostInitCommands...)
+	if c.Registration != nil {
+		cp.Registration = append([]string{}, c.Registration...)
+	}
+	if c.PINCounter != nil {
+		counter := *c.PINCounter
+		cp.PINCounter = &counter
+	}
+	if c.RATCommands != nil {
+		cp.RATCommands = map[RAT]string{}
+		for rat, cmd := range c.RATCommands {
+			cp.RATCommands[rat] = cmd
+		}
+	}
+	return &cp
+}
+
+// 返回填充默认值后的配置.
+func (c Config) withDefaults() Config {
+	if c.EchoRetries <= 0 {
+		c.EchoRetries = 3
+	}
+	if c.CommandTimeout <= 0 {
+		c.CommandTimeout = time.Second
+	}
+	if c.Registration == nil {
+		c.Registration = []string{"CREG", "CGREG"}
+	}
+	if c.RegistrationRetries <= 0 {
+		c.RegistrationRetries = 8
+	}
+	if c.RegistrationInterval <= 0 {
+		c.RegistrationInterval = time.Second * 5
+	}
+	if c.ICCIDCommand == "" {
+		c.ICCIDCommand = "AT+CCID"
+	}
+	return c
+}
+
+var (
+	profileLock sync.Mutex
+	profiles    = map[string]*Config{
+		"SIM800": {
+			// +SPIC: <pin1>,<pin2>,<puk1>,<puk2>
+			PINCounter:  &PINCounter{Command: "AT+SPIC", Prefix: "+SPIC:", PIN: 0, PUK: 2},
+			RATCommands: map[RAT]string{RAT_AUTO: "", RAT_GSM: ""}, // 只支持GSM
+		},
+		"EC25": {
+			Registration: []string{"CREG", "CGREG|CEREG"},
+			ICCIDCommand: "AT+QCCID",
+			PINCounter:   &PINCounter{Command: `AT+QPINC="SC"`, Prefix: "+QPINC:", PIN: 1, PUK: 2},
+			RATCommands: map[RAT]string{
+				RAT_AUTO: `AT+QCFG="nwscanmode",0,1`,
+				RAT_GSM:  `AT+QCFG="nwscanmode",1,1`,
+				RAT_UMTS: `AT+QCFG="nwscanmode",2,1`,
+				RAT_LTE:  `AT+QCFG="nwscanmode",3,1`,
+			},
+		},
+		"SARA-R4": {
+			Registration:         []string{"CEREG"},
+			RegistrationRetries:  36,
+			RegistrationInterval: time.Second * 5,
+			PINCounter:           &PINCounter{Command: "AT+UPINCNT", Prefix: "+UPINCNT:", PIN: 0, PUK: 2},
+			// 修改URAT前需要注销网络
+			RATCommands: map[RAT]string{
+				RAT_AUTO: "AT+COPS=2;AT+URAT=7,8;AT+COPS=0",
+				RAT_LTE:  "AT+COPS=2;AT+URAT=7;AT+COPS=0",
+			},
+		},
+	}
+)
+
+// 注册模块配置, 同名的配置被替换.
+func RegisterProfile(name string, c *Config) {
+	profileLock.Lock()
+	defer profileLock.Unlock()
+	profiles[name] = c.clone()
+}
+
+// 返回模块配置的副本, 可以修改后传给SetConfig.
+// 内置"SIM800", "EC25"和"SARA-R4".
+func Profile(name string) (*Config, error) {
+	profileLock.Lock()
+	defer profileLock.Unlock()
+	c, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf(`Unknown gsm profile "%s"`, name)
+	}
+	return c.clone(), nil
+}
+
+// 设置初始化配置, 修改后需要重新调用Init.
+func (g *Gsm) SetConfig(c *Config) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	g.mConfig = c.clone().withDefaults()
+
+	g.mUSSDLock.Lock()
+	g.mUSSDPacked = c.USSDPacked
+	g.mUSSDLock.Unlock()
+}
+
+// 使用注册的模块配置, 修改后需要重新调用Init.
+func (g *Gsm) SetProfile(name string) error {
+	c, err := Profile(name)
+	if err != nil {
+		return err
+	}
+	g.SetConfig(c)
+	return nil
+}
@@ -0,0 +1,70 @@
+package gsm
+
+import (
+	"strings"
+	"testing"
+)
+
+// 修改Profile返回的副本不影响注册的配置.
+func TestProfileClone(t *testing.T) {
+	c, err := Profile("EC25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Registration[1] = "CREG"
+	c.PINCounter.PUK = 0
+	c.RATCommands[RAT_LTE] = ""
+	c.InitCommands = append(c.InitCommands, "AT+X")
+
+	again, _ := Profile("EC25")
+	if again.Registration[1] != "CGREG|CEREG" || again.PINCounter.PUK != 2 ||
+		again.RATCommands[RAT_LTE] != `AT+QCFG="nwscanmode",3,1` || len(again.InitCommands) != 0 {
+		t.Fatalf("profile changed through its copy: %+v", again)
+	}
+
+	// 注册后修改原配置也不影响
+	own := &Config{InitCommands: []string{"AT+A"}, Registration: []string{}}
+	RegisterProfile("test-clone", own)
+	own.InitCommands[0] = "AT+B"
+	registered, _ := Profile("test-clone")
+	if registered.InitCommands[0] != "AT+A" {
+		t.Fatalf("registered profile changed: %q", registered.InitCommands)
+	}
+	// 空切片表示不等待注册, 不能变成默认值
+	if r := registered.withDefaults().Registration; r == nil || len(r) != 0 {
+		t.Fatalf("Registration %q", r)
+	}
+
+	if _, err := Profile("none"); err == nil {
+		t.Fatal("unknown profile accepted")
+	}
+}
+
+func TestSetConfigClone(t *testing.T) {
+	g := &Gsm{}
+	c := &Config{Registration: []string{"CEREG"}}
+	g.SetConfig(c)
+	c.Registration[0] = "CREG"
+	if g.mConfig.Registration[0] != "CEREG" {
+		t.Fatal("SetConfig kept the caller's slice")
+	}
+	if g.mConfig.CommandTimeout == 0 || g.mConfig.ICCIDCommand != "AT+CCID" {
+		t.Fatalf("defaults missing: %+v", g.mConfig)
+	}
+}
+
+func TestRegistrationServices(t *testing.T) {
+	for _, c := range []struct {
+		registration []string
+		want         string
+	}{
+		{nil, ""},
+		{[]string{"CREG", "CGREG"}, "CREG,CGREG"},
+		{[]string{"CREG", "CGREG|CEREG"}, "CREG,CGREG,CEREG"},
+		{[]string{"CEREG|CGREG", "CGREG", "CREG|CEREG"}, "CEREG,CGREG,CREG"},
+	} {
+		if got := strings.Join(registrationServices(c.registration), ","); got != c.want {
+			t.Errorf("%q: %q, want %q", c.registration, got, c.want)
+		}
+	}
+}
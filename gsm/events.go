@@ -0,0 +1,196 @@
+package gsm
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/xiqingping/golibs/gsm/atcmd"
+)
+
+// 模块主动上报的事件, 为以下*Event类型之一.
+type Event interface {
+	isEvent()
+}
+
+// 来电振铃(RING, +CRING:).
+type RingEvent struct {
+	Type string // +CRING的呼叫类型, 例如VOICE; RING时为空
+}
+
+// 来电号码(+CLIP:).
+type CallerIDEvent struct {
+	Number string
+	Type   int // 号码类型, 145为国际号码
+	Name   string
+}
+
+// 网络注册状态变化(+CREG:, +CGREG:, +CEREG:).
+type RegistrationEvent struct {
+	Registration
+}
+
+// 新短信已保存(+CMTI:).
+type NewSMSEvent struct {
+	Storage string // 存储器, 例如"SM"
+	Index   int
+}
+
+// USSD响应(+CUSD:), 包括网络主动发起的USSD.
+type USSDEvent struct {
+	USSDResponse
+}
+
+// 短信状态报告(+CDS:).
+type StatusReportEvent struct {
+	PDU    []byte
+	Report *StatusReport // 解码失败时为nil
+	Number string        // 对应的已发送短信的号码, 没有对应的短信时为空
+	Refs   []int         // 对应的已发送短信的参考号, 长短信有多个
+}
+
+// 通话断开(NO CARRIER), 随后还有CallEvent.
+type DisconnectEvent struct{}
+
+func (*RingEvent) isEvent()         {}
+func (*CallerIDEvent) isEvent()     {}
+func (*RegistrationEvent) isEvent() {}
+func (*NewSMSEvent) isEvent()       {}
+func (*USSDEvent) isEvent()         {}
+func (*StatusReportEvent) isEvent() {}
+func (*DisconnectEvent) isEvent()   {}
+
+// 事件通道的缓冲大小
+const EVENT_BUFFER_SIZE = 32
+
+// 内置解析的URC前缀
+var urcPrefixes = []string{
+	"RING", "+CRING:", "+CLIP:", "+CREG:", "+CGREG:", "+CEREG:",
+	"+CMTI:", "+CUSD:", "NO CARRIER", "BUSY", "NO ANSWER", "NO DIALTONE",
+}
+
+// 注册内置的URC处理函数.
+func (g *Gsm) initURC() {
+	for _, prefix := range urcPrefixes {
+		g.mAT.HandleURC(prefix, g.onURC)
+	}
+	g.mAT.HandleURCWithPDU("+CMT:", g.onURC)
+	g.mAT.HandleURCWithPDU("+CDS:", g.onURC)
+}
+
+// 返回事件通道, 模块关闭后通道被关闭.
+// 事件来不及处理时会被丢弃.
+func (g *Gsm) Events() <-chan Event {
+	return g.mChanEvents
+}
+
+// 订阅以prefix开头的URC, handler收到URC的原始行.
+// 带PDU的URC(+CMT:, +CDS:)还包括PDU行.
+// handler在接收协程中调用, 不能阻塞, 也不能发送AT命令.
+func (g *Gsm) Subscribe(prefix string, handler atcmd.URCHandler) {
+	g.mSubLock.Lock()
+	g.mSubs = append(g.mSubs, subscription{prefix, handler})
+	g.mSubLock.Unlock()
+
+	for _, p := range append(urcPrefixes, "+CMT:", "+CDS:") {
+		if strings.HasPrefix(prefix, p) {
+			return
+		}
+	}
+	g.mAT.HandleURC(prefix, g.onURC)
+}
+
+type subscription struct {
+	prefix  string
+	handler atcmd.URCHandler
+}
+
+// 发送事件, 模块关闭后不再发送.
+// 可以在接收协程之外调用, 例如通话轮询协程.
+func (g *Gsm) emit(ev Event) {
+	g.mChanLock.RLock()
+	defer g.mChanLock.RUnlock()
+	if g.mChanClosed {
+		return
+	}
+
+	select {
+	case g.mChanEvents <- ev:
+	default:
+		g.mLogger.Debug("GSMAT: Drop event %T", ev)
+	}
+}
+
+// 解析URC为事件, 再交给订阅者.
+func (g *Gsm) onURC(lines []string) {
+	l := lines[0]
+	value := ""
+	if i := strings.Index(l, ":"); i >= 0 {
+		value = strings.TrimSpace(l[i+1:])
+	}
+	params := atcmd.SplitParams(value)
+
+	switch {
+	case l == "RING":
+		g.watchCalls()
+		g.emit(&RingEvent{})
+
+	case strings.HasPrefix(l, "+CRING:"):
+		g.watchCalls()
+		g.emit(&RingEvent{Type: value})
+
+	case strings.HasPrefix(l, "+CLIP:"):
+		ev := &CallerIDEvent{Number: params[0], Type: atcmd.IntParam(params, 1, 0)}
+		if len(params) > 4 {
+			ev.Name = params[4]
+		}
+		g.emit(ev)
+
+	case strings.HasPrefix(l, "+CREG:"), strings.HasPrefix(l, "+CGREG:"), strings.HasPrefix(l, "+CEREG:"):
+		r := parseRegistration(l[1:strings.Index(l, ":")], params, false)
+		g.emit(&RegistrationEvent{*r})
+
+	case strings.HasPrefix(l, "+CMTI:"):
+		ev := &NewSMSEvent{Storage: params[0], Index: atcmd.IntParam(params, 1, -1)}
+		if ev.Index >= 0 && g.storedMode() {
+			g.fetchStored(ev.Index)
+		}
+		g.emit(ev)
+
+	case strings.HasPrefix(l, "+CUSD:"):
+		r := g.parseUSSD(params)
+		g.onUSSD(r)
+		g.emit(&USSDEvent{r})
+
+	case strings.HasPrefix(l, "+CMT:"):
+		g.handleSMS(lines[1])
+
+	case strings.HasPrefix(l, "+CDS:"):
+		if b, err := hex.DecodeString(lines[1]); err == nil {
+			g.handleStatusReport(b)
+		} else {
+			g.mLogger.Error(`GSMSMS: Decode status report hex string error "%v"`, err)
+		}
+
+	case l == "NO CARRIER":
+		g.setCallEnd(CALL_ENDED)
+		g.emit(&DisconnectEvent{})
+
+	case l == "BUSY":
+		g.setCallEnd(CALL_BUSY)
+
+	case l == "NO ANSWER":
+		g.setCallEnd(CALL_NO_ANSWER)
+
+	case l == "NO DIALTONE":
+		g.setCallEnd(CALL_NO_DIALTONE)
+	}
+
+	g.mSubLock.Lock()
+	subs := g.mSubs
+	g.mSubLock.Unlock()
+	for _, s := range subs {
+		if strings.HasPrefix(l, s.prefix) {
+			s.handler(lines)
+		}
+	}
+}
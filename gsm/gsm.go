@@ -7,24 +7,57 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
 
 	l4g "github.com/alecthomas/log4go"
+	"github.com/xiqingping/golibs/gsm/atcmd"
 	"github.com/xiqingping/golibs/serial"
 	"github.com/xlab/at/sms"
 )
 
 // GSM结构体
 type Gsm struct {
-	mLogger      *l4g.Logger
-	mPort        *serial.SerialPort
-	mMutex       sync.Mutex
-	mChanAtReply chan string
-	mChanSMS     chan *sms.Message
-	mRecvCMT     bool
+	mLogger   *l4g.Logger
+	mPort     *serial.SerialPort
+	mAT       *atcmd.Engine
+	mMutex    sync.Mutex
+	mConfig   Config
+	mChanSMS  chan *sms.Message
+	mRecvDone chan struct{}
+
+	mChanEvents chan Event
+	mSubLock    sync.Mutex
+	mSubs       []subscription
+
+	mConcatRef         int
+	mConcatRef16       bool
+	mPartsLock         sync.Mutex
+	mParts             map[concatKey]*partialSMS
+	mPartsClosed       bool
+	mReassemblyTimeout time.Duration
+	mStoredMode        bool
+	mFetch             chan int
+	mTaken             map[int]string // 已读出还没有删除的存储短信, 位置到PDU
+	mChanLock          sync.RWMutex
+	mChanClosed        bool
+
+	mCallLock    sync.Mutex
+	mCalls       map[int]Call
+	mCallEnd     CallState
+	mCallPolling bool
+	mDialNumber  string // 已拨出但还没有查询到的通话
+
+	mUSSDMutex  sync.Mutex
+	mUSSDLock   sync.Mutex
+	mUSSDWait   chan *USSDResponse
+	mUSSDPacked bool
+
+	mStatusReport    bool
+	mSentLock        sync.Mutex
+	mSent            map[int]*sentSMS
+	mDeliveryHandler func(ev *StatusReportEvent)
 }
 
 // 构建一个新的GSM结构体.
@@ -37,156 +70,169 @@ func NewGsm(name string, baud int, logger *l4g.Logger) (*Gsm, error) {
 		return nil, err
 	}
 
-	gsm := Gsm{
-		mLogger:      logger,
-		mPort:        s,
-		mChanAtReply: make(chan string),
-		mChanSMS:     make(chan *sms.Message),
-	}
-	go gsm.recvThread()
-
-	return &gsm, nil
-}
-
-// 等待AT命令应答.
-// expect 合法字符串应答.
-// timeout 等待应答超时
-// return 等到的应答, 错误
-func (g *Gsm) waitForReply(expect string, timeout time.Duration) (string, error) {
-	regExpPatttern := regexp.MustCompile(expect)
-	t := time.After(timeout)
-	for {
-		select {
-		case data := <-g.mChanAtReply:
-			result := regExpPatttern.FindAllString(data, -1)
-			if len(result) > 0 {
-				return result[0], nil
-			}
-			g.mLogger.Debug("GSMAT: Drop <- %v", data)
-		case <-t:
-			return "", fmt.Errorf("Timeout expired")
-		}
-	}
+	return NewGsmWithPort(s, logger), nil
 }
 
-// 发送AT命令并等待应答.
-// expect 合法字符串应答.
-// timeout 等待应答超时
-// return 等到的应答, 错误
-func (g *Gsm) atcmd(cmd, expect string, timeout time.Duration) (string, error) {
-	if "" != cmd {
-		g.mLogger.Debug(`GSMAT: -> "%s"`, cmd)
-		buf := make([]byte, len(cmd)+1)
-		copy(buf, cmd)
-		buf[len(cmd)] = '\r'
-		if _, err := g.mPort.Write(buf); nil != err {
-			return "", err
-		}
-	}
-
-	if "" == expect {
-		time.Sleep(timeout)
-		return "", nil
+// 在已打开的串口上构建GSM结构体.
+// port 可以是serial.NewSerialPortFrom包装的ReconnectingPort,
+// 收到PortConnected事件后再次调用Init即可重新初始化模块.
+// logger 日志
+func NewGsmWithPort(port *serial.SerialPort, logger *l4g.Logger) *Gsm {
+	gsm := Gsm{
+		mLogger:   logger,
+		mPort:     port,
+		mAT:       atcmd.New(port, logger),
+		mConfig:   Config{}.withDefaults(),
+		mChanSMS:  make(chan *sms.Message),
+		mRecvDone: make(chan struct{}),
+
+		mChanEvents: make(chan Event, EVENT_BUFFER_SIZE),
+
+		mConcatRef:         int(time.Now().UnixNano()),
+		mParts:             make(map[concatKey]*partialSMS),
+		mReassemblyTimeout: SMS_REASSEMBLY_TIMEOUT,
+		mSent:              make(map[int]*sentSMS),
+		mFetch:             make(chan int, FETCH_QUEUE_SIZE),
+		mTaken:             make(map[int]string),
+
+		mCalls:   make(map[int]Call),
+		mCallEnd: CALL_ENDED,
 	}
+	gsm.initURC()
+	go gsm.waitForEngine()
+	go gsm.fetchLoop()
 
-	r, err := g.waitForReply(expect, timeout)
-	if err != nil {
-		g.mLogger.Debug(`GSMAT:<- error "%v"`, err)
-	} else {
-		g.mLogger.Debug(`GSMAT:<- "%v"`, r)
-	}
+	return &gsm
+}
 
-	return r, err
+// 返回AT命令引擎, 可以用来发送其他AT命令.
+func (g *Gsm) AT() *atcmd.Engine {
+	return g.mAT
 }
 
-// 判断应答字符串是否为期望的字符串的函数类型
-type checkReply func(string) bool
-
-// 多次重试AT指令, 并等待期望的应答.
-// cmd AT命令.
-// expect 合法应答字符串的正则表达式.
-// check 检查应答是否正常的函数.
-// times AT命令重试的次数.
-// unitDuration 一次AT指令等待的时间.
-func (g *Gsm) waitForCommand(cmd, expect string, check checkReply, times int, unitDuration time.Duration) error {
-	for i := 0; i < times; i = i + 1 {
-		thisEndTime := time.Duration(time.Now().UnixNano()) + unitDuration
-		if reply, err := g.atcmd(cmd, expect, unitDuration); err == nil && check(reply) {
-			return nil
+// 等待网络注册, services中任一服务(例如"CREG", "CGREG", "CEREG")注册即可.
+func (g *Gsm) waitForRegistration(services []string) error {
+	c := &g.mConfig
+	for i := 0; i < c.RegistrationRetries; i = i + 1 {
+		thisEndTime := time.Now().Add(c.RegistrationInterval)
+		for _, svc := range services {
+			r, err := g.registration(svc, c.RegistrationInterval)
+			if err == nil && r.Registered() {
+				return nil
+			}
 		}
 
-		leftTime := thisEndTime - time.Duration(time.Now().UnixNano())
-		if leftTime > 0 {
+		if leftTime := time.Until(thisEndTime); leftTime > 0 {
 			time.Sleep(leftTime)
 		}
 	}
 
-	return fmt.Errorf(`Wait for command "%s" timeout`, cmd)
+	return fmt.Errorf(`Wait for registration "%s" timeout`, strings.Join(services, "|"))
 }
 
-// 等待GSM网络注册(AT命令中的CREG)
-func (g *Gsm) waitForCreg() error {
-	return g.waitForCommand(
-		"AT+CREG?",
-		`\+CREG: 0,[0-5]`,
-		func(reply string) bool { return "+CREG: 0,1" == reply || "+CREG: 0,5" == reply },
-		8,
-		time.Second*5)
-}
-
-// 等待GPRS网络注册(AT命令中的CGREG)
-func (g *Gsm) waitForCgreg() error {
-	return g.waitForCommand(
-		"AT+CGREG?",
-		`\+CGREG: 0,[0-5]`,
-		func(reply string) bool { return "+CGREG: 0,1" == reply || "+CGREG: 0,5" == reply },
-		8,
-		time.Second*5)
-}
-
-// 初始化
+// 初始化, 使用SetConfig设置的配置.
 func (g *Gsm) Init() error {
 	g.mMutex.Lock()
 	defer g.mMutex.Unlock()
+	c := &g.mConfig
 
 	// auto baudrate
-	g.atcmd("AT", "OK", time.Second)
-	g.atcmd("AT", "OK", time.Second)
-	g.atcmd("ATE0", "OK", time.Second)
-	g.atcmd("ATE0", "OK", time.Second)
+	g.mAT.Command("AT", c.CommandTimeout)
+	g.mAT.Command("AT", c.CommandTimeout)
 
-	if _, err := g.atcmd("ATE0", "OK", time.Second); err != nil {
-		return err
+	var err error
+	for i := 0; i < c.EchoRetries; i++ {
+		if _, err = g.mAT.Command("ATE0", c.CommandTimeout); err == nil {
+			break
+		}
 	}
-
-	if _, err := g.atcmd("AT+CNMI=2,2,0,0,0", "OK", time.Second*2); err != nil {
+	if err != nil {
 		return err
 	}
 
-	if _, err := g.atcmd("AT+CMGF=0", "OK", time.Second); err != nil {
+	// 数字形式的+CME ERROR, 不支持时忽略
+	g.mAT.Command("AT+CMEE=1", c.CommandTimeout)
+
+	// SIM卡未就绪时不必等待注册超时
+	if err := g.waitForSIM(); err != nil {
 		return err
 	}
 
-	if reply, err := g.atcmd("AT+CMGD=1,4", "(OK|ERROR)", time.Second*10); err != nil || reply == "ERROR" {
-		g.mLogger.Warn("GSMAT: delete sms maybe error.")
+	for _, cmd := range c.InitCommands {
+		if _, err := g.mAT.Command(cmd, c.CommandTimeout); err != nil {
+			return err
+		}
 	}
 
-	if _, err := g.atcmd("AT+CREG=0", "OK", time.Second); err != nil {
+	// 存储模式用+CMTI通知新短信, 请求状态报告时用+CDS上报
+	stored := g.storedMode()
+	mt, ds := 2, 0
+	if stored {
+		mt = 1
+	}
+	if g.mStatusReport {
+		ds = 1
+	}
+	if _, err := g.mAT.Command(fmt.Sprintf("AT+CNMI=2,%d,0,%d,0", mt, ds), time.Second*2); err != nil {
 		return err
 	}
 
-	if err := g.waitForCreg(); err != nil {
+	if _, err := g.mAT.Command("AT+CMGF=0", c.CommandTimeout); err != nil {
 		return err
 	}
 
-	if err := g.waitForCgreg(); err != nil {
-		return err
+	switch {
+	case stored:
+		// 读出程序未运行时收到的短信
+		g.fetchStored(-1)
+	case !c.SkipSMSWipe:
+		if _, err := g.mAT.Command("AT+CMGD=1,4", time.Second*10); err != nil {
+			g.mLogger.Warn("GSMAT: delete sms maybe error.")
+		}
+	}
+
+	// 开启注册状态变化(包括位置区和小区号)和来电号码的URC, 只有CREG是必需的
+	for _, svc := range registrationServices(c.Registration) {
+		if _, err := g.mAT.Command("AT+"+svc+"=2", c.CommandTimeout); err == nil {
+			continue
+		}
+		if _, err := g.mAT.Command("AT+"+svc+"=1", c.CommandTimeout); err != nil && svc == "CREG" {
+			return err
+		}
+	}
+	g.mAT.Command("AT+CLIP=1", c.CommandTimeout)
+
+	for _, r := range c.Registration {
+		if err := g.waitForRegistration(strings.Split(r, "|")); err != nil {
+			return err
+		}
+	}
+
+	for _, cmd := range c.PostInitCommands {
+		if _, err := g.mAT.Command(cmd, c.CommandTimeout); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// 处理短信PUD字符串.
+// 返回等待注册的所有服务, 去掉重复的.
+func registrationServices(registration []string) []string {
+	services := []string{}
+	seen := map[string]bool{}
+	for _, r := range registration {
+		for _, svc := range strings.Split(r, "|") {
+			if !seen[svc] {
+				seen[svc] = true
+				services = append(services, svc)
+			}
+		}
+	}
+	return services
+}
+
+// 处理短信PUD字符串, 长短信的分段收齐后才送出.
 // s 串口接收到的PDU字符串.
 func (g *Gsm) handleSMS(s string) {
 	b, err := hex.DecodeString(s)
@@ -202,53 +248,29 @@ func (g *Gsm) handleSMS(s string) {
 		return
 	}
 
-	select {
-	case g.mChanSMS <- &msg:
-	default:
-		g.mLogger.Debug(`GSMSMS: Drop [%v]"%v"`, string(msg.Address), msg.Text)
+	if d, err := decodeDeliver(b); err == nil && d.concat != nil {
+		g.addPart(&msg, d, -1)
+		return
 	}
-}
-
-// 串口接收线程
-func (g *Gsm) recvThread() error {
-	g.mPort.StartRecv()
-	for {
-		l, err := g.mPort.ReadLine()
-		if err != nil {
-			g.mLogger.Error("GSMAT: recvThread %v", err)
-			return err
-		}
 
-		reply := strings.Trim(l, "\r")
-		if len(reply) < 2 {
-			continue
-		}
-		if g.mRecvCMT {
-			g.mRecvCMT = false
-			g.handleSMS(reply)
-			continue
-		}
-		if strings.HasPrefix(reply, "+CMT:") {
-			g.mRecvCMT = true
-			continue
-		}
+	g.deliverSMS(&msg)
+}
 
-		select {
-		case g.mChanAtReply <- reply:
-		default:
-			g.mLogger.Info("GSMAT: Drop <- %v", reply)
-		}
-	}
+// 等待AT命令引擎的接收协程退出, 然后关闭短信和事件通道.
+func (g *Gsm) waitForEngine() {
+	<-g.mAT.Done()
+	g.closeParts()
+	close(g.mChanSMS)
+	close(g.mChanEvents)
+	close(g.mRecvDone)
 }
 
-// 关闭GSM模块
+// 关闭GSM模块, 等待接收线程退出.
 func (g *Gsm) Teardown() error {
 	g.mMutex.Lock()
 	defer g.mMutex.Unlock()
 	err := g.mPort.Close()
-	time.Sleep(time.Millisecond * 10)
-	close(g.mChanAtReply)
-	close(g.mChanSMS)
+	<-g.mRecvDone
 	return err
 }
 
@@ -257,7 +279,7 @@ func (g *Gsm) Teardown() error {
 func (g *Gsm) Ping() error {
 	g.mMutex.Lock()
 	defer g.mMutex.Unlock()
-	_, err := g.atcmd("AT", "OK", time.Millisecond*250)
+	_, err := g.mAT.Command("AT", time.Millisecond*250)
 	return err
 }
 
@@ -287,48 +309,51 @@ func (g *Gsm) RecvSMSWithTimeout(timeout *time.Duration) (*sms.Message, error) {
 	}
 }
 
-// 发送短信.
+// 发送短信, 超过一条短信长度时作为长短信分多条发送.
 // num 接收者的号码.
 // msg 需要发送的短信内容.
 // return 错误; ==nil 发送正常.
 func (g *Gsm) SendSMS(num, msg string) error {
+	_, err := g.SendSMSRef(num, msg)
+	return err
+}
+
+// 发送短信, 并返回+CMGS应答的参考号, 长短信每部分有一个参考号.
+// 用SetStatusReport请求状态报告时, 可以用参考号对应StatusReportEvent.
+// num 接收者的号码.
+// msg 需要发送的短信内容.
+// return 参考号, 错误; 长短信部分发送失败时返回已发送部分的参考号.
+func (g *Gsm) SendSMSRef(num, msg string) ([]int, error) {
 	g.mMutex.Lock()
 	defer g.mMutex.Unlock()
-	if _, err := g.atcmd("AT", "OK", time.Millisecond*250); nil != err {
-		return err
-	}
-
-	s := sms.Message{
-		Encoding: sms.Encodings.Gsm7Bit,
-		Text:     msg,
-		Address:  sms.PhoneNumber(num),
-		VP:       sms.ValidityPeriod(time.Hour * 24 * 4),
-		VPFormat: sms.ValidityPeriodFormats.Relative,
-		Type:     sms.MessageTypes.Submit,
-	}
-
-	if len(msg) != len([]rune(msg)) {
-		s.Encoding = sms.Encodings.UCS2
+	if _, err := g.mAT.Command("AT", time.Millisecond*250); nil != err {
+		return nil, err
 	}
 
-	n, octets, err := s.PDU()
-
+	lens, pdus, err := g.encodeSMS(num, msg)
 	if err != nil {
-		return err
-	}
-
-	cmd := fmt.Sprintf("AT+CMGS=%d", n)
-	if _, err := g.atcmd(cmd, "", time.Millisecond*300); nil != err {
-		return err
+		return nil, err
 	}
 
-	buf := make([]byte, hex.EncodedLen(len(octets))+1)
-	n = hex.Encode(buf, octets)
-	buf[n] = 0x1A
+	refs := []int{}
+	sent := &sentSMS{number: num}
+	for i, octets := range pdus {
+		resp, err := g.mAT.Send(&atcmd.Command{
+			Cmd:     fmt.Sprintf("AT+CMGS=%d", lens[i]),
+			Prefix:  "+CMGS:",
+			Data:    []byte(hex.EncodeToString(octets)),
+			Timeout: time.Second * 10,
+		})
+		if err != nil {
+			return refs, err
+		}
 
-	if _, err := g.mPort.Write(buf); nil != err {
-		return err
+		v, _ := resp.Value("+CMGS:")
+		ref := atcmd.IntParam(atcmd.SplitParams(v), 0, -1)
+		refs = append(refs, ref)
+		if g.mStatusReport && ref >= 0 {
+			g.trackSent(sent, ref)
+		}
 	}
-	_, err = g.atcmd("", "OK", time.Second*10)
-	return err
+	return refs, nil
 }
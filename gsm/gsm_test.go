@@ -0,0 +1,41 @@
+package gsm
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	l4g "github.com/alecthomas/log4go"
+	"github.com/xiqingping/golibs/serial"
+)
+
+// 在net.Pipe上模拟模块, reply按收到的命令返回应答.
+func newTestGsm(t *testing.T, reply func(cmd string) string) (*Gsm, net.Conn) {
+	host, modem := net.Pipe()
+	go func() {
+		r := bufio.NewReader(modem)
+		cmd := []byte{}
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			// 命令以\r结束, 数据以Ctrl-Z结束
+			if c != '\r' && c != 0x1A {
+				cmd = append(cmd, c)
+				continue
+			}
+			if resp := reply(strings.TrimSpace(string(cmd))); resp != "" {
+				modem.Write([]byte(resp))
+			}
+			cmd = cmd[:0]
+		}
+	}()
+	g := NewGsmWithPort(serial.NewSerialPortFrom(host), &l4g.Logger{})
+	t.Cleanup(func() {
+		host.Close()
+		modem.Close()
+	})
+	return g, modem
+}
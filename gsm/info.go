@@ -0,0 +1,319 @@
+package gsm
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/xiqingping/golibs/gsm/atcmd"
+)
+
+// 接入技术(+COPS的<AcT>, 3GPP TS 27.007 7.3)
+type AccessTech int
+
+const (
+	ACT_UNKNOWN     AccessTech = -1
+	ACT_GSM         AccessTech = 0
+	ACT_GSM_COMPACT AccessTech = 1
+	ACT_UTRAN       AccessTech = 2
+	ACT_EGPRS       AccessTech = 3
+	ACT_HSDPA       AccessTech = 4
+	ACT_HSUPA       AccessTech = 5
+	ACT_HSPA        AccessTech = 6
+	ACT_EUTRAN      AccessTech = 7
+	ACT_EC_GSM_IOT  AccessTech = 8
+	ACT_EUTRAN_NB   AccessTech = 9 // NB-IoT
+)
+
+func (a AccessTech) String() string {
+	switch a {
+	case ACT_GSM, ACT_GSM_COMPACT:
+		return "GSM"
+	case ACT_EGPRS:
+		return "EDGE"
+	case ACT_UTRAN:
+		return "UMTS"
+	case ACT_HSDPA, ACT_HSUPA, ACT_HSPA:
+		return "HSPA"
+	case ACT_EUTRAN:
+		return "LTE"
+	case ACT_EC_GSM_IOT:
+		return "EC-GSM-IoT"
+	case ACT_EUTRAN_NB:
+		return "NB-IoT"
+	}
+	return "unknown"
+}
+
+// 当前注册的运营商(+COPS?).
+type CurrentOperator struct {
+	Mode   int    // 0自动, 1手动, 2注销, 4手动失败后自动
+	Format int    // 0长名称, 1短名称, 2数字代码
+	Name   string // 按Format表示的运营商, 未注册时为空
+	AcT    AccessTech
+}
+
+// 信号质量(+CSQ).
+type Signal struct {
+	RSSI int // 0-31, 99为未知
+	BER  int // 0-7, 99为未知
+}
+
+// 信号强度(dBm), 未知时返回false.
+func (s *Signal) DBm() (int, bool) {
+	if s.RSSI < 0 || s.RSSI > 31 {
+		return 0, false
+	}
+	return -113 + 2*s.RSSI, true
+}
+
+// 扩展信号质量(+CESQ), 未知的值为99(RxLev, BER)或255.
+type ExtendedSignal struct {
+	RxLev int // GSM, 0-63
+	BER   int // GSM, 0-7
+	RSCP  int // UMTS, 0-96
+	EcNo  int // UMTS, 0-49
+	RSRQ  int // LTE, 0-34
+	RSRP  int // LTE, 0-97
+}
+
+// GSM接收电平(dBm).
+func (s *ExtendedSignal) RxLevDBm() (int, bool) {
+	if s.RxLev < 0 || s.RxLev > 63 {
+		return 0, false
+	}
+	return -111 + s.RxLev, true
+}
+
+// UMTS接收信号码功率(dBm).
+func (s *ExtendedSignal) RSCPDBm() (int, bool) {
+	if s.RSCP < 0 || s.RSCP > 96 {
+		return 0, false
+	}
+	return -121 + s.RSCP, true
+}
+
+// UMTS Ec/No(dB).
+func (s *ExtendedSignal) EcNoDB() (float64, bool) {
+	if s.EcNo < 0 || s.EcNo > 49 {
+		return 0, false
+	}
+	return -24.5 + float64(s.EcNo)/2, true
+}
+
+// LTE参考信号接收质量(dB).
+func (s *ExtendedSignal) RSRQDB() (float64, bool) {
+	if s.RSRQ < 0 || s.RSRQ > 34 {
+		return 0, false
+	}
+	return -20 + float64(s.RSRQ)/2, true
+}
+
+// LTE参考信号接收功率(dBm).
+func (s *ExtendedSignal) RSRPDBm() (int, bool) {
+	if s.RSRP < 0 || s.RSRP > 97 {
+		return 0, false
+	}
+	return -141 + s.RSRP, true
+}
+
+// 模块和SIM卡的状态快照, 查询失败的字段为零值, 错误记录在Errors中.
+type ModemStatus struct {
+	IMEI         string
+	IMSI         string
+	ICCID        string
+	Manufacturer string
+	Model        string
+	Revision     string
+	Operator     *CurrentOperator
+	Signal       *Signal
+	Extended     *ExtendedSignal // 模块不支持+CESQ时为nil
+	AcT          AccessTech
+
+	Errors map[string]error // 键为字段名
+}
+
+// 发送查询命令, 返回以prefix开头的响应去掉前缀后的内容,
+// 没有时返回第一行响应, 例如AT+CGSN的IMEI.
+func (g *Gsm) query(cmd, prefix string) (string, error) {
+	resp, err := g.mAT.Send(&atcmd.Command{Cmd: cmd, Prefix: prefix, Timeout: time.Second * 5})
+	if err != nil {
+		return "", err
+	}
+	v, ok := resp.Value(prefix)
+	if !ok {
+		if len(resp.Lines) == 0 {
+			return "", errors.New("No response for " + cmd)
+		}
+		v = resp.Lines[0]
+	}
+	return strings.TrimSpace(v), nil
+}
+
+// 查询只有一个值的命令, 结果去掉两边的引号.
+func (g *Gsm) queryString(cmd, prefix string) (string, error) {
+	v, err := g.query(cmd, prefix)
+	return strings.Trim(v, `"`), err
+}
+
+// 国际移动设备识别码(AT+CGSN).
+func (g *Gsm) IMEI() (string, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.queryString("AT+CGSN", "+CGSN:")
+}
+
+// 国际移动用户识别码(AT+CIMI).
+func (g *Gsm) IMSI() (string, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.queryString("AT+CIMI", "+CIMI:")
+}
+
+// SIM卡号, 命令由Config.ICCIDCommand指定.
+func (g *Gsm) ICCID() (string, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.iccid()
+}
+
+func (g *Gsm) iccid() (string, error) {
+	cmd := g.mConfig.ICCIDCommand
+	return g.queryString(cmd, strings.TrimPrefix(cmd, "AT")+":")
+}
+
+// 制造商(AT+CGMI).
+func (g *Gsm) Manufacturer() (string, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.queryString("AT+CGMI", "+CGMI:")
+}
+
+// 型号(AT+CGMM).
+func (g *Gsm) Model() (string, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.queryString("AT+CGMM", "+CGMM:")
+}
+
+// 固件版本(AT+CGMR).
+func (g *Gsm) Revision() (string, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.revision()
+}
+
+func (g *Gsm) revision() (string, error) {
+	v, err := g.queryString("AT+CGMR", "+CGMR:")
+	// SIM800等模块的应答为"Revision:..."
+	return strings.TrimSpace(strings.TrimPrefix(v, "Revision:")), err
+}
+
+// 当前运营商和接入技术(AT+COPS?).
+func (g *Gsm) Operator() (*CurrentOperator, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.operator()
+}
+
+func (g *Gsm) operator() (*CurrentOperator, error) {
+	v, err := g.query("AT+COPS?", "+COPS:")
+	if err != nil {
+		return nil, err
+	}
+	params := atcmd.SplitParams(v)
+	op := &CurrentOperator{
+		Mode:   atcmd.IntParam(params, 0, 0),
+		Format: atcmd.IntParam(params, 1, 0),
+		AcT:    AccessTech(atcmd.IntParam(params, 3, int(ACT_UNKNOWN))),
+	}
+	if len(params) > 2 {
+		op.Name = params[2]
+	}
+	return op, nil
+}
+
+// 信号质量(AT+CSQ).
+func (g *Gsm) SignalQuality() (*Signal, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.signalQuality()
+}
+
+func (g *Gsm) signalQuality() (*Signal, error) {
+	v, err := g.query("AT+CSQ", "+CSQ:")
+	if err != nil {
+		return nil, err
+	}
+	params := atcmd.SplitParams(v)
+	return &Signal{RSSI: atcmd.IntParam(params, 0, 99), BER: atcmd.IntParam(params, 1, 99)}, nil
+}
+
+// 扩展信号质量(AT+CESQ), 用于UMTS和LTE.
+func (g *Gsm) ExtendedSignalQuality() (*ExtendedSignal, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.extendedSignalQuality()
+}
+
+func (g *Gsm) extendedSignalQuality() (*ExtendedSignal, error) {
+	v, err := g.query("AT+CESQ", "+CESQ:")
+	if err != nil {
+		return nil, err
+	}
+	params := atcmd.SplitParams(v)
+	return &ExtendedSignal{
+		RxLev: atcmd.IntParam(params, 0, 99),
+		BER:   atcmd.IntParam(params, 1, 99),
+		RSCP:  atcmd.IntParam(params, 2, 255),
+		EcNo:  atcmd.IntParam(params, 3, 255),
+		RSRQ:  atcmd.IntParam(params, 4, 255),
+		RSRP:  atcmd.IntParam(params, 5, 255),
+	}, nil
+}
+
+// 查询模块和SIM卡的全部信息.
+// 只有全部查询都失败时才返回错误, 例如AT命令通道不通.
+func (g *Gsm) Status() (*ModemStatus, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+
+	s := &ModemStatus{AcT: ACT_UNKNOWN, Errors: map[string]error{}}
+	var lastErr error
+	queries := 0
+	check := func(field string, err error) {
+		queries++
+		if err != nil {
+			s.Errors[field] = err
+			lastErr = err
+		}
+	}
+
+	var err error
+	s.IMEI, err = g.queryString("AT+CGSN", "+CGSN:")
+	check("IMEI", err)
+	s.IMSI, err = g.queryString("AT+CIMI", "+CIMI:")
+	check("IMSI", err)
+	s.ICCID, err = g.iccid()
+	check("ICCID", err)
+	s.Manufacturer, err = g.queryString("AT+CGMI", "+CGMI:")
+	check("Manufacturer", err)
+	s.Model, err = g.queryString("AT+CGMM", "+CGMM:")
+	check("Model", err)
+	s.Revision, err = g.revision()
+	check("Revision", err)
+	s.Operator, err = g.operator()
+	check("Operator", err)
+	if s.Operator != nil {
+		s.AcT = s.Operator.AcT
+	}
+	s.Signal, err = g.signalQuality()
+	check("Signal", err)
+	s.Extended, err = g.extendedSignalQuality()
+	check("Extended", err)
+
+	if len(s.Errors) == queries {
+		return nil, lastErr
+	}
+	return s, nil
+}
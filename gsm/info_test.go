@@ -0,0 +1,79 @@
+package gsm
+
+import (
+	"fmt"
+	"testing"
+)
+
+// 只应答cmd, 响应为line.
+func replyQuery(cmd, line string) func(string) string {
+	return func(c string) string {
+		if c != cmd {
+			return "\r\nERROR\r\n"
+		}
+		return "\r\n" + line + "\r\n\r\nOK\r\n"
+	}
+}
+
+func TestSignalQuality(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want Signal
+		dbm  string
+	}{
+		{"+CSQ: 20,99", Signal{20, 99}, "-73"},
+		{"+CSQ: 0,0", Signal{0, 0}, "-113"},
+		{"+CSQ: 31,7", Signal{31, 7}, "-51"},
+		{"+CSQ: 99,99", Signal{99, 99}, "unknown"},
+	} {
+		g, _ := newTestGsm(t, replyQuery("AT+CSQ", c.line))
+		s, err := g.SignalQuality()
+		if err != nil {
+			t.Fatalf("%q: %v", c.line, err)
+		}
+		if *s != c.want || dbm(s.DBm()) != c.dbm {
+			t.Errorf("%q: %+v %s dBm, want %+v %s", c.line, *s, dbm(s.DBm()), c.want, c.dbm)
+		}
+	}
+}
+
+func TestExtendedSignalQuality(t *testing.T) {
+	for _, c := range []struct {
+		line                          string
+		rxlev, rscp, ecno, rsrq, rsrp string
+	}{
+		// GSM
+		{"+CESQ: 40,0,255,255,255,255", "-71", "unknown", "unknown", "unknown", "unknown"},
+		// UMTS
+		{"+CESQ: 99,99,50,30,255,255", "unknown", "-71", "-9.5", "unknown", "unknown"},
+		// LTE
+		{"+CESQ: 99,99,255,255,20,38", "unknown", "unknown", "unknown", "-10", "-103"},
+		{"+CESQ: 63,7,96,49,34,97", "-48", "-25", "0", "-3", "-44"},
+		{"+CESQ: 0,0,0,0,0,0", "-111", "-121", "-24.5", "-20", "-141"},
+	} {
+		g, _ := newTestGsm(t, replyQuery("AT+CESQ", c.line))
+		s, err := g.ExtendedSignalQuality()
+		if err != nil {
+			t.Fatalf("%q: %v", c.line, err)
+		}
+		got := []string{dbm(s.RxLevDBm()), dbm(s.RSCPDBm()), db(s.EcNoDB()), db(s.RSRQDB()), dbm(s.RSRPDBm())}
+		want := []string{c.rxlev, c.rscp, c.ecno, c.rsrq, c.rsrp}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%q: %v, want %v", c.line, got, want)
+		}
+	}
+}
+
+func dbm(v int, ok bool) string {
+	if !ok {
+		return "unknown"
+	}
+	return fmt.Sprint(v)
+}
+
+func db(v float64, ok bool) string {
+	if !ok {
+		return "unknown"
+	}
+	return fmt.Sprint(v)
+}
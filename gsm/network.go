@@ -0,0 +1,211 @@
+package gsm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xiqingping/golibs/gsm/atcmd"
+)
+
+// 网络注册状态(+CREG, +CGREG, +CEREG).
+type Registration struct {
+	Service string     // "CREG", "CGREG"或"CEREG"
+	Stat    int        // 0未注册, 1本地, 2搜索中, 3拒绝, 4未知, 5漫游
+	LAC     string     // 位置区码(CEREG为跟踪区码, 十六进制), 模块未上报时为空
+	CI      string     // 小区号(十六进制)
+	AcT     AccessTech // 模块未上报时为ACT_UNKNOWN
+}
+
+// 判断是否已注册(本地或漫游).
+func (r *Registration) Registered() bool {
+	return r.Stat == 1 || r.Stat == 5
+}
+
+// 解析注册状态, params为<stat>[,<lac>,<ci>[,<AcT>]],
+// 查询的应答前面还有<n>.
+func parseRegistration(service string, params []string, query bool) *Registration {
+	if query && len(params) > 0 {
+		params = params[1:]
+	}
+	r := &Registration{Service: service, Stat: atcmd.IntParam(params, 0, 4), AcT: ACT_UNKNOWN}
+	if len(params) >= 3 {
+		r.LAC = params[1]
+		r.CI = params[2]
+		r.AcT = AccessTech(atcmd.IntParam(params, 3, int(ACT_UNKNOWN)))
+	}
+	return r
+}
+
+// 查询注册状态, service为"CREG", "CGREG"或"CEREG".
+func (g *Gsm) RegistrationStatus(service string) (*Registration, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.registration(service, time.Second*5)
+}
+
+func (g *Gsm) registration(service string, timeout time.Duration) (*Registration, error) {
+	prefix := "+" + service + ":"
+	resp, err := g.mAT.Send(&atcmd.Command{Cmd: "AT+" + service + "?", Prefix: prefix, Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	v, ok := resp.Value(prefix)
+	if !ok {
+		return nil, fmt.Errorf("No %s response", prefix)
+	}
+	return parseRegistration(service, atcmd.SplitParams(v), true), nil
+}
+
+// 运营商选择模式(+COPS的<mode>)
+const (
+	COPS_AUTO        = 0
+	COPS_MANUAL      = 1
+	COPS_DEREGISTER  = 2
+	COPS_MANUAL_AUTO = 4 // 手动选择失败时自动选择
+)
+
+// 搜索运营商的超时时间
+const SCAN_TIMEOUT = time.Second * 180
+
+// 搜索到的运营商(AT+COPS=?).
+type Operator struct {
+	Status  int // 0未知, 1可用, 2当前, 3禁止
+	Long    string
+	Short   string
+	Numeric string // MCC和MNC, 例如"46000"
+	AcT     AccessTech
+}
+
+// 取出括号中的元组, 元组之间以逗号分隔, 字符串中可以有括号.
+func splitTuples(s string) []string {
+	tuples := []string{}
+	depth, start, quoted := 0, 0, false
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			if depth == 0 {
+				start = i + 1
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				tuples = append(tuples, s[start:i])
+			}
+		}
+	}
+	return tuples
+}
+
+// 搜索运营商, 需要较长时间(最长SCAN_TIMEOUT).
+func (g *Gsm) ScanOperators() ([]Operator, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+
+	resp, err := g.mAT.Send(&atcmd.Command{Cmd: "AT+COPS=?", Prefix: "+COPS:", Timeout: SCAN_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+	v, ok := resp.Value("+COPS:")
+	if !ok {
+		return nil, errors.New("No +COPS response")
+	}
+
+	operators := []Operator{}
+	for _, t := range splitTuples(v) {
+		params := atcmd.SplitParams(t)
+		// 最后是支持的<mode>和<format>列表, 例如(0-4),(0-2)
+		if len(params) < 4 {
+			continue
+		}
+		operators = append(operators, Operator{
+			Status:  atcmd.IntParam(params, 0, 0),
+			Long:    params[1],
+			Short:   params[2],
+			Numeric: params[3],
+			AcT:     AccessTech(atcmd.IntParam(params, 4, int(ACT_UNKNOWN))),
+		})
+	}
+	return operators, nil
+}
+
+// 选择运营商.
+// mode COPS_AUTO等, 自动选择和注销时不需要numeric.
+// numeric 运营商的数字代码, 例如"46000".
+func (g *Gsm) SelectOperator(mode int, numeric string) error {
+	cmd := fmt.Sprintf("AT+COPS=%d", mode)
+	if mode == COPS_MANUAL || mode == COPS_MANUAL_AUTO {
+		if numeric == "" {
+			return errors.New("Operator required for manual selection")
+		}
+		cmd += fmt.Sprintf(`,2,"%s"`, numeric)
+	}
+
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	_, err := g.mAT.Command(cmd, SCAN_TIMEOUT)
+	return err
+}
+
+// 无线接入技术的选择.
+type RAT int
+
+const (
+	RAT_AUTO RAT = iota
+	RAT_GSM
+	RAT_UMTS
+	RAT_LTE
+)
+
+func (r RAT) String() string {
+	switch r {
+	case RAT_AUTO:
+		return "auto"
+	case RAT_GSM:
+		return "GSM"
+	case RAT_UMTS:
+		return "UMTS"
+	case RAT_LTE:
+		return "LTE"
+	}
+	return "unknown"
+}
+
+// 模块配置中没有RATCommands时使用的标准命令(3GPP TS 27.007 5.9)
+var ws46Commands = map[RAT]string{
+	RAT_AUTO: "AT+WS46=25",
+	RAT_GSM:  "AT+WS46=12",
+	RAT_UMTS: "AT+WS46=22",
+	RAT_LTE:  "AT+WS46=28",
+}
+
+// 设置首选的无线接入技术, 命令由Config.RATCommands指定,
+// 没有配置时使用AT+WS46.
+func (g *Gsm) SetPreferredRAT(rat RAT) error {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+
+	commands := g.mConfig.RATCommands
+	if commands == nil {
+		commands = ws46Commands
+	}
+	cmd, ok := commands[rat]
+	if !ok {
+		return fmt.Errorf("RAT %v: %v", rat, ErrNotSupported)
+	}
+
+	if cmd == "" {
+		return nil
+	}
+	for _, c := range strings.Split(cmd, ";") {
+		if _, err := g.mAT.Command(c, time.Second*10); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package gsm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xiqingping/golibs/gsm/atcmd"
+)
+
+func TestParseRegistration(t *testing.T) {
+	for _, c := range []struct {
+		line  string
+		query bool
+		want  Registration
+	}{
+		// 查询的应答, 前面是<n>
+		{"+CREG: 0,1", true, Registration{"CREG", 1, "", "", ACT_UNKNOWN}},
+		{`+CREG: 2,5,"1A2B","00C3"`, true, Registration{"CREG", 5, "1A2B", "00C3", ACT_UNKNOWN}},
+		{`+CGREG: 2,1,"1A2B","0F3C",2`, true, Registration{"CGREG", 1, "1A2B", "0F3C", ACT_UTRAN}},
+		{`+CEREG: 2,1,"2F1A","01A2D102",7`, true, Registration{"CEREG", 1, "2F1A", "01A2D102", ACT_EUTRAN}},
+		{"+CEREG: 2,2", true, Registration{"CEREG", 2, "", "", ACT_UNKNOWN}},
+		// URC
+		{"+CREG: 3", false, Registration{"CREG", 3, "", "", ACT_UNKNOWN}},
+		{`+CREG: 1,"1A2B","00C3"`, false, Registration{"CREG", 1, "1A2B", "00C3", ACT_UNKNOWN}},
+		{`+CEREG: 5,"2F1A","01A2D102",9`, false, Registration{"CEREG", 5, "2F1A", "01A2D102", ACT_EUTRAN_NB}},
+		{"+CGREG:", false, Registration{"CGREG", 4, "", "", ACT_UNKNOWN}},
+	} {
+		i := strings.Index(c.line, ":")
+		params := atcmd.SplitParams(strings.TrimSpace(c.line[i+1:]))
+		if got := parseRegistration(c.line[1:i], params, c.query); *got != c.want {
+			t.Errorf("%q: %+v, want %+v", c.line, *got, c.want)
+		}
+	}
+}
+
+func TestSplitTuples(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want []string
+	}{
+		{"", []string{}},
+		{`(1,"A","B","00101"),,(0-4),(0-2)`, []string{`1,"A","B","00101"`, "0-4", "0-2"}},
+		// 字符串中的括号
+		{`(1,"Op (test)","OP","00101",0)`, []string{`1,"Op (test)","OP","00101",0`}},
+		{`((1,2),3)`, []string{"(1,2),3"}},
+	} {
+		if got := splitTuples(c.s); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: %q, want %q", c.s, got, c.want)
+		}
+	}
+}
+
+func TestScanOperators(t *testing.T) {
+	g, _ := newTestGsm(t, replyQuery("AT+COPS=?",
+		`+COPS: (2,"CHINA MOBILE","CMCC","46000",7),(1,"CHN-UNICOM","UNICOM","46001",2),`+
+			`(3,"CHN-CT","CT","46011"),,(0-4),(0-2)`))
+	ops, err := g.ScanOperators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Operator{
+		{2, "CHINA MOBILE", "CMCC", "46000", ACT_EUTRAN},
+		{1, "CHN-UNICOM", "UNICOM", "46001", ACT_UTRAN},
+		{3, "CHN-CT", "CT", "46011", ACT_UNKNOWN},
+	}
+	if !reflect.DeepEqual(ops, want) {
+		t.Fatalf("operators %+v, want %+v", ops, want)
+	}
+}
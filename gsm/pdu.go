@@ -0,0 +1,487 @@
+package gsm
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// GSM 03.38 7位默认字母表
+var gsm7Basic = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// 7位字母表的扩展表, 前面加转义字符0x1B
+var gsm7Ext = map[byte]rune{
+	0x0A: '\f',
+	0x14: '^',
+	0x28: '{',
+	0x29: '}',
+	0x2F: '\\',
+	0x3C: '[',
+	0x3D: '~',
+	0x3E: ']',
+	0x40: '|',
+	0x65: '€',
+}
+
+var (
+	gsm7BasicIndex = map[rune]byte{}
+	gsm7ExtIndex   = map[rune]byte{}
+)
+
+func init() {
+	for i, r := range gsm7Basic {
+		if i != 0x1B {
+			gsm7BasicIndex[r] = byte(i)
+		}
+	}
+	for b, r := range gsm7Ext {
+		gsm7ExtIndex[r] = b
+	}
+}
+
+var errPDU = errors.New("Malformed SMS PDU")
+
+// 字符编码为7位字母表时占用的septet数, 0表示不能编码.
+func gsm7Len(r rune) int {
+	if _, ok := gsm7BasicIndex[r]; ok {
+		return 1
+	}
+	if _, ok := gsm7ExtIndex[r]; ok {
+		return 2
+	}
+	return 0
+}
+
+// 编码为7位字母表的septet序列.
+func gsm7Encode(s string) []byte {
+	septets := []byte{}
+	for _, r := range s {
+		if b, ok := gsm7BasicIndex[r]; ok {
+			septets = append(septets, b)
+		} else if b, ok := gsm7ExtIndex[r]; ok {
+			septets = append(septets, 0x1B, b)
+		} else {
+			septets = append(septets, gsm7BasicIndex['?'])
+		}
+	}
+	return septets
+}
+
+// 解码7位字母表的septet序列.
+func gsm7Decode(septets []byte) string {
+	var sb strings.Builder
+	for i := 0; i < len(septets); i++ {
+		c := septets[i] & 0x7F
+		if c == 0x1B && i+1 < len(septets) {
+			i++
+			if r, ok := gsm7Ext[septets[i]]; ok {
+				sb.WriteRune(r)
+			} else {
+				// 未知的扩展字符按基本表显示
+				sb.WriteRune(gsm7Basic[septets[i]&0x7F])
+			}
+			continue
+		}
+		sb.WriteRune(gsm7Basic[c])
+	}
+	return sb.String()
+}
+
+// 把septet打包成octet, fill为开头的填充位数(跟在用户数据头后面).
+func packSeptets(septets []byte, fill int) []byte {
+	bits := fill + len(septets)*7
+	out := make([]byte, (bits+7)/8)
+	pos := fill
+	for _, s := range septets {
+		v := uint(s&0x7F) << uint(pos%8)
+		out[pos/8] |= byte(v)
+		if pos%8 > 1 {
+			out[pos/8+1] |= byte(v >> 8)
+		}
+		pos += 7
+	}
+	return out
+}
+
+// 从octet中解出count个septet, 跳过开头fill位.
+func unpackSeptets(data []byte, count int, fill int) []byte {
+	septets := make([]byte, 0, count)
+	for i := 0; i < count; i++ {
+		pos := fill + i*7
+		if pos/8 >= len(data) {
+			break
+		}
+		v := uint(data[pos/8]) >> uint(pos%8)
+		if pos%8 > 1 && pos/8+1 < len(data) {
+			v |= uint(data[pos/8+1]) << uint(8-pos%8)
+		}
+		septets = append(septets, byte(v&0x7F))
+	}
+	return septets
+}
+
+// 编码地址字段: 号码位数, 号码类型, 半字节BCD.
+func encodeAddress(num string) []byte {
+	toa := byte(0x81)
+	if strings.HasPrefix(num, "+") {
+		toa = 0x91
+		num = num[1:]
+	}
+
+	digits := []byte{}
+	for _, c := range num {
+		switch {
+		case c >= '0' && c <= '9':
+			digits = append(digits, byte(c-'0'))
+		case c == '*':
+			digits = append(digits, 0x0A)
+		case c == '#':
+			digits = append(digits, 0x0B)
+		}
+	}
+
+	out := []byte{byte(len(digits)), toa}
+	for i := 0; i < len(digits); i += 2 {
+		b := digits[i]
+		if i+1 < len(digits) {
+			b |= digits[i+1] << 4
+		} else {
+			b |= 0xF0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// 解码地址字段, 返回地址和占用的字节数.
+func decodeAddress(b []byte) (string, int, error) {
+	if len(b) < 2 {
+		return "", 0, errPDU
+	}
+	digits := int(b[0])
+	toa := b[1]
+	n := 2 + (digits+1)/2
+	if len(b) < n {
+		return "", 0, errPDU
+	}
+	value := b[2:n]
+
+	// 字母数字地址, 7位字母表
+	if toa&0x70 == 0x50 {
+		return gsm7Decode(unpackSeptets(value, digits*4/7, 0)), n, nil
+	}
+
+	var sb strings.Builder
+	if toa&0x70 == 0x10 {
+		sb.WriteByte('+')
+	}
+	const semiOctets = "0123456789*#abc"
+	for i := 0; i < digits; i++ {
+		d := value[i/2]
+		if i%2 == 1 {
+			d >>= 4
+		}
+		d &= 0x0F
+		if d < 0x0F {
+			sb.WriteByte(semiOctets[d])
+		}
+	}
+	return sb.String(), n, nil
+}
+
+// 数据编码方案中的字母表
+const (
+	alphabetGSM7 = iota
+	alphabet8Bit
+	alphabetUCS2
+)
+
+func dcsAlphabet(dcs byte) int {
+	switch {
+	case dcs&0x80 == 0:
+		// 通用编码组和自动删除组
+		switch (dcs >> 2) & 0x03 {
+		case 1:
+			return alphabet8Bit
+		case 2:
+			return alphabetUCS2
+		}
+	case dcs&0xF0 == 0xE0:
+		return alphabetUCS2
+	case dcs&0xF0 == 0xF0 && dcs&0x04 != 0:
+		return alphabet8Bit
+	}
+	return alphabetGSM7
+}
+
+// 长短信的用户数据头信息单元
+type concatInfo struct {
+	ref   int
+	total int
+	seq   int
+}
+
+// 解析用户数据头, 返回长短信信息(没有时为nil).
+func parseUDH(udh []byte) *concatInfo {
+	for i := 0; i+1 < len(udh); {
+		iei, l := udh[i], int(udh[i+1])
+		v := udh[i+2:]
+		if len(v) < l {
+			return nil
+		}
+		v = v[:l]
+		switch {
+		case iei == 0x00 && l == 3:
+			return &concatInfo{ref: int(v[0]), total: int(v[1]), seq: int(v[2])}
+		case iei == 0x08 && l == 4:
+			return &concatInfo{ref: int(v[0])<<8 | int(v[1]), total: int(v[2]), seq: int(v[3])}
+		}
+		i += 2 + l
+	}
+	return nil
+}
+
+// 解码后的SMS-DELIVER
+type deliverPDU struct {
+	sender string
+	concat *concatInfo
+	text   string
+}
+
+// 解码SMS-DELIVER的PDU(包括开头的短信中心地址).
+func decodeDeliver(b []byte) (*deliverPDU, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, errPDU
+	}
+	b = b[1+int(b[0]):]
+	if len(b) < 1 || b[0]&0x03 != 0x00 {
+		return nil, errPDU
+	}
+	udhi := b[0]&0x40 != 0
+
+	sender, n, err := decodeAddress(b[1:])
+	if err != nil {
+		return nil, err
+	}
+	b = b[1+n:]
+
+	// PID, DCS, SCTS(7), UDL
+	if len(b) < 10 {
+		return nil, errPDU
+	}
+	dcs := b[1]
+	udl := int(b[9])
+	ud := b[10:]
+
+	d := &deliverPDU{sender: sender}
+	d.text, d.concat, err = decodeUserData(ud, udl, dcs, udhi)
+	return d, err
+}
+
+// 解码用户数据, udl为septet数(7位字母表)或octet数.
+func decodeUserData(ud []byte, udl int, dcs byte, udhi bool) (string, *concatInfo, error) {
+	headerLen := 0
+	var concat *concatInfo
+	if udhi {
+		if len(ud) < 1 || len(ud) < 1+int(ud[0]) {
+			return "", nil, errPDU
+		}
+		headerLen = 1 + int(ud[0])
+		concat = parseUDH(ud[1:headerLen])
+	}
+
+	switch dcsAlphabet(dcs) {
+	case alphabetGSM7:
+		// 用户数据头后面填充到septet边界
+		headerSeptets := (headerLen*8 + 6) / 7
+		if udl < headerSeptets {
+			return "", nil, errPDU
+		}
+		fill := headerSeptets*7 - headerLen*8
+		septets := unpackSeptets(ud[headerLen:], udl-headerSeptets, fill)
+		return gsm7Decode(septets), concat, nil
+
+	case alphabetUCS2:
+		if udl > len(ud) {
+			udl = len(ud)
+		}
+		if udl < headerLen {
+			return "", nil, errPDU
+		}
+		data := ud[headerLen:udl]
+		u := make([]uint16, len(data)/2)
+		for i := range u {
+			u[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		}
+		return string(utf16.Decode(u)), concat, nil
+	}
+
+	if udl > len(ud) {
+		udl = len(ud)
+	}
+	if udl < headerLen {
+		return "", nil, errPDU
+	}
+	return string(ud[headerLen:udl]), concat, nil
+}
+
+// 相对有效期的编码(3GPP TS 23.040 9.2.3.12.1).
+func encodeValidity(d time.Duration) byte {
+	switch {
+	case d <= 12*time.Hour:
+		v := int(d/(5*time.Minute)) - 1
+		if v < 0 {
+			v = 0
+		}
+		return byte(v)
+	case d <= 24*time.Hour:
+		return byte(143 + int((d-12*time.Hour)/(30*time.Minute)))
+	case d <= 30*24*time.Hour:
+		return byte(166 + int(d/(24*time.Hour)))
+	case d <= 63*7*24*time.Hour:
+		return byte(192 + int(d/(7*24*time.Hour)))
+	}
+	return 255
+}
+
+// 短信的有效期
+const SMS_VALIDITY = time.Hour * 24 * 4
+
+// 一条短信的用户数据最大长度(octet)
+const maxUserData = 140
+
+// 判断文本能否用7位字母表编码.
+func isGSM7(text string) bool {
+	for _, r := range text {
+		if gsm7Len(r) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 把文本分成长短信的各部分, headerLen为每部分用户数据头的长度(含长度字节).
+// 7位字母表的扩展字符和UTF-16代理对不会被拆开.
+func splitText(text string, ucs2 bool, headerLen int) []string {
+	runes := []rune(text)
+
+	// 不需要拆分
+	if ucs2 {
+		if len(utf16.Encode(runes))*2 <= maxUserData {
+			return []string{text}
+		}
+	} else if len(gsm7Encode(text)) <= maxUserData*8/7 {
+		return []string{text}
+	}
+
+	limit := (maxUserData - headerLen) * 8 / 7
+	if ucs2 {
+		limit = (maxUserData - headerLen) / 2
+	}
+
+	parts := []string{}
+	start, used := 0, 0
+	for i, r := range runes {
+		n := gsm7Len(r)
+		if ucs2 {
+			n = len(utf16.Encode([]rune{r}))
+		}
+		if used+n > limit {
+			parts = append(parts, string(runes[start:i]))
+			start, used = i, 0
+		}
+		used += n
+	}
+	return append(parts, string(runes[start:]))
+}
+
+// 编码SMS-SUBMIT, 返回TPDU长度和包括短信中心地址(使用SIM卡中的设置)的PDU.
+// concat 为nil时是普通短信.
+// ref16 使用16位参考号.
+func encodeSubmit(num, text string, ucs2 bool, concat *concatInfo, ref16 bool, statusReport bool) (int, []byte) {
+	first := byte(0x01 | 0x10) // SMS-SUBMIT, 相对有效期
+	if statusReport {
+		first |= 0x20
+	}
+
+	var udh []byte
+	if concat != nil {
+		first |= 0x40
+		if ref16 {
+			udh = []byte{6, 0x08, 4, byte(concat.ref >> 8), byte(concat.ref), byte(concat.total), byte(concat.seq)}
+		} else {
+			udh = []byte{5, 0x00, 3, byte(concat.ref), byte(concat.total), byte(concat.seq)}
+		}
+	}
+
+	dcs := byte(0x00)
+	var udl int
+	var ud []byte
+	if ucs2 {
+		dcs = 0x08
+		ud = append(ud, udh...)
+		for _, u := range utf16.Encode([]rune(text)) {
+			ud = append(ud, byte(u>>8), byte(u))
+		}
+		udl = len(ud)
+	} else {
+		septets := gsm7Encode(text)
+		headerSeptets := (len(udh)*8 + 6) / 7
+		fill := headerSeptets*7 - len(udh)*8
+		ud = append(ud, udh...)
+		ud = append(ud, packSeptets(septets, fill)...)
+		udl = headerSeptets + len(septets)
+	}
+
+	tpdu := []byte{first, 0x00} // 参考号由模块填写
+	tpdu = append(tpdu, encodeAddress(num)...)
+	tpdu = append(tpdu, 0x00, dcs, encodeValidity(SMS_VALIDITY), byte(udl))
+	tpdu = append(tpdu, ud...)
+
+	return len(tpdu), append([]byte{0x00}, tpdu...)
+}
+
+// 解码时间戳(半字节BCD, 7字节).
+func decodeTimestamp(b []byte) time.Time {
+	bcd := func(v byte) int {
+		return int(v&0x0F)*10 + int(v>>4)
+	}
+	// 时区以15分钟为单位, 高半字节的第3位为负号
+	tz := int(b[6]&0x07)*10 + int(b[6]>>4)
+	if b[6]&0x08 != 0 {
+		tz = -tz
+	}
+	loc := time.FixedZone("", tz*15*60)
+	return time.Date(2000+bcd(b[0]), time.Month(bcd(b[1])), bcd(b[2]),
+		bcd(b[3]), bcd(b[4]), bcd(b[5]), 0, loc)
+}
+
+// 解码SMS-STATUS-REPORT的PDU(包括开头的短信中心地址).
+func decodeStatusReport(b []byte) (*StatusReport, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, errPDU
+	}
+	b = b[1+int(b[0]):]
+	if len(b) < 2 || b[0]&0x03 != 0x02 {
+		return nil, errPDU
+	}
+	r := &StatusReport{Ref: int(b[1])}
+
+	recipient, n, err := decodeAddress(b[2:])
+	if err != nil {
+		return nil, err
+	}
+	r.Recipient = recipient
+	b = b[2+n:]
+
+	// SCTS(7), DT(7), ST
+	if len(b) < 15 {
+		return nil, errPDU
+	}
+	r.SCTime = decodeTimestamp(b[0:7])
+	r.Discharge = decodeTimestamp(b[7:14])
+	r.Status = int(b[14])
+	return r, nil
+}
@@ -0,0 +1,112 @@
+package gsm
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// 把encodeSubmit生成的SMS-SUBMIT转换为同样内容的SMS-DELIVER.
+func toDeliver(submit []byte) []byte {
+	tpdu := submit[1:]
+	n := 2 + (int(tpdu[2])+1)/2
+	addr := tpdu[2 : 2+n]
+	rest := tpdu[2+n:] // PID, DCS, VP, UDL, UD
+
+	out := []byte{0x00, tpdu[0] & 0x40}
+	out = append(out, addr...)
+	out = append(out, rest[0], rest[1])
+	out = append(out, 0x99, 0x30, 0x92, 0x51, 0x61, 0x95, 0x80)
+	return append(out, rest[3:]...)
+}
+
+func TestDecodeDeliver(t *testing.T) {
+	b, _ := hex.DecodeString("07917283010010F5040BC87238880900F10000993092516195800AE8329BFD4697D9EC37")
+	d, err := decodeDeliver(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.sender != "27838890001" || d.text != "hellohello" || d.concat != nil {
+		t.Fatalf("decodeDeliver = %+v", d)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		pdu  string
+	}{
+		{"empty", ""},
+		{"short smsc", "07917283"},
+		{"no first octet", "00"},
+		{"not deliver", "0001"},
+		{"no address", "0004"},
+		{"short address", "00040B91"},
+		{"short header", "00040391214300"},
+		{"udh longer than data", "00440391214300009930925161958005" + "0500"},
+		{"gsm7 udl shorter than udh", "00440391214300009930925161958002" + "050003010201"},
+		{"ucs2 udl shorter than udh", "00440391214300089930925161958002" + "050003010201"},
+		{"8bit udl shorter than udh", "00440391214300049930925161958002" + "050003010201"},
+	}
+
+	for _, tt := range tests {
+		b, err := hex.DecodeString(tt.pdu)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if _, err := decodeDeliver(b); err != errPDU {
+			t.Errorf("%s: decodeDeliver error = %v, want %v", tt.name, err, errPDU)
+		}
+	}
+}
+
+func TestDecodeStatusReportMalformed(t *testing.T) {
+	for _, s := range []string{"", "05", "00", "0002", "00060A", "0006010391214300", "000601039121430099309251619580"} {
+		b, _ := hex.DecodeString(s)
+		if _, err := decodeStatusReport(b); err != errPDU {
+			t.Errorf("%q: decodeStatusReport error = %v, want %v", s, err, errPDU)
+		}
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	texts := []string{
+		"short [x]",
+		"短",
+		strings.Repeat("x", 160),
+		strings.Repeat("x", 161),
+		strings.Repeat("abc{}€defg", 40),
+		strings.Repeat("中文短信😀", 30),
+	}
+
+	for _, ref16 := range []bool{false, true} {
+		for _, text := range texts {
+			g := &Gsm{mConcatRef16: ref16}
+			lens, pdus, err := g.encodeSMS("+8613800138000", text)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var sb strings.Builder
+			for i, p := range pdus {
+				if lens[i] != len(p)-1 {
+					t.Fatalf("part %d: length %d, want %d", i, lens[i], len(p)-1)
+				}
+				d, err := decodeDeliver(toDeliver(p))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if d.sender != "+8613800138000" {
+					t.Fatalf("sender %q", d.sender)
+				}
+				if len(pdus) > 1 && (d.concat == nil || d.concat.seq != i+1 || d.concat.total != len(pdus)) {
+					t.Fatalf("part %d: concat %+v", i, d.concat)
+				}
+				sb.WriteString(d.text)
+			}
+			if sb.String() != text {
+				t.Errorf("ref16=%v: got %q, want %q", ref16, sb.String(), text)
+			}
+		}
+	}
+}
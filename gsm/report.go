@@ -0,0 +1,85 @@
+package gsm
+
+import "time"
+
+// 短信状态报告(SMS-STATUS-REPORT).
+type StatusReport struct {
+	Ref       int       // 发送时+CMGS返回的参考号
+	Recipient string    // 接收者号码
+	SCTime    time.Time // 短信中心收到短信的时间
+	Discharge time.Time // 投递(或最后一次尝试投递)的时间
+	Status    int       // TP-Status, 见3GPP TS 23.040 9.2.3.15
+}
+
+// 短信已送达.
+func (r *StatusReport) Delivered() bool {
+	return r.Status < 0x20
+}
+
+// 短信中心仍在尝试投递.
+func (r *StatusReport) Pending() bool {
+	return r.Status >= 0x20 && r.Status < 0x40
+}
+
+// 投递失败, 短信中心不再尝试.
+func (r *StatusReport) Failed() bool {
+	return r.Status >= 0x40
+}
+
+// 已发送且请求了状态报告的短信
+type sentSMS struct {
+	number string
+	refs   []int
+}
+
+// 处理状态报告, 对应到已发送的短信.
+func (g *Gsm) handleStatusReport(pdu []byte) {
+	ev := &StatusReportEvent{PDU: pdu}
+	r, err := decodeStatusReport(pdu)
+	if err != nil {
+		g.mLogger.Error(`GSMSMS: Decode status report error "%v"`, err)
+	} else {
+		ev.Report = r
+
+		g.mSentLock.Lock()
+		if s := g.mSent[r.Ref]; s != nil {
+			ev.Number = s.number
+			ev.Refs = append([]int{}, s.refs...)
+			if !r.Pending() {
+				delete(g.mSent, r.Ref)
+			}
+		}
+		handler := g.mDeliveryHandler
+		g.mSentLock.Unlock()
+
+		if handler != nil {
+			handler(ev)
+		}
+	}
+	g.emit(ev)
+}
+
+// 记录已发送短信(或长短信的一部分)的参考号, 在状态报告到达前调用.
+// 参考号只有8位, 重复时覆盖旧的记录.
+func (g *Gsm) trackSent(s *sentSMS, ref int) {
+	g.mSentLock.Lock()
+	defer g.mSentLock.Unlock()
+	s.refs = append(s.refs, ref)
+	g.mSent[ref] = s
+}
+
+// 设置发送短信时是否请求状态报告, 修改后需要重新调用Init.
+// 状态报告通过Events的StatusReportEvent和SetDeliveryHandler设置的函数送出.
+func (g *Gsm) SetStatusReport(on bool) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	g.mStatusReport = on
+}
+
+// 设置收到状态报告时调用的函数, 与Events不同, 状态报告不会被丢弃.
+// handler在接收协程中调用, 不能阻塞, 也不能发送AT命令.
+func (g *Gsm) SetDeliveryHandler(handler func(ev *StatusReportEvent)) {
+	g.mSentLock.Lock()
+	defer g.mSentLock.Unlock()
+	g.mDeliveryHandler = handler
+}
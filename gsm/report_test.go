@@ -0,0 +1,65 @@
+package gsm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// +CDS:上报的SMS-STATUS-REPORT, 参考号和TP-Status可变.
+func statusReportURC(ref, status int) string {
+	pdu := fmt.Sprintf("07911326040000F006%02X0B911326880736F49930925161958099309251710080%02X", ref, status)
+	return fmt.Sprintf("\r\n+CDS: %d\r\n%s\r\n", len(pdu)/2-8, pdu)
+}
+
+func TestStatusReportCorrelation(t *testing.T) {
+	g, modem := newTestGsm(t, func(cmd string) string { return "" })
+	reports := make(chan *StatusReportEvent, 1)
+	g.SetDeliveryHandler(func(ev *StatusReportEvent) { reports <- ev })
+
+	// 两段的长短信
+	sent := &sentSMS{number: "10086"}
+	g.trackSent(sent, 41)
+	g.trackSent(sent, 42)
+
+	for _, c := range []struct {
+		ref, status int
+		number      string
+		refs        []int
+		state       string
+	}{
+		{42, 0x20, "10086", []int{41, 42}, "pending"},
+		{42, 0x00, "10086", []int{41, 42}, "delivered"},
+		// 投递完成后不再对应
+		{42, 0x00, "", nil, "delivered"},
+		{41, 0x41, "10086", []int{41, 42}, "failed"},
+		{7, 0x00, "", nil, "delivered"},
+	} {
+		modem.Write([]byte(statusReportURC(c.ref, c.status)))
+		var ev *StatusReportEvent
+		select {
+		case ev = <-reports:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ref %d: no report", c.ref)
+		}
+
+		r := ev.Report
+		if r == nil || r.Ref != c.ref || r.Status != c.status || r.Recipient != "+31628870634" {
+			t.Fatalf("ref %d: report %+v", c.ref, r)
+		}
+		state := map[bool]string{true: "pending"}[r.Pending()] +
+			map[bool]string{true: "delivered"}[r.Delivered()] +
+			map[bool]string{true: "failed"}[r.Failed()]
+		if ev.Number != c.number || !reflect.DeepEqual(ev.Refs, c.refs) || state != c.state {
+			t.Errorf("ref %d status %#x: number %q refs %v %s, want %q %v %s",
+				c.ref, c.status, ev.Number, ev.Refs, state, c.number, c.refs, c.state)
+		}
+	}
+
+	g.mSentLock.Lock()
+	defer g.mSentLock.Unlock()
+	if len(g.mSent) != 0 {
+		t.Fatalf("%d sent sms left", len(g.mSent))
+	}
+}
@@ -0,0 +1,257 @@
+package gsm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xiqingping/golibs/gsm/atcmd"
+)
+
+// SIM卡状态(AT+CPIN?).
+type SIMState int
+
+const (
+	SIM_UNKNOWN SIMState = iota
+	SIM_READY
+	SIM_PIN  // 需要PIN
+	SIM_PUK  // PIN已锁, 需要PUK
+	SIM_PIN2 // 需要PIN2
+	SIM_PUK2
+	SIM_PH_PIN // 需要手机锁密码(PH-SIM PIN等)
+	SIM_NOT_INSERTED
+	SIM_BUSY
+	SIM_FAILURE
+)
+
+func (s SIMState) String() string {
+	switch s {
+	case SIM_READY:
+		return "READY"
+	case SIM_PIN:
+		return "SIM PIN"
+	case SIM_PUK:
+		return "SIM PUK"
+	case SIM_PIN2:
+		return "SIM PIN2"
+	case SIM_PUK2:
+		return "SIM PUK2"
+	case SIM_PH_PIN:
+		return "PH PIN"
+	case SIM_NOT_INSERTED:
+		return "not inserted"
+	case SIM_BUSY:
+		return "busy"
+	case SIM_FAILURE:
+		return "failure"
+	}
+	return "unknown"
+}
+
+// SIM卡未就绪, Init在SIM卡需要PIN, PUK或未插入时返回.
+type SIMError struct {
+	State SIMState
+}
+
+func (e *SIMError) Error() string {
+	return "SIM not ready: " + e.State.String()
+}
+
+// 模块配置不支持的功能
+var ErrNotSupported = errors.New("Not supported by the module profile")
+
+// 查询PIN/PUK剩余次数的厂商命令.
+type PINCounter struct {
+	Command string // 例如`AT+QPINC="SC"`
+	Prefix  string // 例如"+QPINC:"
+	PIN     int    // PIN剩余次数在应答参数中的位置
+	PUK     int    // PUK剩余次数在应答参数中的位置
+}
+
+// 等待SIM卡就绪的查询次数和间隔
+const (
+	SIM_RETRIES  = 10
+	SIM_INTERVAL = time.Second
+)
+
+// 把+CPIN的应答转换为状态.
+func parseSIMState(v string) SIMState {
+	switch strings.Trim(strings.TrimSpace(v), `"`) {
+	case "READY":
+		return SIM_READY
+	case "SIM PIN":
+		return SIM_PIN
+	case "SIM PUK":
+		return SIM_PUK
+	case "SIM PIN2":
+		return SIM_PIN2
+	case "SIM PUK2":
+		return SIM_PUK2
+	case "PH-SIM PIN", "PH-FSIM PIN", "PH-NET PIN", "PH-NETSUB PIN", "PH-SP PIN", "PH-CORP PIN":
+		return SIM_PH_PIN
+	case "NOT INSERTED":
+		// SIM800等模块不返回+CME ERROR: 10
+		return SIM_NOT_INSERTED
+	case "NOT READY":
+		return SIM_BUSY
+	}
+	return SIM_UNKNOWN
+}
+
+// 把+CME ERROR转换为状态, 不是SIM卡相关的错误时返回SIM_UNKNOWN.
+func cmeSIMState(err error) SIMState {
+	switch {
+	case atcmd.IsCME(err, atcmd.CME_SIM_NOT_INSERTED):
+		return SIM_NOT_INSERTED
+	case atcmd.IsCME(err, atcmd.CME_SIM_PIN_REQUIRED):
+		return SIM_PIN
+	case atcmd.IsCME(err, atcmd.CME_SIM_PUK_REQUIRED):
+		return SIM_PUK
+	case atcmd.IsCME(err, atcmd.CME_SIM_FAILURE), atcmd.IsCME(err, atcmd.CME_SIM_WRONG):
+		return SIM_FAILURE
+	case atcmd.IsCME(err, atcmd.CME_SIM_BUSY):
+		return SIM_BUSY
+	}
+	return SIM_UNKNOWN
+}
+
+// 查询SIM卡状态(AT+CPIN?).
+func (g *Gsm) SIMState() (SIMState, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.simState()
+}
+
+func (g *Gsm) simState() (SIMState, error) {
+	resp, err := g.mAT.Send(&atcmd.Command{Cmd: "AT+CPIN?", Prefix: "+CPIN:", Timeout: time.Second * 5})
+	if err != nil {
+		if state := cmeSIMState(err); state != SIM_UNKNOWN {
+			return state, nil
+		}
+		return SIM_UNKNOWN, err
+	}
+	v, ok := resp.Value("+CPIN:")
+	if !ok {
+		return SIM_UNKNOWN, errors.New("No +CPIN response")
+	}
+	return parseSIMState(v), nil
+}
+
+// 等待SIM卡就绪, 需要PIN且配置了Config.PIN时自动输入.
+// 一直查询失败时返回最后的错误.
+func (g *Gsm) waitForSIM() error {
+	pinEntered := false
+	state := SIM_UNKNOWN
+	var err error
+	for i := 0; i < SIM_RETRIES; i++ {
+		if i > 0 {
+			time.Sleep(SIM_INTERVAL)
+		}
+
+		state, err = g.simState()
+		if err != nil {
+			// 模块启动过程中可能暂时不响应, 继续查询
+			g.mLogger.Warn(`GSMSIM: Query SIM state error "%v"`, err)
+			continue
+		}
+
+		switch state {
+		case SIM_READY, SIM_PIN2, SIM_PUK2:
+			// PIN2只在需要时输入
+			return nil
+		case SIM_PIN:
+			if g.mConfig.PIN == "" || pinEntered {
+				return &SIMError{State: state}
+			}
+			// 只输入一次, 以免PIN错误时锁卡
+			pinEntered = true
+			if err := g.enterPIN(g.mConfig.PIN); err != nil {
+				return err
+			}
+		case SIM_BUSY, SIM_UNKNOWN:
+		default:
+			return &SIMError{State: state}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return &SIMError{State: state}
+}
+
+func (g *Gsm) enterPIN(pin string) error {
+	_, err := g.mAT.Command(fmt.Sprintf(`AT+CPIN="%s"`, pin), time.Second*10)
+	return err
+}
+
+// 输入PIN.
+func (g *Gsm) EnterPIN(pin string) error {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.enterPIN(pin)
+}
+
+// 输入PUK并设置新的PIN.
+func (g *Gsm) EnterPUK(puk, newPIN string) error {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	_, err := g.mAT.Command(fmt.Sprintf(`AT+CPIN="%s","%s"`, puk, newPIN), time.Second*10)
+	return err
+}
+
+// 修改PIN, 需要已开启PIN锁.
+func (g *Gsm) ChangePIN(oldPIN, newPIN string) error {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	_, err := g.mAT.Command(fmt.Sprintf(`AT+CPWD="SC","%s","%s"`, oldPIN, newPIN), time.Second*10)
+	return err
+}
+
+// 开启或关闭PIN锁.
+func (g *Gsm) SetPINLock(enable bool, pin string) error {
+	mode := 0
+	if enable {
+		mode = 1
+	}
+
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	_, err := g.mAT.Command(fmt.Sprintf(`AT+CLCK="SC",%d,"%s"`, mode, pin), time.Second*10)
+	return err
+}
+
+// 查询PIN锁是否开启.
+func (g *Gsm) PINLock() (bool, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	v, err := g.query(`AT+CLCK="SC",2`, "+CLCK:")
+	if err != nil {
+		return false, err
+	}
+	return atcmd.IntParam(atcmd.SplitParams(v), 0, 0) == 1, nil
+}
+
+// 查询PIN和PUK的剩余次数, 命令由Config.PINCounter指定.
+// 没有配置时返回ErrNotSupported.
+func (g *Gsm) PINRetries() (pin, puk int, err error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+
+	c := g.mConfig.PINCounter
+	if c == nil {
+		return 0, 0, ErrNotSupported
+	}
+	v, err := g.query(c.Command, c.Prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	pin, puk = c.parse(v)
+	return pin, puk, nil
+}
+
+// 从应答参数中取出PIN和PUK的剩余次数, 没有时为-1.
+func (c *PINCounter) parse(v string) (pin, puk int) {
+	params := atcmd.SplitParams(v)
+	return atcmd.IntParam(params, c.PIN, -1), atcmd.IntParam(params, c.PUK, -1)
+}
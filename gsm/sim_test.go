@@ -0,0 +1,94 @@
+package gsm
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSIMState(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want SIMState
+	}{
+		{"+CPIN: READY", SIM_READY},
+		{"+CPIN: SIM PIN", SIM_PIN},
+		{"+CPIN: SIM PUK", SIM_PUK},
+		{"+CPIN: SIM PIN2", SIM_PIN2},
+		{"+CPIN: SIM PUK2", SIM_PUK2},
+		{"+CPIN: PH-SIM PIN", SIM_PH_PIN},
+		{"+CPIN: PH-NET PIN", SIM_PH_PIN},
+		{"+CPIN: NOT INSERTED", SIM_NOT_INSERTED}, // SIM800
+		{"+CPIN: NOT READY", SIM_BUSY},
+		{`+CPIN: "READY"`, SIM_READY},
+		{"+CPIN: SOMETHING", SIM_UNKNOWN},
+	} {
+		if got := parseSIMState(strings.TrimPrefix(c.line, "+CPIN:")); got != c.want {
+			t.Errorf("%q: %v, want %v", c.line, got, c.want)
+		}
+	}
+}
+
+func TestParsePINCounter(t *testing.T) {
+	for _, c := range []struct {
+		module   string
+		line     string
+		pin, puk int
+	}{
+		{"SIM800", "+SPIC: 2,3,10,10", 2, 10},
+		{"SIM800", "+SPIC: 0,3,9,10", 0, 9},
+		{"EC25", `+QPINC: "SC",3,10`, 3, 10},
+		{"SARA-R4", "+UPINCNT: 1,3,10,10", 1, 10},
+		{"SIM800", "+SPIC: 3", 3, -1},
+	} {
+		profile, err := Profile(c.module)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counter := profile.PINCounter
+		pin, puk := counter.parse(strings.TrimPrefix(c.line, counter.Prefix))
+		if pin != c.pin || puk != c.puk {
+			t.Errorf("%s %q: PIN %d, PUK %d, want %d, %d", c.module, c.line, pin, puk, c.pin, c.puk)
+		}
+	}
+}
+
+func TestWaitForSIMNotInserted(t *testing.T) {
+	queries := 0
+	g, _ := newTestGsm(t, func(cmd string) string {
+		if cmd == "AT+CPIN?" {
+			queries++
+			return "\r\n+CPIN: NOT INSERTED\r\n\r\nOK\r\n"
+		}
+		return "\r\nOK\r\n"
+	})
+
+	start := time.Now()
+	err := g.waitForSIM()
+	if e, ok := err.(*SIMError); !ok || e.State != SIM_NOT_INSERTED {
+		t.Fatalf("waitForSIM: %v, want SIM not inserted", err)
+	}
+	if queries != 1 || time.Since(start) > SIM_INTERVAL {
+		t.Fatalf("%d queries in %v, want to fail at once", queries, time.Since(start))
+	}
+}
+
+func TestWaitForSIMQueryError(t *testing.T) {
+	queries := 0
+	g, _ := newTestGsm(t, func(cmd string) string {
+		if cmd != "AT+CPIN?" {
+			return "\r\nOK\r\n"
+		}
+		// 第一次查询没有应答, 然后报告需要PIN
+		queries++
+		if queries == 1 {
+			return "\r\nERROR\r\n"
+		}
+		return "\r\n+CPIN: SIM PIN\r\n\r\nOK\r\n"
+	})
+
+	err := g.waitForSIM()
+	if e, ok := err.(*SIMError); !ok || e.State != SIM_PIN {
+		t.Fatalf("waitForSIM: %v, want SIM PIN required", err)
+	}
+}
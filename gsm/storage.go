@@ -0,0 +1,290 @@
+package gsm
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xiqingping/golibs/gsm/atcmd"
+	"github.com/xlab/at/sms"
+)
+
+// 短信状态(PDU模式下AT+CMGL的<stat>)
+const (
+	SMS_REC_UNREAD = 0
+	SMS_REC_READ   = 1
+	SMS_STO_UNSENT = 2
+	SMS_STO_SENT   = 3
+	SMS_ALL        = 4
+)
+
+// 存储模式下待读取短信的队列大小
+const FETCH_QUEUE_SIZE = 32
+
+// 存储器中的短信.
+type StoredSMS struct {
+	Index   int
+	Stat    int // SMS_REC_UNREAD等
+	PDU     []byte
+	Message *sms.Message
+}
+
+// 短信存储器的使用情况.
+type SMSStorage struct {
+	Name  string // 例如"SM", "ME"
+	Used  int
+	Total int
+}
+
+// 解析存储的短信, header为+CMGL/+CMGR去掉前缀后的内容, s为PDU字符串.
+// index <0 时从header中取索引(+CMGL).
+func parseStored(header, s string, index int) (*StoredSMS, error) {
+	params := atcmd.SplitParams(header)
+	stored := &StoredSMS{Index: index}
+	if index < 0 {
+		stored.Index = atcmd.IntParam(params, 0, -1)
+		params = params[1:]
+	}
+	stored.Stat = atcmd.IntParam(params, 0, -1)
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	stored.PDU = b
+
+	var msg sms.Message
+	if _, err = msg.ReadFrom(b); err != nil {
+		return nil, err
+	}
+	stored.Message = &msg
+	return stored, nil
+}
+
+// 设置首选存储器(AT+CPMS).
+// read 读取和删除使用的存储器, write 写入和发送, receive 接收的短信.
+// write或receive为空时不设置.
+func (g *Gsm) SetPreferredStorage(read, write, receive string) error {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+
+	cmd := fmt.Sprintf(`AT+CPMS="%s"`, read)
+	if write != "" {
+		cmd += fmt.Sprintf(`,"%s"`, write)
+		if receive != "" {
+			cmd += fmt.Sprintf(`,"%s"`, receive)
+		}
+	}
+	_, err := g.mAT.Send(&atcmd.Command{Cmd: cmd, Prefix: "+CPMS:", Timeout: time.Second * 5})
+	return err
+}
+
+// 查询存储器使用情况, 依次为读取, 写入, 接收使用的存储器.
+func (g *Gsm) StorageUsage() ([]SMSStorage, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+
+	resp, err := g.mAT.Send(&atcmd.Command{Cmd: "AT+CPMS?", Prefix: "+CPMS:", Timeout: time.Second * 5})
+	if err != nil {
+		return nil, err
+	}
+	v, ok := resp.Value("+CPMS:")
+	if !ok {
+		return nil, errors.New("No +CPMS response")
+	}
+
+	params := atcmd.SplitParams(v)
+	storages := []SMSStorage{}
+	for i := 0; i+2 < len(params); i += 3 {
+		storages = append(storages, SMSStorage{
+			Name:  params[i],
+			Used:  atcmd.IntParam(params, i+1, 0),
+			Total: atcmd.IntParam(params, i+2, 0),
+		})
+	}
+	return storages, nil
+}
+
+// 列出存储器中指定状态的短信(AT+CMGL), 未读短信读取后变为已读.
+// stat SMS_REC_UNREAD等, SMS_ALL为全部.
+func (g *Gsm) ListSMS(stat int) ([]*StoredSMS, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.listSMS(stat)
+}
+
+func (g *Gsm) listSMS(stat int) ([]*StoredSMS, error) {
+	resp, err := g.mAT.Send(&atcmd.Command{
+		Cmd:     fmt.Sprintf("AT+CMGL=%d", stat),
+		Prefix:  "+CMGL:",
+		Timeout: time.Second * 20,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := []*StoredSMS{}
+	for i := 0; i+1 < len(resp.Lines); i++ {
+		l := resp.Lines[i]
+		if !strings.HasPrefix(l, "+CMGL:") {
+			continue
+		}
+		i++
+		s, err := parseStored(strings.TrimSpace(l[len("+CMGL:"):]), resp.Lines[i], -1)
+		if err != nil {
+			g.mLogger.Error(`GSMSMS: Decode stored sms error "%v"`, err)
+			continue
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// 读取存储器中index位置的短信(AT+CMGR).
+func (g *Gsm) ReadSMS(index int) (*StoredSMS, error) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	return g.readSMS(index)
+}
+
+func (g *Gsm) readSMS(index int) (*StoredSMS, error) {
+	resp, err := g.mAT.Send(&atcmd.Command{
+		Cmd:     fmt.Sprintf("AT+CMGR=%d", index),
+		Prefix:  "+CMGR:",
+		Timeout: time.Second * 5,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, l := range resp.Lines {
+		if strings.HasPrefix(l, "+CMGR:") && i+1 < len(resp.Lines) {
+			return parseStored(strings.TrimSpace(l[len("+CMGR:"):]), resp.Lines[i+1], index)
+		}
+	}
+	return nil, fmt.Errorf("No sms at %d", index)
+}
+
+// 删除存储器中index位置的短信(AT+CMGD).
+func (g *Gsm) DeleteSMS(index int) error {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	_, err := g.mAT.Command(fmt.Sprintf("AT+CMGD=%d", index), time.Second*5)
+	if err == nil {
+		g.forgetStored(index)
+	}
+	return err
+}
+
+// 设置存储模式, 修改后需要重新调用Init.
+// 存储模式下收到的短信先保存在存储器中并以+CMTI通知, 然后读出交给RecvSMS,
+// 被接收后才从存储器中删除, 程序重启时不会丢失短信.
+// Init不再删除存储器中的短信, 而是读出所有已收到的短信.
+func (g *Gsm) SetStoredMode(on bool) {
+	g.mPartsLock.Lock()
+	defer g.mPartsLock.Unlock()
+	g.mStoredMode = on
+}
+
+func (g *Gsm) storedMode() bool {
+	g.mPartsLock.Lock()
+	defer g.mPartsLock.Unlock()
+	return g.mStoredMode
+}
+
+// 请求读取存储的短信, index <0 时读取全部已收到的短信.
+func (g *Gsm) fetchStored(index int) {
+	select {
+	case g.mFetch <- index:
+	default:
+		g.mLogger.Warn("GSMSMS: Fetch queue full, sms %d is read on next Init", index)
+	}
+}
+
+// 读取存储短信的协程, 所有读取依次进行.
+func (g *Gsm) fetchLoop() {
+	for {
+		select {
+		case index := <-g.mFetch:
+			g.fetch(index)
+		case <-g.mAT.Done():
+			return
+		}
+	}
+}
+
+func (g *Gsm) fetch(index int) {
+	var list []*StoredSMS
+	var err error
+
+	g.mMutex.Lock()
+	if index < 0 {
+		list, err = g.listSMS(SMS_ALL)
+	} else {
+		var s *StoredSMS
+		if s, err = g.readSMS(index); err == nil {
+			list = append(list, s)
+		}
+	}
+	g.mMutex.Unlock()
+
+	if err != nil {
+		g.mLogger.Error(`GSMSMS: Read stored sms error "%v"`, err)
+		return
+	}
+
+	for _, s := range list {
+		if s.Stat != SMS_REC_UNREAD && s.Stat != SMS_REC_READ {
+			continue
+		}
+		// +CMTI和全部读取可能读到同一条短信
+		if !g.takeStored(s) {
+			continue
+		}
+		if d, err := decodeDeliver(s.PDU); err == nil && d.concat != nil {
+			g.addPart(s.Message, d, s.Index)
+			continue
+		}
+		if g.deliverSMSWait(s.Message) {
+			g.deleteStored([]int{s.Index})
+		} else {
+			g.releaseStored([]int{s.Index})
+		}
+	}
+}
+
+// 记录读出的存储短信, 已经送出或正在重组时返回false.
+// 删除失败的短信也不再送出.
+func (g *Gsm) takeStored(s *StoredSMS) bool {
+	g.mPartsLock.Lock()
+	defer g.mPartsLock.Unlock()
+	if pdu, ok := g.mTaken[s.Index]; ok && pdu == string(s.PDU) {
+		return false
+	}
+	g.mTaken[s.Index] = string(s.PDU)
+	return true
+}
+
+// 存储器中的短信已删除或没有送出, 下次读取时重新处理.
+func (g *Gsm) releaseStored(indexes []int) {
+	g.mPartsLock.Lock()
+	defer g.mPartsLock.Unlock()
+	for _, index := range indexes {
+		delete(g.mTaken, index)
+	}
+}
+
+// 删除已处理的存储短信.
+func (g *Gsm) deleteStored(indexes []int) {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	for _, index := range indexes {
+		if _, err := g.mAT.Command(fmt.Sprintf("AT+CMGD=%d", index), time.Second*5); err != nil {
+			g.mLogger.Warn(`GSMSMS: Delete sms %d error "%v"`, index, err)
+			continue
+		}
+		g.releaseStored([]int{index})
+	}
+}
@@ -0,0 +1,50 @@
+package gsm
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testDeliver  = "07917283010010F5040BC87238880900F10000993092516195800AE8329BFD4697D9EC37"
+	testDeliver2 = "07917283010010F5040BC87238880900F10000993092516195800AE8329BFD4697D9EC38"
+)
+
+// 全部读取送出的短信不会被随后的+CMTI再送出一次, 即使删除失败.
+func TestFetchStoredOnce(t *testing.T) {
+	var lock sync.Mutex
+	stored := testDeliver
+	g, modem := newTestGsm(t, func(cmd string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		switch cmd {
+		case "AT+CMGL=4":
+			return "\r\n+CMGL: 1,0,,28\r\n" + stored + "\r\n\r\nOK\r\n"
+		case "AT+CMGR=1":
+			return "\r\n+CMGR: 0,,28\r\n" + stored + "\r\n\r\nOK\r\n"
+		}
+		return "\r\nERROR\r\n"
+	})
+	g.SetStoredMode(true)
+	timeout := 300 * time.Millisecond
+
+	g.fetchStored(-1)
+	if _, err := g.RecvSMSWithTimeout(&timeout); err != nil {
+		t.Fatal(err)
+	}
+	modem.Write([]byte("\r\n+CMTI: \"SM\",1\r\n"))
+	g.fetchStored(-1)
+	if msg, err := g.RecvSMSWithTimeout(&timeout); err == nil {
+		t.Fatalf("sms delivered twice: %+v", msg)
+	}
+
+	// 同一位置上的另一条短信
+	lock.Lock()
+	stored = testDeliver2
+	lock.Unlock()
+	modem.Write([]byte("\r\n+CMTI: \"SM\",1\r\n"))
+	if _, err := g.RecvSMSWithTimeout(&timeout); err != nil {
+		t.Fatal(err)
+	}
+}
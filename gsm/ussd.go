@@ -0,0 +1,209 @@
+package gsm
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/xiqingping/golibs/gsm/atcmd"
+)
+
+// USSD会话状态(+CUSD的<m>)
+const (
+	USSD_DONE           = 0 // 不需要进一步操作
+	USSD_FURTHER_ACTION = 1 // 需要用ReplyUSSD回复
+	USSD_TERMINATED     = 2 // 网络终止
+	USSD_OTHER_CLIENT   = 3 // 其他本地客户端已响应
+	USSD_NOT_SUPPORTED  = 4
+	USSD_NET_TIMEOUT    = 5 // 网络超时
+)
+
+// 等待USSD响应的超时时间
+const USSD_TIMEOUT = time.Second * 30
+
+// USSD响应的DCS为15(7位字母表, 未指定语言)
+const USSD_DCS = 15
+
+var ErrUSSDTimeout = errors.New("USSD response timeout")
+
+// USSD响应(+CUSD:).
+type USSDResponse struct {
+	Status int    // USSD_DONE等
+	Text   string // 按DCS解码后的文本
+	DCS    int
+}
+
+// 会话是否需要继续回复.
+func (r *USSDResponse) FurtherAction() bool {
+	return r.Status == USSD_FURTHER_ACTION
+}
+
+// 判断字符串是否为十六进制.
+func isHex(s string) bool {
+	if s == "" || len(s)%2 != 0 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// 把UCS-2的十六进制字符串解码为文本.
+func decodeUCS2Hex(s string) (string, bool) {
+	if !isHex(s) || len(s)%4 != 0 {
+		return "", false
+	}
+	b, _ := hex.DecodeString(s)
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return string(utf16.Decode(u)), true
+}
+
+// 打包7位字母表, 剩余7位时用CR填充(3GPP TS 23.038 6.1.2.3.1).
+func packUSSD(s string) string {
+	septets := gsm7Encode(s)
+	if len(septets)%8 == 7 {
+		septets = append(septets, '\r')
+	}
+	return strings.ToUpper(hex.EncodeToString(packSeptets(septets, 0)))
+}
+
+// 解包7位字母表的十六进制字符串.
+func unpackUSSD(s string) (string, bool) {
+	if !isHex(s) {
+		return "", false
+	}
+	b, _ := hex.DecodeString(s)
+	septets := unpackSeptets(b, len(b)*8/7, 0)
+	if len(septets)%8 == 0 && len(septets) > 0 && septets[len(septets)-1] == '\r' {
+		septets = septets[:len(septets)-1]
+	}
+	return gsm7Decode(septets), true
+}
+
+// 按小区广播的DCS(3GPP TS 23.038 5)解码USSD文本.
+// packed 模块用打包的十六进制字符串表示7位字母表的文本.
+func decodeUSSD(s string, dcs int, packed bool) string {
+	alphabet := alphabetGSM7
+	language := false
+	switch {
+	case dcs == 0x11:
+		// UCS2, 前面是2个7位字符的语言
+		alphabet = alphabetUCS2
+		language = true
+	case dcs&0xC0 == 0x40, dcs&0xF0 == 0x90:
+		alphabet = dcsAlphabet(byte(dcs & 0x0F))
+	case dcs&0xF0 == 0xF0 && dcs&0x04 != 0:
+		alphabet = alphabet8Bit
+	}
+
+	switch alphabet {
+	case alphabetUCS2:
+		if language && isHex(s) && len(s) >= 4 {
+			s = s[4:]
+		}
+		if text, ok := decodeUCS2Hex(s); ok {
+			return text
+		}
+	case alphabetGSM7:
+		if packed {
+			if text, ok := unpackUSSD(s); ok {
+				return text
+			}
+		}
+	}
+	return s
+}
+
+// 解析+CUSD的参数<m>[,<str>,<dcs>].
+func (g *Gsm) parseUSSD(params []string) USSDResponse {
+	r := USSDResponse{Status: atcmd.IntParam(params, 0, USSD_TERMINATED)}
+	r.DCS = atcmd.IntParam(params, 2, USSD_DCS)
+	if len(params) > 1 {
+		r.Text = decodeUSSD(params[1], r.DCS, g.ussdPacked())
+	}
+	return r
+}
+
+func (g *Gsm) ussdPacked() bool {
+	g.mUSSDLock.Lock()
+	defer g.mUSSDLock.Unlock()
+	return g.mUSSDPacked
+}
+
+// 收到+CUSD, 交给等待响应的SendUSSD.
+func (g *Gsm) onUSSD(r USSDResponse) {
+	g.mUSSDLock.Lock()
+	defer g.mUSSDLock.Unlock()
+	if g.mUSSDWait != nil {
+		g.mUSSDWait <- &r
+		g.mUSSDWait = nil
+	}
+}
+
+// 发送USSD请求, 例如"*100#", 并等待网络响应.
+// 响应的Status为USSD_FURTHER_ACTION时可以用ReplyUSSD继续会话.
+func (g *Gsm) SendUSSD(code string) (*USSDResponse, error) {
+	return g.ussd(code)
+}
+
+// 在USSD会话中回复, 例如菜单选项"1".
+func (g *Gsm) ReplyUSSD(text string) (*USSDResponse, error) {
+	return g.ussd(text)
+}
+
+func (g *Gsm) ussd(text string) (*USSDResponse, error) {
+	g.mUSSDMutex.Lock()
+	defer g.mUSSDMutex.Unlock()
+
+	wait := make(chan *USSDResponse, 1)
+	g.mUSSDLock.Lock()
+	g.mUSSDWait = wait
+	packed := g.mUSSDPacked
+	g.mUSSDLock.Unlock()
+
+	if packed {
+		text = packUSSD(text)
+	}
+
+	g.mMutex.Lock()
+	_, err := g.mAT.Command(fmt.Sprintf(`AT+CUSD=1,"%s",%d`, text, USSD_DCS), time.Second*10)
+	g.mMutex.Unlock()
+
+	if err == nil {
+		select {
+		case r := <-wait:
+			return r, nil
+		case <-time.After(USSD_TIMEOUT):
+			err = ErrUSSDTimeout
+		case <-g.mAT.Done():
+			err = atcmd.ErrClosed
+		}
+	}
+
+	g.mUSSDLock.Lock()
+	if g.mUSSDWait == wait {
+		g.mUSSDWait = nil
+	}
+	g.mUSSDLock.Unlock()
+
+	// 先到的响应
+	select {
+	case r := <-wait:
+		return r, nil
+	default:
+	}
+	return nil, err
+}
+
+// 取消当前的USSD会话.
+func (g *Gsm) CancelUSSD() error {
+	g.mMutex.Lock()
+	defer g.mMutex.Unlock()
+	_, err := g.mAT.Command("AT+CUSD=2", time.Second*5)
+	return err
+}
@@ -0,0 +1,55 @@
+package gsm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/xiqingping/golibs/gsm/atcmd"
+)
+
+func TestPackUSSD(t *testing.T) {
+	for _, c := range []struct {
+		text, packed string
+	}{
+		{"*100#", "AA180C3602"},
+		{"hello", "E8329BFD06"},
+		// 7个字符时用CR填充最后一个字节
+		{"1234567", "31D98C56B3DD1A"},
+		{"12345678", "31D98C56B3DD70"},
+		{"", ""},
+	} {
+		if got := packUSSD(c.text); got != c.packed {
+			t.Errorf("packUSSD(%q) = %q, want %q", c.text, got, c.packed)
+		}
+		if got, ok := unpackUSSD(c.packed); c.packed != "" && (!ok || got != c.text) {
+			t.Errorf("unpackUSSD(%q) = %q, %v, want %q", c.packed, got, ok, c.text)
+		}
+	}
+}
+
+func TestParseUSSD(t *testing.T) {
+	for _, c := range []struct {
+		line   string
+		packed bool
+		want   USSDResponse
+	}{
+		{`+CUSD: 0,"Balance: 10.00",15`, false, USSDResponse{USSD_DONE, "Balance: 10.00", 15}},
+		// 华为模块用打包后的十六进制
+		{`+CUSD: 1,"E8329BFD06",15`, true, USSDResponse{USSD_FURTHER_ACTION, "hello", 15}},
+		{`+CUSD: 0,"Balance",15`, true, USSDResponse{USSD_DONE, "Balance", 15}},
+		{`+CUSD: 0,"4F60597D",72`, false, USSDResponse{USSD_DONE, "你好", 72}},
+		{`+CUSD: 0,"4F60597D",8`, false, USSDResponse{USSD_DONE, "4F60597D", 8}},
+		{`+CUSD: 0,"4F60597D",152`, false, USSDResponse{USSD_DONE, "你好", 152}},
+		// UCS2, 前面2字节是语言
+		{`+CUSD: 0,"656E4F60597D",17`, false, USSDResponse{USSD_DONE, "你好", 17}},
+		{`+CUSD: 0,"ABC",244`, true, USSDResponse{USSD_DONE, "ABC", 244}},
+		{`+CUSD: 2`, false, USSDResponse{USSD_TERMINATED, "", USSD_DCS}},
+		{`+CUSD: 4,"",15`, false, USSDResponse{USSD_NOT_SUPPORTED, "", 15}},
+	} {
+		g := &Gsm{mUSSDPacked: c.packed}
+		params := atcmd.SplitParams(strings.TrimSpace(strings.TrimPrefix(c.line, "+CUSD:")))
+		if got := g.parseUSSD(params); got != c.want {
+			t.Errorf("%q: %+v, want %+v", c.line, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,692 @@
+/*
+Package cmux implements the 3GPP TS 27.010 (GSM 07.10) multiplexer protocol
+on top of any io.ReadWriter, with basic and advanced option framing. Each
+DLCI is an io.ReadWriteCloser, so AT commands can run on one channel while
+PPP runs on another.
+
+A Mux plays either side of the link: the initiator (the host, after
+AT+CMUX) or the responder (the modem), which makes it possible to test a
+host against a simulated modem in the same process.
+*/
+package cmux
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Control channel message types, with the EA bit and without the C/R bit
+const (
+	MSG_PN    byte = 0x81
+	MSG_PSC   byte = 0x41
+	MSG_CLD   byte = 0xC1
+	MSG_TEST  byte = 0x21
+	MSG_FCON  byte = 0xA1
+	MSG_FCOFF byte = 0x61
+	MSG_MSC   byte = 0xE1
+	MSG_NSC   byte = 0x11
+	MSG_RPN   byte = 0x91
+	MSG_RLS   byte = 0x51
+	MSG_SNC   byte = 0xD1
+
+	msgCR byte = 0x02
+)
+
+// V.24 signal bits of the MSC message
+const (
+	V24_FC  byte = 0x02 // flow control, the sender can't accept frames
+	V24_RTC byte = 0x04 // ready to communicate (DTR/DSR)
+	V24_RTR byte = 0x08 // ready to receive (RTS/CTS)
+	V24_IC  byte = 0x40 // incoming call (RI)
+	V24_DV  byte = 0x80 // data valid (DCD)
+)
+
+// Highest DLCI usable for a channel.
+const MAX_DLCI = 63
+
+// Receive buffer of a channel. Flow control is asserted toward the peer
+// (MSC with FC) once CHANNEL_BUFFER_HIGH bytes wait to be read and released
+// at CHANNEL_BUFFER_LOW, data beyond CHANNEL_BUFFER_SIZE is dropped.
+const (
+	CHANNEL_BUFFER_SIZE = 64 * 1024
+	CHANNEL_BUFFER_HIGH = 32 * 1024
+	CHANNEL_BUFFER_LOW  = 8 * 1024
+)
+
+var (
+	ErrClosed  = errors.New("Multiplexer closed")
+	ErrTimeout = errors.New("Multiplexer response timeout")
+	ErrRefused = errors.New("Channel refused by peer")
+)
+
+// Config describes the multiplexer session, the zero value is an
+// initiator using basic option framing with the 27.010 default timers.
+type Config struct {
+	Initiator bool
+	Advanced  bool // advanced option framing
+
+	MaxFrameSize int           // N1, largest information field sent, default 127
+	T1           time.Duration // acknowledgement timer, default 300ms
+	N2           int           // retransmissions, default 3
+}
+
+type Mux struct {
+	rw  io.ReadWriter
+	cfg Config
+
+	wlock  sync.Mutex // serializes frame writes
+	fclock sync.Mutex // orders the flow control MSCs of the channels
+
+	lock     sync.Mutex
+	cond     *sync.Cond // broadcast on every state change
+	channels map[int]*Channel
+	acks     map[int]chan byte // SABM/DISC waiting for UA/DM per DLCI
+	replies  map[byte]chan []byte
+	fcOff    bool // peer sent FCoff
+	closed   bool
+	err      error
+	accept   chan *Channel
+	done     chan struct{}
+}
+
+// New starts a multiplexer session on rw, which must already be in
+// multiplexer mode (AT+CMUX answered OK). Call Start next.
+func New(rw io.ReadWriter, c *Config) *Mux {
+	m := &Mux{
+		rw:       rw,
+		channels: map[int]*Channel{},
+		acks:     map[int]chan byte{},
+		replies:  map[byte]chan []byte{},
+		accept:   make(chan *Channel, MAX_DLCI),
+		done:     make(chan struct{}),
+	}
+	if c != nil {
+		m.cfg = *c
+	}
+	if m.cfg.MaxFrameSize <= 0 {
+		m.cfg.MaxFrameSize = 127
+	}
+	if m.cfg.T1 <= 0 {
+		m.cfg.T1 = time.Millisecond * 300
+	}
+	if m.cfg.N2 <= 0 {
+		m.cfg.N2 = 3
+	}
+	m.cond = sync.NewCond(&m.lock)
+
+	go m.readThread()
+	return m
+}
+
+// Start opens the control channel (DLCI 0). The initiator sends SABM and
+// waits for UA, the responder has nothing to do.
+func (m *Mux) Start() error {
+	if !m.cfg.Initiator {
+		return nil
+	}
+	return m.connect(0)
+}
+
+// Open establishes a channel on dlci (1-63).
+func (m *Mux) Open(dlci int) (*Channel, error) {
+	if dlci < 1 || dlci > MAX_DLCI {
+		return nil, fmt.Errorf("Invalid DLCI %d", dlci)
+	}
+
+	m.lock.Lock()
+	if _, ok := m.channels[dlci]; ok {
+		m.lock.Unlock()
+		return nil, fmt.Errorf("DLCI %d already open", dlci)
+	}
+	m.lock.Unlock()
+
+	if err := m.connect(dlci); err != nil {
+		return nil, err
+	}
+
+	ch := m.newChannel(dlci)
+	// Many modems hold the channel until they get our V.24 signals
+	m.SendMSC(dlci, V24_RTC|V24_RTR|V24_DV)
+	return ch, nil
+}
+
+// Accept waits for a channel opened by the peer. The peer is refused while
+// MAX_DLCI channels wait to be accepted.
+func (m *Mux) Accept() (*Channel, error) {
+	select {
+	case ch := <-m.accept:
+		return ch, nil
+	case <-m.done:
+		return nil, m.closeError()
+	}
+}
+
+// Done is closed when the session is over.
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Close disconnects every channel and ends the session: the initiator
+// sends CLD, the responder DISC on the control channel. rw is not closed.
+func (m *Mux) Close() error {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return nil
+	}
+	channels := []*Channel{}
+	for _, ch := range m.channels {
+		channels = append(channels, ch)
+	}
+	m.lock.Unlock()
+
+	for _, ch := range channels {
+		ch.Close()
+	}
+
+	var err error
+	if m.cfg.Initiator {
+		_, err = m.request(MSG_CLD, nil)
+	} else {
+		err = m.disconnect(0)
+	}
+
+	m.shutdown(ErrClosed)
+	return err
+}
+
+func (m *Mux) closeError() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.err
+}
+
+// shutdown ends the session, waking everybody up.
+func (m *Mux) shutdown(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	m.err = err
+	for _, ch := range m.channels {
+		ch.closed = true
+	}
+	m.cond.Broadcast()
+	close(m.done)
+}
+
+func (m *Mux) writeFrame(f *frame) error {
+	var buf []byte
+	if m.cfg.Advanced {
+		buf = f.encodeAdvanced()
+	} else {
+		buf = f.encodeBasic()
+	}
+
+	m.wlock.Lock()
+	defer m.wlock.Unlock()
+	_, err := m.rw.Write(buf)
+	return err
+}
+
+// command sense of the C/R bit, responses use the opposite
+func (m *Mux) command() bool {
+	return m.cfg.Initiator
+}
+
+// connect sends SABM on dlci and waits for UA.
+func (m *Mux) connect(dlci int) error {
+	ack, err := m.exchange(dlci, CTRL_SABM)
+	if err != nil {
+		return err
+	}
+	if ack != CTRL_UA {
+		return ErrRefused
+	}
+	return nil
+}
+
+// disconnect sends DISC on dlci and waits for UA or DM.
+func (m *Mux) disconnect(dlci int) error {
+	_, err := m.exchange(dlci, CTRL_DISC)
+	return err
+}
+
+// exchange sends a SABM or DISC command, retrying N2 times every T1, and
+// returns the control field of the answer.
+func (m *Mux) exchange(dlci int, ctrl byte) (byte, error) {
+	ack := make(chan byte, 1)
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return 0, ErrClosed
+	}
+	m.acks[dlci] = ack
+	m.lock.Unlock()
+
+	defer func() {
+		m.lock.Lock()
+		delete(m.acks, dlci)
+		m.lock.Unlock()
+	}()
+
+	for i := 0; i <= m.cfg.N2; i++ {
+		if err := m.writeFrame(&frame{dlci: dlci, cr: m.command(), ctrl: ctrl, pf: true}); err != nil {
+			return 0, err
+		}
+
+		select {
+		case c := <-ack:
+			return c, nil
+		case <-time.After(m.cfg.T1):
+		case <-m.done:
+			return 0, ErrClosed
+		}
+	}
+	return 0, ErrTimeout
+}
+
+// writeMessage sends a control channel message.
+func (m *Mux) writeMessage(typ byte, command bool, value []byte) error {
+	if command {
+		typ |= msgCR
+	}
+	data := appendLength([]byte{typ}, len(value))
+	data = append(data, value...)
+	return m.writeFrame(&frame{dlci: 0, cr: m.command(), ctrl: CTRL_UIH, data: data})
+}
+
+// request sends a control channel command and waits for its response.
+func (m *Mux) request(typ byte, value []byte) ([]byte, error) {
+	reply := make(chan []byte, 1)
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return nil, ErrClosed
+	}
+	m.replies[typ] = reply
+	m.lock.Unlock()
+
+	defer func() {
+		m.lock.Lock()
+		delete(m.replies, typ)
+		m.lock.Unlock()
+	}()
+
+	for i := 0; i <= m.cfg.N2; i++ {
+		if err := m.writeMessage(typ, true, value); err != nil {
+			return nil, err
+		}
+
+		select {
+		case v := <-reply:
+			return v, nil
+		case <-time.After(m.cfg.T1):
+		case <-m.done:
+			return nil, ErrClosed
+		}
+	}
+	return nil, ErrTimeout
+}
+
+// SendMSC sends the V.24 signals of dlci to the peer and waits for the
+// acknowledgement. FC is kept set while the receive buffer of the channel
+// is full.
+func (m *Mux) SendMSC(dlci int, signals byte) error {
+	m.lock.Lock()
+	if ch := m.channels[dlci]; ch != nil {
+		ch.local = signals &^ V24_FC
+		if ch.fcSent {
+			signals |= V24_FC
+		}
+	}
+	m.lock.Unlock()
+
+	_, err := m.request(MSG_MSC, []byte{byte(dlci<<2) | 0x03, signals | 0x01})
+	return err
+}
+
+// flowControl tells the peer whether ch can take more data. The read
+// goroutine calls it too, so the MSC response is not waited for.
+func (m *Mux) flowControl(ch *Channel) {
+	m.fclock.Lock()
+	defer m.fclock.Unlock()
+
+	m.lock.Lock()
+	if ch.full == ch.fcSent || ch.closed {
+		m.lock.Unlock()
+		return
+	}
+	ch.fcSent = ch.full
+	signals := ch.local
+	if ch.full {
+		signals |= V24_FC
+	}
+	m.lock.Unlock()
+
+	m.writeMessage(MSG_MSC, true, []byte{byte(ch.dlci<<2) | 0x03, signals | 0x01})
+}
+
+// Test sends a test command and checks the peer echoes the pattern.
+func (m *Mux) Test(pattern []byte) error {
+	v, err := m.request(MSG_TEST, pattern)
+	if err != nil {
+		return err
+	}
+	if string(v) != string(pattern) {
+		return errors.New("Test pattern mismatch")
+	}
+	return nil
+}
+
+func (m *Mux) newChannel(dlci int) *Channel {
+	ch := &Channel{mux: m, dlci: dlci, local: V24_RTC | V24_RTR | V24_DV}
+	m.lock.Lock()
+	m.channels[dlci] = ch
+	m.lock.Unlock()
+	return ch
+}
+
+func (m *Mux) readThread() {
+	r := bufio.NewReader(m.rw)
+	for {
+		var f *frame
+		var err error
+		if m.cfg.Advanced {
+			f, err = readAdvanced(r)
+		} else {
+			f, err = readBasic(r)
+		}
+		if err != nil {
+			if t, ok := err.(interface{ Timeout() bool }); ok && t.Timeout() {
+				continue
+			}
+			m.shutdown(err)
+			return
+		}
+
+		select {
+		case <-m.done:
+			return
+		default:
+		}
+		m.handleFrame(f)
+	}
+}
+
+func (m *Mux) response(f *frame, ctrl byte) {
+	m.writeFrame(&frame{dlci: f.dlci, cr: !m.command(), ctrl: ctrl, pf: f.pf})
+}
+
+func (m *Mux) handleFrame(f *frame) {
+	switch f.ctrl {
+	case CTRL_SABM:
+		m.lock.Lock()
+		_, open := m.channels[f.dlci]
+		m.lock.Unlock()
+
+		if f.dlci == 0 || open || m.cfg.Initiator {
+			if f.dlci == 0 && !m.cfg.Initiator {
+				m.response(f, CTRL_UA)
+			} else if open {
+				m.response(f, CTRL_UA)
+			} else {
+				m.response(f, CTRL_DM)
+			}
+			return
+		}
+
+		// the read goroutine must not block, channels nobody accepts
+		// anymore are refused
+		ch := m.newChannel(f.dlci)
+		select {
+		case m.accept <- ch:
+			m.response(f, CTRL_UA)
+		default:
+			m.lock.Lock()
+			delete(m.channels, f.dlci)
+			m.lock.Unlock()
+			m.response(f, CTRL_DM)
+		}
+
+	case CTRL_UA, CTRL_DM:
+		m.lock.Lock()
+		ack := m.acks[f.dlci]
+		m.lock.Unlock()
+		if ack != nil {
+			select {
+			case ack <- f.ctrl:
+			default:
+			}
+		}
+
+	case CTRL_DISC:
+		if f.dlci == 0 {
+			m.response(f, CTRL_UA)
+			m.shutdown(io.EOF)
+			return
+		}
+
+		m.lock.Lock()
+		ch := m.channels[f.dlci]
+		if ch != nil {
+			ch.closed = true
+			delete(m.channels, f.dlci)
+			m.cond.Broadcast()
+		}
+		m.lock.Unlock()
+
+		if ch != nil {
+			m.response(f, CTRL_UA)
+		} else {
+			m.response(f, CTRL_DM)
+		}
+
+	case CTRL_UIH, CTRL_UI:
+		if f.dlci == 0 {
+			m.handleMessages(f.data)
+			return
+		}
+
+		m.lock.Lock()
+		ch := m.channels[f.dlci]
+		full := false
+		if ch != nil && !ch.closed {
+			data := f.data
+			if room := CHANNEL_BUFFER_SIZE - len(ch.buf); len(data) > room {
+				data = data[:room]
+			}
+			ch.buf = append(ch.buf, data...)
+			if !ch.full && len(ch.buf) >= CHANNEL_BUFFER_HIGH {
+				ch.full = true
+				full = true
+			}
+			m.cond.Broadcast()
+		}
+		m.lock.Unlock()
+
+		if full {
+			m.flowControl(ch)
+		}
+	}
+}
+
+// handleMessages parses the control channel messages of an UIH frame.
+func (m *Mux) handleMessages(data []byte) {
+	for len(data) >= 2 {
+		typ := data[0]
+		n := int(data[1] >> 1)
+		hl := 2
+		if data[1]&0x01 == 0 {
+			if len(data) < 3 {
+				return
+			}
+			n |= int(data[2]) << 7
+			hl = 3
+		}
+		if len(data) < hl+n {
+			return
+		}
+		value := data[hl : hl+n]
+		data = data[hl+n:]
+
+		if typ&msgCR == 0 {
+			m.handleResponse(typ, value)
+		} else {
+			m.handleCommand(typ&^msgCR, value)
+		}
+	}
+}
+
+func (m *Mux) handleResponse(typ byte, value []byte) {
+	m.lock.Lock()
+	reply := m.replies[typ]
+	m.lock.Unlock()
+	if reply != nil {
+		select {
+		case reply <- append([]byte(nil), value...):
+		default:
+		}
+	}
+}
+
+func (m *Mux) handleCommand(typ byte, value []byte) {
+	switch typ {
+	case MSG_CLD:
+		m.writeMessage(typ, false, nil)
+		m.shutdown(io.EOF)
+		return
+
+	case MSG_FCON, MSG_FCOFF:
+		m.lock.Lock()
+		m.fcOff = typ == MSG_FCOFF
+		m.cond.Broadcast()
+		m.lock.Unlock()
+
+	case MSG_MSC:
+		if len(value) < 2 {
+			break
+		}
+		dlci := int(value[0] >> 2)
+		m.lock.Lock()
+		if ch := m.channels[dlci]; ch != nil {
+			ch.signals = value[1]
+			m.cond.Broadcast()
+		}
+		m.lock.Unlock()
+
+	case MSG_TEST, MSG_PN, MSG_PSC, MSG_RPN, MSG_RLS, MSG_SNC:
+		// accept what the peer proposes by echoing it
+
+	default:
+		m.writeMessage(MSG_NSC, false, []byte{typ | msgCR})
+		return
+	}
+
+	m.writeMessage(typ, false, value)
+}
+
+// Channel is one DLCI of a Mux.
+type Channel struct {
+	mux     *Mux
+	dlci    int
+	buf     []byte
+	closed  bool
+	signals byte // last V.24 signals from the peer
+	local   byte // V.24 signals sent to the peer, without FC
+	full    bool // buf reached CHANNEL_BUFFER_HIGH
+	fcSent  bool // FC asserted toward the peer
+}
+
+func (ch *Channel) DLCI() int {
+	return ch.dlci
+}
+
+// Signals returns the last V.24 signals (V24_*) received for the channel.
+func (ch *Channel) Signals() byte {
+	m := ch.mux
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return ch.signals
+}
+
+// Read returns io.EOF once the channel is closed and drained.
+func (ch *Channel) Read(b []byte) (int, error) {
+	m := ch.mux
+	m.lock.Lock()
+	for len(ch.buf) == 0 && !ch.closed {
+		m.cond.Wait()
+	}
+	if len(ch.buf) == 0 {
+		m.lock.Unlock()
+		return 0, io.EOF
+	}
+
+	n := copy(b, ch.buf)
+	ch.buf = ch.buf[n:]
+	if len(ch.buf) == 0 {
+		ch.buf = nil
+	}
+	release := ch.full && len(ch.buf) <= CHANNEL_BUFFER_LOW
+	if release {
+		ch.full = false
+	}
+	m.lock.Unlock()
+
+	if release {
+		m.flowControl(ch)
+	}
+	return n, nil
+}
+
+// Write sends b in UIH frames of at most MaxFrameSize bytes, blocking while
+// the peer has flow control asserted.
+func (ch *Channel) Write(b []byte) (int, error) {
+	m := ch.mux
+	written := 0
+	for len(b) > 0 {
+		m.lock.Lock()
+		for !ch.closed && (m.fcOff || ch.signals&V24_FC != 0) {
+			m.cond.Wait()
+		}
+		closed := ch.closed
+		m.lock.Unlock()
+		if closed {
+			return written, ErrClosed
+		}
+
+		n := len(b)
+		if n > m.cfg.MaxFrameSize {
+			n = m.cfg.MaxFrameSize
+		}
+		f := &frame{dlci: ch.dlci, cr: m.command(), ctrl: CTRL_UIH, data: b[:n]}
+		if err := m.writeFrame(f); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close sends DISC for the channel. Closing twice is harmless.
+func (ch *Channel) Close() error {
+	m := ch.mux
+	m.lock.Lock()
+	if ch.closed {
+		m.lock.Unlock()
+		return nil
+	}
+	ch.closed = true
+	delete(m.channels, ch.dlci)
+	m.cond.Broadcast()
+	m.lock.Unlock()
+
+	return m.disconnect(ch.dlci)
+}
@@ -0,0 +1,331 @@
+package cmux
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestPair(t *testing.T) (*Mux, *Mux) {
+	a, b := net.Pipe()
+	host := New(a, &Config{Initiator: true, T1: 50 * time.Millisecond})
+	modem := New(b, &Config{T1: 50 * time.Millisecond})
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	if err := host.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return host, modem
+}
+
+func TestOpenAccept(t *testing.T) {
+	host, modem := newTestPair(t)
+
+	ch, err := host.Open(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := modem.Accept()
+	if err != nil || peer.DLCI() != 1 {
+		t.Fatalf("Accept = %v, %v", peer, err)
+	}
+
+	go ch.Write([]byte("AT\r"))
+	buf := make([]byte, 16)
+	n, err := peer.Read(buf)
+	if err != nil || string(buf[:n]) != "AT\r" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+
+	if err := host.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-modem.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("responder still running after CLD")
+	}
+}
+
+// Channels nobody accepts must not block the read goroutine of the
+// responder, it refuses them once the accept queue is full.
+func TestAcceptQueueFull(t *testing.T) {
+	host, _ := newTestPair(t)
+
+	for i := 0; i < MAX_DLCI; i++ {
+		ch, err := host.Open(1)
+		if err != nil {
+			t.Fatalf("Open %d: %v", i, err)
+		}
+		if err := ch.Close(); err != nil {
+			t.Fatalf("Close %d: %v", i, err)
+		}
+	}
+
+	if _, err := host.Open(1); err != ErrRefused {
+		t.Fatalf("Open error %v, want %v", err, ErrRefused)
+	}
+	if err := host.Test([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFrame(advanced bool, b []byte) (*frame, error) {
+	r := bufio.NewReader(bytes.NewReader(b))
+	if advanced {
+		return readAdvanced(r)
+	}
+	return readBasic(r)
+}
+
+func encodeFrame(advanced bool, f *frame) []byte {
+	if advanced {
+		return f.encodeAdvanced()
+	}
+	return f.encodeBasic()
+}
+
+func TestAdvancedEscaping(t *testing.T) {
+	f := &frame{dlci: 31, cr: true, ctrl: CTRL_UIH, data: []byte{0x7E, 0x7D, 0x11, 0x13, 0x20, 0x5E}}
+	b := f.encodeAdvanced()
+	// the address of DLCI 31 is 0x7F, only the flags may be 0x7E
+	want := []byte{0x7E, 0x7F, 0xEF, 0x7D, 0x5E, 0x7D, 0x5D, 0x7D, 0x31, 0x7D, 0x33, 0x20, 0x5E}
+	if !bytes.Equal(b[:len(want)], want) || b[len(b)-1] != FLAG_ADVANCED {
+		t.Fatalf("encoded % X", b)
+	}
+	for _, c := range b[1 : len(b)-1] {
+		if c == 0x7E || c == 0x11 || c == 0x13 {
+			t.Fatalf("unescaped %02X in % X", c, b)
+		}
+	}
+
+	g, err := readFrame(true, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.dlci != f.dlci || !g.cr || g.ctrl != f.ctrl || !bytes.Equal(g.data, f.data) {
+		t.Fatalf("decoded %+v", g)
+	}
+}
+
+// Damaged frames are skipped up to the next good one. The FCS of UIH
+// frames covers the header only, the one of UI frames the data too.
+func TestFCSRejection(t *testing.T) {
+	for _, advanced := range []bool{false, true} {
+		good := &frame{dlci: 2, ctrl: CTRL_UIH, data: []byte("ok")}
+		fcs := func(b []byte) { b[len(b)-2] ^= 0x04 }
+		addr := func(b []byte) { b[1] ^= 0x04 }
+		data := func(b []byte) { b[bytes.LastIndexByte(b, 'T')] = 'X' }
+		for _, c := range []struct {
+			name    string
+			f       *frame
+			corrupt func(b []byte)
+			pass    bool
+		}{
+			{"UIH fcs", &frame{dlci: 1, ctrl: CTRL_UIH, data: []byte("AT")}, fcs, false},
+			{"SABM address", &frame{dlci: 1, ctrl: CTRL_SABM, pf: true}, addr, false},
+			{"UIH data", &frame{dlci: 1, ctrl: CTRL_UIH, data: []byte("AT")}, data, true},
+			{"UI fcs", &frame{dlci: 1, ctrl: CTRL_UI, data: []byte("AT")}, fcs, false},
+			{"UI data", &frame{dlci: 1, ctrl: CTRL_UI, data: []byte("AT")}, data, false},
+			{"UI", &frame{dlci: 1, ctrl: CTRL_UI, data: []byte("AT")}, nil, true},
+		} {
+			b := encodeFrame(advanced, c.f)
+			if c.corrupt != nil {
+				c.corrupt(b)
+			}
+			b = append(b, encodeFrame(advanced, good)...)
+
+			f, err := readFrame(advanced, b)
+			if err != nil {
+				t.Fatalf("advanced %v, %s: %v", advanced, c.name, err)
+			}
+			want := good.dlci
+			if c.pass {
+				want = c.f.dlci
+			}
+			if f.dlci != want {
+				t.Errorf("advanced %v, %s: frame on DLCI %d read, want %d", advanced, c.name, f.dlci, want)
+			}
+		}
+	}
+}
+
+func TestAdvancedPair(t *testing.T) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	host := New(a, &Config{Initiator: true, Advanced: true})
+	modem := New(b, &Config{Advanced: true})
+	if err := host.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := host.Open(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := modem.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte{0x7E, 0x7D, 0x11, 0x13, 0xF9}
+	go ch.Write(data)
+	buf := make([]byte, 16)
+	n, err := io.ReadAtLeast(peer, buf, len(data))
+	if err != nil || !bytes.Equal(buf[:n], data) {
+		t.Fatalf("Read = % X, %v", buf[:n], err)
+	}
+}
+
+// The initiator refuses channels opened by the responder with DM.
+func TestRefused(t *testing.T) {
+	_, modem := newTestPair(t)
+	if _, err := modem.Open(2); err != ErrRefused {
+		t.Fatalf("Open error %v, want %v", err, ErrRefused)
+	}
+}
+
+// Unanswered SABMs are repeated N2 times, T1 apart.
+func TestRetries(t *testing.T) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	frames := make(chan time.Time, 16)
+	go func() {
+		r := bufio.NewReader(b)
+		for {
+			f, err := readBasic(r)
+			if err != nil {
+				return
+			}
+			if f.ctrl == CTRL_SABM && f.dlci == 0 {
+				frames <- time.Now()
+			}
+		}
+	}()
+
+	m := New(a, &Config{Initiator: true, T1: 30 * time.Millisecond, N2: 2})
+	if err := m.Start(); err != ErrTimeout {
+		t.Fatalf("Start error %v, want %v", err, ErrTimeout)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("%d SABM sent, want 3", len(frames))
+	}
+	first, last := <-frames, time.Time{}
+	for len(frames) > 0 {
+		last = <-frames
+	}
+	if d := last.Sub(first); d < 50*time.Millisecond {
+		t.Fatalf("retries %v apart", d)
+	}
+}
+
+// writeBlocked reports whether a Write of b on ch is still blocked after a
+// while, and returns the channel the Write ends on.
+func writeBlocked(ch *Channel, b []byte) (bool, chan error) {
+	done := make(chan error, 1)
+	go func() {
+		_, err := ch.Write(b)
+		done <- err
+	}()
+	select {
+	case <-done:
+		return false, done
+	case <-time.After(100 * time.Millisecond):
+		return true, done
+	}
+}
+
+func TestPeerFlowControl(t *testing.T) {
+	host, modem := newTestPair(t)
+	ch, err := host.Open(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := modem.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+
+	for _, c := range []struct {
+		name        string
+		assert, off func() error
+	}{
+		{"FCoff",
+			func() error { _, err := modem.request(MSG_FCOFF, nil); return err },
+			func() error { _, err := modem.request(MSG_FCON, nil); return err }},
+		{"MSC",
+			func() error { return modem.SendMSC(1, V24_RTC|V24_FC) },
+			func() error { return modem.SendMSC(1, V24_RTC) }},
+	} {
+		if err := c.assert(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		blocked, done := writeBlocked(ch, []byte("AT\r"))
+		if !blocked {
+			t.Fatalf("%s: Write not held", c.name)
+		}
+		if err := c.off(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("%s: Write: %v", c.name, err)
+		}
+		if n, err := peer.Read(buf); err != nil || string(buf[:n]) != "AT\r" {
+			t.Fatalf("%s: Read = %q, %v", c.name, buf[:n], err)
+		}
+	}
+}
+
+// A channel nobody reads asserts flow control toward the peer instead of
+// buffering without limit, and releases it once drained.
+func TestChannelBufferFlowControl(t *testing.T) {
+	host, modem := newTestPair(t)
+	ch, err := host.Open(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := modem.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 2*CHANNEL_BUFFER_SIZE/16)
+	blocked, done := writeBlocked(ch, data)
+	if !blocked {
+		t.Fatal("Write not held by the full channel")
+	}
+	if ch.Signals()&V24_FC == 0 {
+		t.Fatal("FC not asserted")
+	}
+	modem.lock.Lock()
+	n := len(peer.buf)
+	modem.lock.Unlock()
+	if n < CHANNEL_BUFFER_HIGH || n > CHANNEL_BUFFER_SIZE {
+		t.Fatalf("%d bytes buffered", n)
+	}
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(peer, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data mismatch")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if ch.Signals() != V24_RTC|V24_RTR|V24_DV|0x01 {
+		t.Fatalf("signals %02X after drain", ch.Signals())
+	}
+}
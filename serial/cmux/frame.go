@@ -0,0 +1,267 @@
+package cmux
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// Frame delimiters
+const (
+	FLAG_BASIC    byte = 0xF9
+	FLAG_ADVANCED byte = 0x7E
+	ESC_ADVANCED  byte = 0x7D
+)
+
+// Control field values, without the P/F bit
+const (
+	CTRL_SABM byte = 0x2F
+	CTRL_UA   byte = 0x63
+	CTRL_DM   byte = 0x0F
+	CTRL_DISC byte = 0x43
+	CTRL_UIH  byte = 0xEF
+	CTRL_UI   byte = 0x03
+	CTRL_PF   byte = 0x10
+)
+
+// Longest information field accepted from the peer.
+const MAX_INFO_LENGTH = 32768
+
+var errBadFrame = errors.New("Bad frame")
+
+type frame struct {
+	dlci int
+	cr   bool
+	ctrl byte // without P/F
+	pf   bool
+	data []byte
+}
+
+// fcsTable is the reversed CRC-8 (x^8 + x^2 + x + 1) of 27.010 annex B.
+var fcsTable = func() (t [256]byte) {
+	for i := 0; i < 256; i++ {
+		crc := byte(i)
+		for j := 0; j < 8; j++ {
+			if crc&0x01 != 0 {
+				crc = (crc >> 1) ^ 0xE0
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return
+}()
+
+func fcs(b []byte) byte {
+	crc := byte(0xFF)
+	for _, c := range b {
+		crc = fcsTable[crc^c]
+	}
+	return 0xFF - crc
+}
+
+// fcsCheck runs the receiver check over the covered octets and the received
+// FCS.
+func fcsCheck(b []byte, received byte) bool {
+	crc := byte(0xFF)
+	for _, c := range b {
+		crc = fcsTable[crc^c]
+	}
+	return fcsTable[crc^received] == 0xCF
+}
+
+// covered returns the octets the FCS is computed over: the header, and for
+// UI frames the information field too.
+func covered(hdr []byte, ctrl byte, data []byte) []byte {
+	if ctrl&^CTRL_PF != CTRL_UI {
+		return hdr
+	}
+	return append(append([]byte(nil), hdr...), data...)
+}
+
+func (f *frame) header() []byte {
+	addr := byte(f.dlci<<2) | 0x01
+	if f.cr {
+		addr |= 0x02
+	}
+	ctrl := f.ctrl
+	if f.pf {
+		ctrl |= CTRL_PF
+	}
+	return []byte{addr, ctrl}
+}
+
+// appendLength appends an EA encoded length of one or two octets.
+func appendLength(b []byte, n int) []byte {
+	if n <= 0x7F {
+		return append(b, byte(n<<1)|0x01)
+	}
+	return append(b, byte(n<<1), byte(n>>7))
+}
+
+func (f *frame) encodeBasic() []byte {
+	hdr := appendLength(f.header(), len(f.data))
+	buf := make([]byte, 0, len(hdr)+len(f.data)+3)
+	buf = append(buf, FLAG_BASIC)
+	buf = append(buf, hdr...)
+	buf = append(buf, f.data...)
+	buf = append(buf, fcs(covered(hdr, f.ctrl, f.data)), FLAG_BASIC)
+	return buf
+}
+
+func appendEscaped(buf []byte, b byte) []byte {
+	if b == FLAG_ADVANCED || b == ESC_ADVANCED || b == 0x11 || b == 0x13 {
+		return append(buf, ESC_ADVANCED, b^0x20)
+	}
+	return append(buf, b)
+}
+
+func (f *frame) encodeAdvanced() []byte {
+	hdr := f.header()
+	buf := make([]byte, 0, 2*(len(f.data)+3)+2)
+	buf = append(buf, FLAG_ADVANCED)
+	for _, b := range hdr {
+		buf = appendEscaped(buf, b)
+	}
+	for _, b := range f.data {
+		buf = appendEscaped(buf, b)
+	}
+	buf = appendEscaped(buf, fcs(covered(hdr, f.ctrl, f.data)))
+	return append(buf, FLAG_ADVANCED)
+}
+
+func parseHeader(addr, ctrl byte) *frame {
+	return &frame{
+		dlci: int(addr >> 2),
+		cr:   addr&0x02 != 0,
+		ctrl: ctrl &^ CTRL_PF,
+		pf:   ctrl&CTRL_PF != 0,
+	}
+}
+
+// readBasic reads the next valid basic option frame. Damaged frames are
+// skipped, only errors of r are returned.
+func readBasic(r *bufio.Reader) (*frame, error) {
+	for {
+		f, err := readBasicOnce(r)
+		if err != errBadFrame {
+			return f, err
+		}
+	}
+}
+
+func readBasicOnce(r *bufio.Reader) (*frame, error) {
+	// opening flag, repeated flags are fill
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if b != FLAG_BASIC {
+		return nil, errBadFrame
+	}
+	for {
+		if b, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+		if b != FLAG_BASIC {
+			break
+		}
+	}
+
+	hdr := []byte{b}
+	for i := 0; i < 2; i++ {
+		if b, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+		hdr = append(hdr, b)
+	}
+	n := int(hdr[2] >> 1)
+	if hdr[2]&0x01 == 0 {
+		if b, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+		hdr = append(hdr, b)
+		n |= int(b) << 7
+	}
+	if hdr[0]&0x01 == 0 || n > MAX_INFO_LENGTH {
+		return nil, errBadFrame
+	}
+
+	data := make([]byte, n+2)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if data[n+1] != FLAG_BASIC {
+		return nil, errBadFrame
+	}
+	// the closing flag may open the next frame
+	r.UnreadByte()
+
+	if !fcsCheck(covered(hdr, hdr[1], data[:n]), data[n]) {
+		return nil, errBadFrame
+	}
+
+	f := parseHeader(hdr[0], hdr[1])
+	f.data = data[:n]
+	return f, nil
+}
+
+// readAdvanced reads the next valid advanced option frame.
+func readAdvanced(r *bufio.Reader) (*frame, error) {
+	for {
+		f, err := readAdvancedOnce(r)
+		if err != errBadFrame {
+			return f, err
+		}
+	}
+}
+
+func readAdvancedOnce(r *bufio.Reader) (*frame, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if b != FLAG_ADVANCED {
+		return nil, errBadFrame
+	}
+
+	body := []byte{}
+	escaped := false
+	for {
+		if b, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+		if b == FLAG_ADVANCED {
+			if len(body) == 0 {
+				// fill or shared flag
+				continue
+			}
+			r.UnreadByte()
+			break
+		}
+		if len(body) > MAX_INFO_LENGTH {
+			return nil, errBadFrame
+		}
+		if b == ESC_ADVANCED {
+			escaped = true
+			continue
+		}
+		if escaped {
+			b ^= 0x20
+			escaped = false
+		}
+		body = append(body, b)
+	}
+
+	if len(body) < 3 || body[0]&0x01 == 0 {
+		return nil, errBadFrame
+	}
+	if !fcsCheck(covered(body[:2], body[1], body[2:len(body)-1]), body[len(body)-1]) {
+		return nil, errBadFrame
+	}
+
+	f := parseHeader(body[0], body[1])
+	f.data = body[2 : len(body)-1]
+	return f, nil
+}
@@ -0,0 +1,64 @@
+package serial
+
+import (
+	"errors"
+)
+
+// PortInfo describes a serial port found by ListPorts.
+type PortInfo struct {
+	Device string // device node, e.g. /dev/ttyUSB0
+	Name   string // kernel name, e.g. ttyUSB0
+	Driver string // e.g. ftdi_sio, cdc_acm, option
+
+	// USB metadata, only filled in when USB is true
+	USB          bool
+	VID          uint16
+	PID          uint16
+	Manufacturer string
+	Product      string
+	SerialNumber string
+	Interface    int // USB interface number, -1 if unknown
+}
+
+// PortFilter reports whether a port is the one looked for.
+type PortFilter func(info *PortInfo) bool
+
+var ErrPortNotFound = errors.New("No matching serial port")
+
+// USBFilter matches USB ports by identity. Zero vid or pid, empty
+// serialNumber and negative iface match anything.
+func USBFilter(vid, pid uint16, serialNumber string, iface int) PortFilter {
+	return func(info *PortInfo) bool {
+		if !info.USB {
+			return false
+		}
+		if vid != 0 && info.VID != vid {
+			return false
+		}
+		if pid != 0 && info.PID != pid {
+			return false
+		}
+		if serialNumber != "" && info.SerialNumber != serialNumber {
+			return false
+		}
+		if iface >= 0 && info.Interface != iface {
+			return false
+		}
+		return true
+	}
+}
+
+// FindPort returns the first port listed by ListPorts that filter accepts.
+func FindPort(filter PortFilter) (*PortInfo, error) {
+	ports, err := ListPorts()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ports {
+		if filter(&ports[i]) {
+			return &ports[i], nil
+		}
+	}
+	return nil, ErrPortNotFound
+}
@@ -0,0 +1,97 @@
+package serial
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Root of the sysfs tree read by ListPorts.
+var SysfsRoot = "/sys"
+
+// Directory holding the device nodes reported by ListPorts.
+var DevRoot = "/dev"
+
+// ListPorts walks /sys/class/tty and returns every tty backed by a device,
+// sorted by name. Legacy 8250 ports without hardware behind them are left out.
+func ListPorts() ([]PortInfo, error) {
+	dir := filepath.Join(SysfsRoot, "class", "tty")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ports := []PortInfo{}
+	for _, e := range entries {
+		name := e.Name()
+		dev, err := filepath.EvalSymlinks(filepath.Join(dir, name, "device"))
+		if err != nil {
+			// virtual terminal, pty, console...
+			continue
+		}
+
+		info := PortInfo{
+			Device:    filepath.Join(DevRoot, name),
+			Name:      name,
+			Interface: -1,
+		}
+
+		if drv, err := filepath.EvalSymlinks(filepath.Join(dev, "driver")); err == nil {
+			info.Driver = filepath.Base(drv)
+		}
+
+		if info.Driver == "serial8250" && sysfsAttr(filepath.Join(dir, name), "type") == "0" {
+			continue
+		}
+
+		fillUSBInfo(&info, dev)
+		ports = append(ports, info)
+	}
+
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Name < ports[j].Name })
+	return ports, nil
+}
+
+// fillUSBInfo walks up from the tty device to the USB interface and the USB
+// device above it.
+func fillUSBInfo(info *PortInfo, dev string) {
+	root := filepath.Clean(SysfsRoot)
+	for p := dev; strings.HasPrefix(p, root+string(os.PathSeparator)); p = filepath.Dir(p) {
+		if info.Interface < 0 {
+			if s := sysfsAttr(p, "bInterfaceNumber"); s != "" {
+				if n, err := strconv.ParseUint(s, 16, 8); err == nil {
+					info.Interface = int(n)
+				}
+			}
+		}
+
+		vid := sysfsAttr(p, "idVendor")
+		if vid == "" {
+			continue
+		}
+
+		info.USB = true
+		if n, err := strconv.ParseUint(vid, 16, 16); err == nil {
+			info.VID = uint16(n)
+		}
+		if n, err := strconv.ParseUint(sysfsAttr(p, "idProduct"), 16, 16); err == nil {
+			info.PID = uint16(n)
+		}
+		info.Manufacturer = sysfsAttr(p, "manufacturer")
+		info.Product = sysfsAttr(p, "product")
+		info.SerialNumber = sysfsAttr(p, "serial")
+		return
+	}
+}
+
+// sysfsAttr returns the trimmed content of an attribute file, "" if missing.
+func sysfsAttr(dir, name string) string {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
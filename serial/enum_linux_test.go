@@ -0,0 +1,148 @@
+package serial
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeSysfs builds a sysfs tree with a FTDI adapter, the second interface
+// of a USB modem, a real and a phantom 8250 port and a virtual terminal,
+// and points SysfsRoot at it until the test ends.
+func fakeSysfs(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mkdir := func(dir string) string {
+		dir = filepath.Join(root, dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	attr := func(dir, name, value string) {
+		if err := ioutil.WriteFile(filepath.Join(mkdir(dir), name), []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := func(target, name string) {
+		mkdir(filepath.Dir(name))
+		if err := os.Symlink(filepath.Join(root, target), filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ftdi := "devices/pci0000:00/0000:00:14.0/usb1/1-2"
+	attr(ftdi, "idVendor", "0403")
+	attr(ftdi, "idProduct", "6001")
+	attr(ftdi, "manufacturer", "FTDI")
+	attr(ftdi, "product", "FT232R USB UART")
+	attr(ftdi, "serial", "A50285BI")
+	attr(ftdi+"/1-2:1.0", "bInterfaceNumber", "00")
+	mkdir(ftdi + "/1-2:1.0/ttyUSB0")
+	mkdir("bus/usb-serial/drivers/ftdi_sio")
+	link("bus/usb-serial/drivers/ftdi_sio", ftdi+"/1-2:1.0/ttyUSB0/driver")
+	link(ftdi+"/1-2:1.0/ttyUSB0", "class/tty/ttyUSB0/device")
+
+	modem := "devices/pci0000:00/0000:00:14.0/usb1/1-3"
+	attr(modem, "idVendor", "2c7c")
+	attr(modem, "idProduct", "0125")
+	attr(modem, "product", "EC25")
+	attr(modem+"/1-3:1.2", "bInterfaceNumber", "02")
+	mkdir("bus/usb/drivers/option")
+	link("bus/usb/drivers/option", modem+"/1-3:1.2/driver")
+	link(modem+"/1-3:1.2", "class/tty/ttyUSB2/device")
+
+	mkdir("devices/platform/serial8250")
+	mkdir("bus/platform/drivers/serial8250")
+	link("bus/platform/drivers/serial8250", "devices/platform/serial8250/driver")
+	link("devices/platform/serial8250", "class/tty/ttyS0/device")
+	attr("class/tty/ttyS0", "type", "4")
+	link("devices/platform/serial8250", "class/tty/ttyS1/device")
+	attr("class/tty/ttyS1", "type", "0")
+
+	mkdir("class/tty/tty0")
+
+	saved := SysfsRoot
+	SysfsRoot = root
+	t.Cleanup(func() { SysfsRoot = saved })
+}
+
+func TestListPorts(t *testing.T) {
+	fakeSysfs(t)
+
+	ports, err := ListPorts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []PortInfo{
+		{Device: "/dev/ttyS0", Name: "ttyS0", Driver: "serial8250", Interface: -1},
+		{
+			Device:       "/dev/ttyUSB0",
+			Name:         "ttyUSB0",
+			Driver:       "ftdi_sio",
+			USB:          true,
+			VID:          0x0403,
+			PID:          0x6001,
+			Manufacturer: "FTDI",
+			Product:      "FT232R USB UART",
+			SerialNumber: "A50285BI",
+			Interface:    0,
+		},
+		{
+			Device:    "/dev/ttyUSB2",
+			Name:      "ttyUSB2",
+			Driver:    "option",
+			USB:       true,
+			VID:       0x2c7c,
+			PID:       0x0125,
+			Product:   "EC25",
+			Interface: 2,
+		},
+	}
+	if !reflect.DeepEqual(ports, want) {
+		t.Fatalf("ListPorts =\n%+v\nwant\n%+v", ports, want)
+	}
+}
+
+func TestFindPort(t *testing.T) {
+	fakeSysfs(t)
+
+	tests := []struct {
+		filter PortFilter
+		want   string
+	}{
+		{USBFilter(0x0403, 0x6001, "", -1), "ttyUSB0"},
+		{USBFilter(0, 0, "A50285BI", -1), "ttyUSB0"},
+		{USBFilter(0x2c7c, 0, "", 2), "ttyUSB2"},
+		{USBFilter(0x2c7c, 0, "", 3), ""},
+		{USBFilter(0x1234, 0, "", -1), ""},
+	}
+	for i, tt := range tests {
+		info, err := FindPort(tt.filter)
+		if tt.want == "" {
+			if err != ErrPortNotFound {
+				t.Errorf("%d: FindPort = %+v, %v, want %v", i, info, err, ErrPortNotFound)
+			}
+			continue
+		}
+		if err != nil || info.Name != tt.want {
+			t.Errorf("%d: FindPort = %+v, %v, want %s", i, info, err, tt.want)
+		}
+	}
+}
+
+func TestListPortsNoSysfs(t *testing.T) {
+	saved := SysfsRoot
+	SysfsRoot = filepath.Join(t.TempDir(), "missing")
+	defer func() { SysfsRoot = saved }()
+
+	if _, err := ListPorts(); err == nil {
+		t.Fatal("ListPorts succeeded without sysfs")
+	}
+}
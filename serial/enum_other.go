@@ -0,0 +1,8 @@
+// +build !linux
+
+package serial
+
+// ListPorts is only implemented on Linux.
+func ListPorts() ([]PortInfo, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,337 @@
+package serial
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Framer splits the bytes received by SerialPort into frames.
+//
+// Frame is called with all buffered bytes that have not been consumed yet.
+// It returns how many of them to consume and the frame they held. Returning
+// advance 0 asks for more data, advance > 0 with a nil frame drops bytes
+// (noise, malformed frames). The frame may alias data, it is copied before
+// being handed out. An error stops the receive goroutine.
+type Framer interface {
+	Frame(data []byte) (advance int, frame []byte, err error)
+}
+
+// FrameEncoder is implemented by framers that can also build frames, it is
+// used by SerialPort.WriteFrame.
+type FrameEncoder interface {
+	Encode(payload []byte) ([]byte, error)
+}
+
+// LineFramer splits on a single byte, the default framer of SerialPort.
+type LineFramer struct {
+	EOL byte
+}
+
+func (f *LineFramer) Frame(data []byte) (int, []byte, error) {
+	if i := bytes.IndexByte(data, f.EOL); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	return 0, nil, nil
+}
+
+func (f *LineFramer) Encode(payload []byte) ([]byte, error) {
+	return append(append([]byte{}, payload...), f.EOL), nil
+}
+
+// DelimiterFramer splits on a multi-byte terminator such as "\r\n".
+type DelimiterFramer struct {
+	Delim []byte
+}
+
+func (f *DelimiterFramer) Frame(data []byte) (int, []byte, error) {
+	if i := bytes.Index(data, f.Delim); i >= 0 {
+		return i + len(f.Delim), data[:i], nil
+	}
+	return 0, nil, nil
+}
+
+func (f *DelimiterFramer) Encode(payload []byte) ([]byte, error) {
+	return append(append([]byte{}, payload...), f.Delim...), nil
+}
+
+// FixedLengthFramer cuts the stream into frames of Length bytes.
+type FixedLengthFramer struct {
+	Length int
+}
+
+func (f *FixedLengthFramer) Frame(data []byte) (int, []byte, error) {
+	if f.Length <= 0 {
+		return 0, nil, fmt.Errorf("Invalid frame length %d", f.Length)
+	}
+	if len(data) < f.Length {
+		return 0, nil, nil
+	}
+	return f.Length, data[:f.Length], nil
+}
+
+func (f *FixedLengthFramer) Encode(payload []byte) ([]byte, error) {
+	if len(payload) != f.Length {
+		return nil, fmt.Errorf("Frame length %d, want %d", len(payload), f.Length)
+	}
+	return payload, nil
+}
+
+// Default LengthPrefixFramer.MaxLength.
+const MAX_FRAME_LENGTH = 64 * 1024
+
+// LengthPrefixFramer reads frames made of a Size byte length field (1, 2
+// or 4) followed by the payload. Adjust is added to the length field to
+// get the payload size, for protocols whose length covers more or less
+// than the payload. Frames announcing more than MaxLength bytes are
+// dropped one byte at a time to resynchronize, 0 means MAX_FRAME_LENGTH.
+// Frames that don't fit in the receive ring are always dropped.
+type LengthPrefixFramer struct {
+	Size         int
+	LittleEndian bool
+	Adjust       int
+	MaxLength    int
+}
+
+func (f *LengthPrefixFramer) order() binary.ByteOrder {
+	if f.LittleEndian {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+func (f *LengthPrefixFramer) maxLength() int {
+	max := f.MaxLength
+	if max <= 0 {
+		max = MAX_FRAME_LENGTH
+	}
+	if max > MAX_READ_BUFFER_SIZE-f.Size {
+		max = MAX_READ_BUFFER_SIZE - f.Size
+	}
+	return max
+}
+
+func (f *LengthPrefixFramer) Frame(data []byte) (int, []byte, error) {
+	if len(data) < f.Size {
+		return 0, nil, nil
+	}
+
+	var n int
+	switch f.Size {
+	case 1:
+		n = int(data[0])
+	case 2:
+		n = int(f.order().Uint16(data))
+	case 4:
+		n = int(f.order().Uint32(data))
+	default:
+		return 0, nil, fmt.Errorf("Invalid length field size %d", f.Size)
+	}
+
+	n += f.Adjust
+	if n < 0 || n > f.maxLength() {
+		return 1, nil, nil
+	}
+	if len(data) < f.Size+n {
+		return 0, nil, nil
+	}
+	return f.Size + n, data[f.Size : f.Size+n], nil
+}
+
+func (f *LengthPrefixFramer) Encode(payload []byte) ([]byte, error) {
+	n := len(payload) - f.Adjust
+	buf := make([]byte, f.Size, f.Size+len(payload))
+	switch f.Size {
+	case 1:
+		if n < 0 || n > 0xFF {
+			return nil, fmt.Errorf("Frame length %d overflows the length field", len(payload))
+		}
+		buf[0] = byte(n)
+	case 2:
+		if n < 0 || n > 0xFFFF {
+			return nil, fmt.Errorf("Frame length %d overflows the length field", len(payload))
+		}
+		f.order().PutUint16(buf, uint16(n))
+	case 4:
+		if n < 0 {
+			return nil, fmt.Errorf("Frame length %d overflows the length field", len(payload))
+		}
+		f.order().PutUint32(buf, uint32(n))
+	default:
+		return nil, fmt.Errorf("Invalid length field size %d", f.Size)
+	}
+	return append(buf, payload...), nil
+}
+
+// SLIP (RFC 1055) special bytes
+const (
+	SLIP_END     byte = 0xC0
+	SLIP_ESC     byte = 0xDB
+	SLIP_ESC_END byte = 0xDC
+	SLIP_ESC_ESC byte = 0xDD
+)
+
+// SLIPFramer decodes RFC 1055 SLIP frames. Empty frames are skipped and
+// frames with an invalid escape are dropped.
+type SLIPFramer struct{}
+
+func (f *SLIPFramer) Frame(data []byte) (int, []byte, error) {
+	i := bytes.IndexByte(data, SLIP_END)
+	if i < 0 {
+		return 0, nil, nil
+	}
+	if i == 0 {
+		return 1, nil, nil
+	}
+
+	frame := make([]byte, 0, i)
+	for j := 0; j < i; j++ {
+		b := data[j]
+		if b == SLIP_ESC {
+			j++
+			if j == i {
+				return i + 1, nil, nil
+			}
+			switch data[j] {
+			case SLIP_ESC_END:
+				b = SLIP_END
+			case SLIP_ESC_ESC:
+				b = SLIP_ESC
+			default:
+				return i + 1, nil, nil
+			}
+		}
+		frame = append(frame, b)
+	}
+	return i + 1, frame, nil
+}
+
+func (f *SLIPFramer) Encode(payload []byte) ([]byte, error) {
+	buf := make([]byte, 0, len(payload)+2)
+	buf = append(buf, SLIP_END)
+	for _, b := range payload {
+		switch b {
+		case SLIP_END:
+			buf = append(buf, SLIP_ESC, SLIP_ESC_END)
+		case SLIP_ESC:
+			buf = append(buf, SLIP_ESC, SLIP_ESC_ESC)
+		default:
+			buf = append(buf, b)
+		}
+	}
+	return append(buf, SLIP_END), nil
+}
+
+// COBSFramer decodes Consistent Overhead Byte Stuffing frames terminated by
+// a zero byte. Malformed frames are dropped.
+type COBSFramer struct{}
+
+func (f *COBSFramer) Frame(data []byte) (int, []byte, error) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return 0, nil, nil
+	}
+	if i == 0 {
+		return 1, nil, nil
+	}
+
+	frame := make([]byte, 0, i)
+	for j := 0; j < i; {
+		code := int(data[j])
+		if j+code > i {
+			return i + 1, nil, nil
+		}
+		frame = append(frame, data[j+1:j+code]...)
+		j += code
+		if code < 0xFF && j < i {
+			frame = append(frame, 0)
+		}
+	}
+	return i + 1, frame, nil
+}
+
+func (f *COBSFramer) Encode(payload []byte) ([]byte, error) {
+	buf := make([]byte, 1, len(payload)+len(payload)/254+2)
+	code := 0
+	for _, b := range payload {
+		if b == 0 {
+			buf[code] = byte(len(buf) - code)
+			code = len(buf)
+			buf = append(buf, 0)
+			continue
+		}
+		buf = append(buf, b)
+		if len(buf)-code == 0xFF {
+			buf[code] = 0xFF
+			code = len(buf)
+			buf = append(buf, 0)
+		}
+	}
+	buf[code] = byte(len(buf) - code)
+	return append(buf, 0), nil
+}
+
+// STXETXFramer reads frames enclosed in STX and ETX. Inside a frame ESC
+// makes the next byte literal after XOR with EscXor (0 for plain escaping,
+// 0x20 for the common "ESC, byte^0x20" scheme). ESC 0 means no escaping,
+// unless Escape is set to escape with NUL. Bytes outside of frames are
+// dropped.
+type STXETXFramer struct {
+	STX    byte
+	ETX    byte
+	ESC    byte
+	EscXor byte
+	Escape bool
+}
+
+func (f *STXETXFramer) escaping() bool {
+	return f.ESC != 0 || f.Escape
+}
+
+func (f *STXETXFramer) Frame(data []byte) (int, []byte, error) {
+	start := bytes.IndexByte(data, f.STX)
+	if start < 0 {
+		return len(data), nil, nil
+	}
+	if start > 0 {
+		return start, nil, nil
+	}
+
+	esc := f.escaping()
+	frame := make([]byte, 0, len(data))
+	for j := 1; j < len(data); j++ {
+		b := data[j]
+		switch {
+		case esc && b == f.ESC:
+			j++
+			if j == len(data) {
+				return 0, nil, nil
+			}
+			b = data[j] ^ f.EscXor
+		case b == f.ETX:
+			return j + 1, frame, nil
+		case b == f.STX:
+			// unterminated frame, restart from the new STX
+			return j, nil, nil
+		}
+		frame = append(frame, b)
+	}
+	return 0, nil, nil
+}
+
+func (f *STXETXFramer) Encode(payload []byte) ([]byte, error) {
+	esc := f.escaping()
+	buf := make([]byte, 0, len(payload)+2)
+	buf = append(buf, f.STX)
+	for _, b := range payload {
+		if b == f.STX || b == f.ETX || (esc && b == f.ESC) {
+			if !esc {
+				return nil, fmt.Errorf("Byte 0x%02X needs escaping, no ESC set", b)
+			}
+			buf = append(buf, f.ESC, b^f.EscXor)
+			continue
+		}
+		buf = append(buf, b)
+	}
+	return append(buf, f.ETX), nil
+}
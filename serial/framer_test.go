@@ -0,0 +1,166 @@
+package serial
+
+import (
+	"bytes"
+	"testing"
+)
+
+// chunkPort is a port whose input arrives in reads of at most n bytes and
+// ends with io.EOF.
+type chunkPort struct {
+	chunkReader
+	written bytes.Buffer
+}
+
+func (p *chunkPort) Write(b []byte) (int, error) { return p.written.Write(b) }
+func (p *chunkPort) Close() error                { return nil }
+
+// readFrames feeds data to f through SerialPort.ReadFrame in chunks of n
+// bytes and returns the frames until the input ends.
+func readFrames(t *testing.T, f Framer, data []byte, n int) [][]byte {
+	t.Helper()
+	sp := NewSerialPortFrom(&chunkPort{chunkReader: chunkReader{data: data, n: n}})
+	sp.SetFramer(f)
+	sp.StartRecv()
+	defer sp.Close()
+
+	frames := [][]byte{}
+	for {
+		frame, err := sp.ReadFrame()
+		if err != nil {
+			if _, ok := err.(*ReadError); !ok {
+				t.Fatalf("ReadFrame: %v", err)
+			}
+			return frames
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func joinFrames(frames [][]byte) string {
+	return string(bytes.Join(frames, []byte("|")))
+}
+
+func TestFramers(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		f     Framer
+		input string
+		want  []string
+	}{
+		{"line", &LineFramer{EOL: '\n'}, "a\nbc\n\nd", []string{"a", "bc", ""}},
+		{"delimiter", &DelimiterFramer{Delim: []byte("\r\n")}, "OK\r\n+CSQ: 1\r\r\n\r", []string{"OK", "+CSQ: 1\r"}},
+		{"fixed", &FixedLengthFramer{Length: 3}, "abcdefgh", []string{"abc", "def"}},
+		// a corrupt length field is dropped byte by byte
+		{"length", &LengthPrefixFramer{Size: 2, MaxLength: 8}, "\x00\x03abc\xff\xff\x00\x02xy", []string{"abc", "xy"}},
+		{"length little endian", &LengthPrefixFramer{Size: 2, LittleEndian: true}, "\x03\x00abc\x00\x00", []string{"abc", ""}},
+		{"length adjust", &LengthPrefixFramer{Size: 1, Adjust: -1}, "\x04abc\x00\x01z", []string{"abc", ""}},
+		{"length default max", &LengthPrefixFramer{Size: 4}, "\xff\xff\xff\xff\x00\x00\x00\x01z", []string{"z"}},
+		// empty frames are skipped, a bad escape drops the frame
+		{"slip", &SLIPFramer{}, "\xc0a\xdb\xdcb\xc0\xc0x\xdby\xc0c\xdb\xdd\xc0", []string{"a\xc0b", "c\xdb"}},
+		{"cobs", &COBSFramer{}, "\x03ab\x00\x05a\x00\x01\x01\x00\x00\x02x\x00", []string{"ab", "\x00", "x"}},
+		// noise and unterminated frames are dropped
+		{"stx/etx", &STXETXFramer{STX: 0x02, ETX: 0x03, ESC: 0x10}, "z\x02a\x10\x03b\x03\x02x\x02y\x03", []string{"a\x03b", "y"}},
+		{"stx/etx xor", &STXETXFramer{STX: 0x7e, ETX: 0x7f, ESC: 0x7d, EscXor: 0x20}, "\x7ea\x7d\x5e\x7d\x5d\x7f", []string{"a\x7e\x7d"}},
+		{"stx/etx NUL", &STXETXFramer{STX: 0x02, ETX: 0x03}, "\x02\x00a\x00\x03", []string{"\x00a\x00"}},
+		{"stx/etx NUL escape", &STXETXFramer{STX: 0x02, ETX: 0x03, Escape: true}, "\x02\x00\x03a\x03", []string{"\x03a"}},
+	} {
+		want := joinFrames(toFrames(c.want))
+		for _, n := range []int{1, 3, 100} {
+			if got := joinFrames(readFrames(t, c.f, []byte(c.input), n)); got != want {
+				t.Errorf("%s, reads of %d: frames %q, want %q", c.name, n, got, want)
+			}
+		}
+	}
+}
+
+func toFrames(s []string) [][]byte {
+	frames := [][]byte{}
+	for _, f := range s {
+		frames = append(frames, []byte(f))
+	}
+	return frames
+}
+
+func TestFramerRoundTrip(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	// COBS codes change at 254 non-zero bytes
+	long := bytes.Repeat([]byte("x"), 600)
+
+	for _, c := range []struct {
+		name     string
+		f        Framer
+		payloads [][]byte
+	}{
+		{"line", &LineFramer{EOL: '\n'}, [][]byte{{}, []byte("AT+CSQ")}},
+		{"delimiter", &DelimiterFramer{Delim: []byte("\r\n")}, [][]byte{[]byte("a\rb\nc")}},
+		{"fixed", &FixedLengthFramer{Length: 4}, [][]byte{[]byte("abcd"), []byte("\x00\x00\x00\x00")}},
+		{"length", &LengthPrefixFramer{Size: 2}, [][]byte{{}, all, long}},
+		{"length adjust", &LengthPrefixFramer{Size: 1, Adjust: 2}, [][]byte{[]byte("ab"), all[:200]}},
+		{"slip", &SLIPFramer{}, [][]byte{all, []byte("\xc0"), long}},
+		{"cobs", &COBSFramer{}, [][]byte{{}, {0}, all, long, append(long[:254:254], 0)}},
+		{"stx/etx", &STXETXFramer{STX: 0x02, ETX: 0x03, ESC: 0x10, EscXor: 0x20}, [][]byte{all, {}}},
+		{"stx/etx NUL escape", &STXETXFramer{STX: 0x02, ETX: 0x03, Escape: true}, [][]byte{all}},
+	} {
+		enc := c.f.(FrameEncoder)
+		stream := []byte{}
+		for _, p := range c.payloads {
+			b, err := enc.Encode(p)
+			if err != nil {
+				t.Fatalf("%s: Encode(%q): %v", c.name, p, err)
+			}
+			stream = append(stream, b...)
+		}
+		if got, want := joinFrames(readFrames(t, c.f, stream, 7)), joinFrames(c.payloads); got != want {
+			t.Errorf("%s: frames %q, want %q", c.name, got, want)
+		}
+	}
+}
+
+func TestFramerEncodeErrors(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		f       FrameEncoder
+		payload []byte
+	}{
+		{"fixed", &FixedLengthFramer{Length: 4}, []byte("abc")},
+		{"length overflow", &LengthPrefixFramer{Size: 1}, make([]byte, 256)},
+		{"length size", &LengthPrefixFramer{Size: 3}, []byte("a")},
+		{"stx/etx unescaped", &STXETXFramer{STX: 0x02, ETX: 0x03}, []byte("\x03")},
+	} {
+		if _, err := c.f.Encode(c.payload); err == nil {
+			t.Errorf("%s: no error", c.name)
+		}
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+	p := &chunkPort{}
+	sp := NewSerialPortFrom(p)
+
+	// the default framer ends lines with the EOL
+	sp.SetEOL('\r')
+	if err := sp.WriteFrame([]byte("AT")); err != nil {
+		t.Fatal(err)
+	}
+
+	sp.SetFramer(&SLIPFramer{})
+	if err := sp.WriteFrame([]byte("\xc0")); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.written.String(); got != "AT\r\xc0\xdb\xdc\xc0" {
+		t.Fatalf("written %q", got)
+	}
+
+	sp.SetFramer(decodeOnly{})
+	if err := sp.WriteFrame([]byte("x")); err != ErrNotSupported {
+		t.Fatalf("WriteFrame without encoder: %v", err)
+	}
+}
+
+type decodeOnly struct{}
+
+func (decodeOnly) Frame(data []byte) (int, []byte, error) { return len(data), data, nil }
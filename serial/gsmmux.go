@@ -0,0 +1,152 @@
+// +build !windows
+
+package serial
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xiqingping/golibs/serial/cmux"
+)
+
+// How long the modem gets to answer AT+CMUX.
+var GsmMuxStartTimeout = time.Second * 5
+
+// GsmMuxPort runs the GSM 07.10 multiplexer on a serial port, each
+// channel is an io.ReadWriteCloser usable with NewSerialPortFrom.
+type GsmMuxPort struct {
+	port     *Port
+	mux      *cmux.Mux
+	channels []*cmux.Channel
+
+	// Advanced selects advanced option framing, MaxFrameSize the N1
+	// parameter (default 127). Both must be set before Start.
+	Advanced     bool
+	MaxFrameSize int
+}
+
+func NewGsmMuxPort(name string, baud int) (*GsmMuxPort, error) {
+	port, err := openPort(&Config{Name: name, Baud: baud})
+	if err != nil {
+		return nil, err
+	}
+	return &GsmMuxPort{port: port}, nil
+}
+
+// Start switches the modem to multiplexer mode with AT+CMUX and opens
+// DLCIs 1 to num. With initiator 0 the port plays the modem side and
+// waits for the peer instead.
+func (mux *GsmMuxPort) Start(num, initiator int) error {
+	if mux.mux != nil {
+		return errors.New("Multiplexer already started")
+	}
+
+	n1 := mux.MaxFrameSize
+	if n1 <= 0 {
+		n1 = 127
+	}
+
+	if initiator != 0 {
+		mode := 0
+		if mux.Advanced {
+			mode = 1
+		}
+		if err := mux.atCMUX(fmt.Sprintf("AT+CMUX=%d,0,5,%d\r", mode, n1)); err != nil {
+			return err
+		}
+	}
+
+	mux.mux = cmux.New(mux.port, &cmux.Config{
+		Initiator:    initiator != 0,
+		Advanced:     mux.Advanced,
+		MaxFrameSize: n1,
+	})
+	if err := mux.mux.Start(); err != nil {
+		mux.mux.Close()
+		mux.mux = nil
+		return err
+	}
+
+	for i := 1; i <= num; i++ {
+		var ch *cmux.Channel
+		var err error
+		if initiator != 0 {
+			ch, err = mux.mux.Open(i)
+		} else {
+			ch, err = mux.mux.Accept()
+		}
+		if err != nil {
+			// closes the channels opened so far
+			mux.mux.Close()
+			mux.mux = nil
+			mux.channels = nil
+			return fmt.Errorf("Open DLCI %d: %s", i, err)
+		}
+		mux.channels = append(mux.channels, ch)
+	}
+
+	return nil
+}
+
+// atCMUX sends the AT+CMUX command and waits for the final result.
+func (mux *GsmMuxPort) atCMUX(cmd string) error {
+	if _, err := mux.port.Write([]byte(cmd)); err != nil {
+		return err
+	}
+
+	mux.port.SetReadDeadline(time.Now().Add(GsmMuxStartTimeout))
+	defer mux.port.SetReadDeadline(time.Time{})
+
+	// byte at a time, nothing after OK may be swallowed
+	r := bufio.NewReaderSize(oneByteReader{mux.port}, 16)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if isTimeout(err) {
+				return errors.New("AT+CMUX response timeout")
+			}
+			return err
+		}
+
+		switch strings.TrimSpace(line) {
+		case "OK":
+			return nil
+		case "ERROR":
+			return errors.New("AT+CMUX returned ERROR")
+		}
+	}
+}
+
+type oneByteReader struct {
+	p *Port
+}
+
+func (r oneByteReader) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return r.p.Read(b)
+}
+
+// Channel returns the channel of DLCI i, nil if it isn't open.
+func (mux *GsmMuxPort) Channel(i int) *cmux.Channel {
+	if i < 1 || i > len(mux.channels) {
+		return nil
+	}
+	return mux.channels[i-1]
+}
+
+// Mux returns the multiplexer, nil before Start.
+func (mux *GsmMuxPort) Mux() *cmux.Mux {
+	return mux.mux
+}
+
+func (mux *GsmMuxPort) Close() {
+	if mux.mux != nil {
+		mux.mux.Close()
+	}
+	mux.port.Close()
+}
@@ -0,0 +1,152 @@
+// +build !windows
+
+package serial
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xiqingping/golibs/serial/cmux"
+	"github.com/xiqingping/golibs/serial/virtual"
+)
+
+// muxModem plays a modem on the device side of a pty: it answers AT+CMUX,
+// then echoes the data of every channel the host opens.
+type muxModem struct {
+	rw io.ReadWriter
+
+	lock     sync.Mutex
+	deaf     bool   // stop answering, keep what the host sends in heard
+	heard    []byte // frames received while deaf
+	accepted int
+	mux      *cmux.Mux
+}
+
+func (m *muxModem) Read(b []byte) (int, error) {
+	for {
+		n, err := m.rw.Read(b)
+		m.lock.Lock()
+		deaf := m.deaf
+		if deaf {
+			m.heard = append(m.heard, b[:n]...)
+		}
+		m.lock.Unlock()
+		if err != nil || !deaf {
+			return n, err
+		}
+	}
+}
+
+func (m *muxModem) Write(b []byte) (int, error) {
+	return m.rw.Write(b)
+}
+
+// run answers AT+CMUX and serves the channels, after accepting deafAfter
+// channels it stops answering.
+func (m *muxModem) run(t *testing.T, deafAfter int) {
+	cmd := []byte{}
+	buf := make([]byte, 1)
+	for !bytes.HasSuffix(cmd, []byte("\r")) {
+		if _, err := m.rw.Read(buf); err != nil {
+			t.Error(err)
+			return
+		}
+		cmd = append(cmd, buf[0])
+	}
+	if !strings.HasPrefix(string(cmd), "AT+CMUX=") {
+		t.Errorf("modem got %q", cmd)
+		return
+	}
+	m.rw.Write([]byte("\r\nOK\r\n"))
+
+	mux := cmux.New(m, &cmux.Config{})
+	m.lock.Lock()
+	m.mux = mux
+	m.lock.Unlock()
+	for {
+		ch, err := mux.Accept()
+		if err != nil {
+			return
+		}
+		m.lock.Lock()
+		m.accepted++
+		m.deaf = m.accepted == deafAfter
+		m.lock.Unlock()
+		go io.Copy(ch, ch)
+	}
+}
+
+func (m *muxModem) heardFrames() []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]byte(nil), m.heard...)
+}
+
+func startMuxModem(t *testing.T, deafAfter int) (*GsmMuxPort, *muxModem) {
+	pair, err := virtual.OpenPair()
+	if err != nil {
+		t.Skip("no pty:", err)
+	}
+	t.Cleanup(func() { pair.Close() })
+
+	modem := &muxModem{rw: pair}
+	go modem.run(t, deafAfter)
+
+	mux, err := NewGsmMuxPort(pair.Name(), 115200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mux, modem
+}
+
+func TestGsmMuxPort(t *testing.T) {
+	mux, _ := startMuxModem(t, 0)
+	defer mux.Close()
+
+	if err := mux.Start(2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		sp := NewSerialPortFrom(mux.Channel(i))
+		sp.StartRecv()
+		want := strings.Repeat("x", 200*i)
+		if _, err := sp.Write([]byte(want + "\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		l, err := sp.ReadLineContext(ctx)
+		cancel()
+		if err != nil || l != want {
+			t.Fatalf("DLCI %d: ReadLine = %d bytes, %v", i, len(l), err)
+		}
+	}
+	if mux.Channel(3) != nil {
+		t.Fatal("DLCI 3 open")
+	}
+}
+
+// A DLCI that can't be opened closes the channels opened before it and
+// the multiplexer.
+func TestGsmMuxPortStartFailure(t *testing.T) {
+	mux, modem := startMuxModem(t, 1)
+	defer mux.Close()
+
+	if err := mux.Start(2, 1); err == nil || !strings.Contains(err.Error(), "DLCI 2") {
+		t.Fatalf("Start error %v", err)
+	}
+	if mux.Mux() != nil || mux.Channel(1) != nil {
+		t.Fatal("multiplexer left running")
+	}
+
+	// DISC for DLCI 1, command from the initiator, P/F set
+	if heard := modem.heardFrames(); !bytes.Contains(heard, []byte{0xF9, 0x07, 0x53}) {
+		t.Fatalf("no DISC for DLCI 1 in % x", heard)
+	}
+}
@@ -0,0 +1,19 @@
+package serial
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func ioctl(fd uintptr, req uint, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		fd,
+		uintptr(req),
+		uintptr(arg),
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package serial
+
+import (
+	"syscall"
+	"testing"
+)
+
+// The termios bits of lineFlags (no cgo) or setLineFlags (cgo).
+func TestLineFlags(t *testing.T) {
+	const (
+		cmspar  = 0x40000000
+		crtscts = 0x80000000
+		cmask   = syscall.CSIZE | syscall.PARENB | syscall.PARODD | syscall.CSTOPB | cmspar | crtscts
+		imask   = syscall.INPCK | syscall.IXON | syscall.IXOFF
+	)
+
+	for _, c := range []struct {
+		c            Config
+		cflag, iflag uint64
+	}{
+		{Config{}, syscall.CS8, 0},
+		{Config{DataBits: 5}, syscall.CS5, 0},
+		{Config{DataBits: 6}, syscall.CS6, 0},
+		{Config{DataBits: 7, Parity: ParityEven}, syscall.CS7 | syscall.PARENB, syscall.INPCK},
+		{Config{Parity: ParityOdd}, syscall.CS8 | syscall.PARENB | syscall.PARODD, syscall.INPCK},
+		{Config{Parity: ParityMark}, syscall.CS8 | syscall.PARENB | syscall.PARODD | cmspar, syscall.INPCK},
+		{Config{Parity: ParitySpace}, syscall.CS8 | syscall.PARENB | cmspar, syscall.INPCK},
+		{Config{StopBits: StopBits2}, syscall.CS8 | syscall.CSTOPB, 0},
+		{Config{RTSCTS: true}, syscall.CS8 | crtscts, 0},
+		{Config{XONXOFF: true}, syscall.CS8, syscall.IXON | syscall.IXOFF},
+	} {
+		cflag, iflag, err := termiosFlags(&c.c)
+		if err != nil {
+			t.Fatalf("%+v: %v", c.c, err)
+		}
+		if cflag&cmask != c.cflag || iflag&imask != c.iflag {
+			t.Errorf("%+v: cflag %#x iflag %#x, want %#x %#x",
+				c.c, cflag&cmask, iflag&imask, c.cflag, c.iflag)
+		}
+	}
+
+	if _, _, err := termiosFlags(&Config{StopBits: StopBits1Half}); err == nil {
+		t.Fatal("1.5 stop bits accepted")
+	}
+}
@@ -0,0 +1,159 @@
+package serial
+
+import (
+	"context"
+	"syscall"
+	"unsafe"
+)
+
+// tiocm performs the modem control ioctls. It is a variable so that the
+// modem line code can be driven without a driver that implements them.
+var tiocm = struct {
+	get  func(fd uintptr) (int, error)
+	set  func(fd uintptr, req uint, bits int) error
+	wait func(fd uintptr, mask int) error
+}{
+	get: func(fd uintptr) (int, error) {
+		var bits int32
+		err := ioctl(fd, syscall.TIOCMGET, unsafe.Pointer(&bits))
+		return int(bits), err
+	},
+	set: func(fd uintptr, req uint, bits int) error {
+		b := int32(bits)
+		return ioctl(fd, req, unsafe.Pointer(&b))
+	},
+	wait: func(fd uintptr, mask int) error {
+		_, _, errno := syscall.Syscall(
+			syscall.SYS_IOCTL,
+			fd,
+			uintptr(syscall.TIOCMIWAIT),
+			uintptr(mask),
+		)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	},
+}
+
+func modemStatus(bits int) ModemStatus {
+	return ModemStatus{
+		CTS: bits&syscall.TIOCM_CTS != 0,
+		DSR: bits&syscall.TIOCM_DSR != 0,
+		DCD: bits&syscall.TIOCM_CD != 0,
+		RI:  bits&syscall.TIOCM_RNG != 0,
+	}
+}
+
+func (p *Port) setModemBits(bits int, on bool) error {
+	req := uint(syscall.TIOCMBIC)
+	if on {
+		req = syscall.TIOCMBIS
+	}
+	return p.control(func(fd uintptr) error {
+		return tiocm.set(fd, req, bits)
+	})
+}
+
+// Sets or clears the DTR line
+func (p *Port) SetDTR(on bool) error {
+	return p.setModemBits(syscall.TIOCM_DTR, on)
+}
+
+// Sets or clears the RTS line
+func (p *Port) SetRTS(on bool) error {
+	return p.setModemBits(syscall.TIOCM_RTS, on)
+}
+
+// Returns the state of the CTS, DSR, DCD and RI lines
+func (p *Port) GetModemStatus() (ModemStatus, error) {
+	var bits int
+	err := p.control(func(fd uintptr) (err error) {
+		bits, err = tiocm.get(fd)
+		return
+	})
+	if err != nil {
+		return ModemStatus{}, err
+	}
+	return modemStatus(bits), nil
+}
+
+// Blocks until one of the CTS, DSR, DCD or RI lines changes and returns the
+// new state, or until ctx is done.
+//
+// The change is waited for with TIOCMIWAIT on a duplicate of the
+// descriptor. The ioctl can not be interrupted: when ctx is done first it
+// keeps running, and keeps the device open even if the port is closed,
+// until the next line change or hangup; the next call waits on it rather
+// than starting another. Drivers without TIOCMIWAIT (ptys among them) are
+// polled every ModemPollInterval instead.
+func (p *Port) WaitForModemStatusChange(ctx context.Context) (ModemStatus, error) {
+	before, err := p.GetModemStatus()
+	if err != nil {
+		return ModemStatus{}, err
+	}
+
+	for {
+		w, fresh, err := p.mw.start(p, before)
+		if err != nil {
+			return ModemStatus{}, err
+		}
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return ModemStatus{}, ctx.Err()
+		}
+
+		if w.err == syscall.ENOTTY || w.err == syscall.EINVAL {
+			return pollModemStatus(ctx, before, p.GetModemStatus)
+		}
+		if w.err != nil {
+			return ModemStatus{}, w.err
+		}
+		now, err := p.GetModemStatus()
+		// A wait taken over from an earlier call may have seen a change
+		// from before this one started.
+		if err != nil || fresh || now != before {
+			return now, err
+		}
+	}
+}
+
+// start returns the running TIOCMIWAIT of p, or starts a new one that
+// returns at once if the lines no longer match before. fresh tells which.
+func (w *modemWaiter) start(p *Port, before ModemStatus) (mw *modemWait, fresh bool, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.cur != nil {
+		select {
+		case <-w.cur.done:
+		default:
+			return w.cur, false, nil
+		}
+	}
+
+	var dup int
+	err = p.control(func(fd uintptr) (err error) {
+		dup, err = syscall.Dup(int(fd))
+		return
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	mw = &modemWait{done: make(chan struct{})}
+	w.cur = mw
+	go func() {
+		defer close(mw.done)
+		defer syscall.Close(dup)
+		// A change between reading before and entering the ioctl would
+		// otherwise be missed until the next one.
+		bits, err := tiocm.get(uintptr(dup))
+		if err != nil || modemStatus(bits) != before {
+			mw.err = err
+			return
+		}
+		mw.err = tiocm.wait(uintptr(dup), syscall.TIOCM_CTS|syscall.TIOCM_DSR|syscall.TIOCM_CD|syscall.TIOCM_RNG)
+	}()
+	return mw, true, nil
+}
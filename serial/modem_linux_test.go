@@ -0,0 +1,186 @@
+package serial
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/xiqingping/golibs/serial/virtual"
+)
+
+// fakeModem stands in for the modem control ioctls of a pty.
+type fakeModem struct {
+	lock    sync.Mutex
+	bits    int
+	gets    int
+	waits   int
+	changed chan struct{} // closed by change
+	waitErr error
+}
+
+func (m *fakeModem) change(bits int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.bits = bits
+	close(m.changed)
+}
+
+// install replaces tiocm with m until the test ends.
+func (m *fakeModem) install(t *testing.T) {
+	saved := tiocm
+	t.Cleanup(func() { tiocm = saved })
+
+	m.changed = make(chan struct{})
+	tiocm.get = func(fd uintptr) (int, error) {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		m.gets++
+		return m.bits, nil
+	}
+	tiocm.wait = func(fd uintptr, mask int) error {
+		m.lock.Lock()
+		m.waits++
+		err := m.waitErr
+		m.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		<-m.changed
+		return nil
+	}
+}
+
+func (m *fakeModem) waitCalls() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.waits
+}
+
+func openPtyPort(t *testing.T) *Port {
+	pair, err := virtual.OpenPair()
+	if err != nil {
+		t.Skip("no pty:", err)
+	}
+	t.Cleanup(func() { pair.Close() })
+
+	p, err := openPort(&Config{Name: pair.Name(), Baud: 115200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestWaitForModemStatusChangeIoctl(t *testing.T) {
+	m := &fakeModem{bits: syscall.TIOCM_CTS}
+	m.install(t)
+	p := openPtyPort(t)
+
+	time.AfterFunc(50*time.Millisecond, func() { m.change(syscall.TIOCM_CTS | syscall.TIOCM_CD) })
+	s, err := p.WaitForModemStatusChange(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != (ModemStatus{CTS: true, DCD: true}) {
+		t.Fatalf("status %+v", s)
+	}
+	if m.waitCalls() != 1 {
+		t.Fatalf("TIOCMIWAIT called %d times", m.waitCalls())
+	}
+}
+
+// A change right before the ioctl starts must not be missed.
+func TestWaitForModemStatusChangeRecheck(t *testing.T) {
+	m := &fakeModem{}
+	m.install(t)
+	get := tiocm.get
+	tiocm.get = func(fd uintptr) (int, error) {
+		bits, err := get(fd)
+		if m.gets == 1 {
+			m.bits = syscall.TIOCM_RNG
+		}
+		return bits, err
+	}
+	p := openPtyPort(t)
+
+	s, err := p.WaitForModemStatusChange(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != (ModemStatus{RI: true}) {
+		t.Fatalf("status %+v", s)
+	}
+	if m.waitCalls() != 0 {
+		t.Fatal("waited although the lines had changed")
+	}
+}
+
+func TestWaitForModemStatusChangeNoIoctl(t *testing.T) {
+	m := &fakeModem{waitErr: syscall.ENOTTY}
+	m.install(t)
+	p := openPtyPort(t)
+
+	time.AfterFunc(50*time.Millisecond, func() { m.change(syscall.TIOCM_DSR) })
+	s, err := p.WaitForModemStatusChange(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != (ModemStatus{DSR: true}) {
+		t.Fatalf("status %+v", s)
+	}
+}
+
+func TestWaitForModemStatusChangeCancellable(t *testing.T) {
+	m := &fakeModem{}
+	m.install(t)
+	p := openPtyPort(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	time.AfterFunc(50*time.Millisecond, func() { m.change(syscall.TIOCM_CTS) })
+	s, err := p.WaitForModemStatusChange(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != (ModemStatus{CTS: true}) {
+		t.Fatalf("status %+v", s)
+	}
+	if m.waitCalls() != 1 {
+		t.Fatalf("TIOCMIWAIT called %d times", m.waitCalls())
+	}
+}
+
+// A cancelled wait leaves its ioctl running for the next call to take
+// over, and does not keep the port from closing.
+func TestWaitForModemStatusChangeCancel(t *testing.T) {
+	m := &fakeModem{}
+	m.install(t)
+	p := openPtyPort(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := p.WaitForModemStatusChange(ctx); err != context.Canceled {
+		t.Fatalf("error %v, want %v", err, context.Canceled)
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { m.change(syscall.TIOCM_DSR) })
+	s, err := p.WaitForModemStatusChange(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != (ModemStatus{DSR: true}) {
+		t.Fatalf("status %+v", s)
+	}
+	if m.waitCalls() != 1 {
+		t.Fatalf("TIOCMIWAIT called %d times", m.waitCalls())
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.GetModemStatus(); err == nil {
+		t.Fatal("GetModemStatus succeeded on a closed port")
+	}
+}
@@ -0,0 +1,23 @@
+// +build !linux,!windows
+
+package serial
+
+import (
+	"context"
+)
+
+func (p *Port) SetDTR(on bool) error {
+	return ErrNotSupported
+}
+
+func (p *Port) SetRTS(on bool) error {
+	return ErrNotSupported
+}
+
+func (p *Port) GetModemStatus() (ModemStatus, error) {
+	return ModemStatus{}, ErrNotSupported
+}
+
+func (p *Port) WaitForModemStatusChange(ctx context.Context) (ModemStatus, error) {
+	return ModemStatus{}, ErrNotSupported
+}
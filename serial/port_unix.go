@@ -0,0 +1,73 @@
+// +build !windows
+
+package serial
+
+import (
+	"sync"
+	"time"
+)
+
+// termios has no 1.5 stop bits.
+const stopBits1Half = false
+
+// modemWait is a TIOCMIWAIT running on a duplicate of the descriptor of a
+// port. done is closed once it returns err.
+type modemWait struct {
+	done chan struct{}
+	err  error
+}
+
+// modemWaiter holds the TIOCMIWAIT of a port. The ioctl can not be
+// interrupted, so one left behind by a cancelled WaitForModemStatusChange
+// is taken over by the next call instead of starting another.
+type modemWaiter struct {
+	lock sync.Mutex
+	cur  *modemWait
+}
+
+// control runs fn with the file descriptor of the port. Unlike File.Fd it
+// leaves the descriptor in non-blocking mode, which deadlines rely on.
+func (p *Port) control(fn func(fd uintptr) error) error {
+	rc, err := p.f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ferr error
+	if err := rc.Control(func(fd uintptr) { ferr = fn(fd) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// Sets the deadline for future Read calls and any currently-blocked Read.
+// A zero value for t means Read will not time out, unless the port has a
+// ReadTimeout.
+func (p *Port) SetReadDeadline(t time.Time) error {
+	return p.rd.setDeadline(t, p.f.SetReadDeadline)
+}
+
+// Sets the deadline for future Write calls and any currently-blocked Write.
+func (p *Port) SetWriteDeadline(t time.Time) error {
+	return p.f.SetWriteDeadline(t)
+}
+
+// Sets the read and write deadlines.
+func (p *Port) SetDeadline(t time.Time) error {
+	if err := p.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return p.SetWriteDeadline(t)
+}
+
+// Changes the line settings of the open port, c.Name is ignored.
+func (p *Port) Configure(c *Config) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	if err := p.control(func(fd uintptr) error { return configure(fd, c) }); err != nil {
+		return err
+	}
+	p.rd.setTimeout(c.ReadTimeout)
+	return nil
+}
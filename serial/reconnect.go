@@ -0,0 +1,493 @@
+package serial
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+type PortEventType int
+
+const (
+	PortConnected PortEventType = iota
+	PortDisconnected
+)
+
+func (t PortEventType) String() string {
+	switch t {
+	case PortConnected:
+		return "connected"
+	case PortDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+// PortEvent reports a ReconnectingPort gaining or losing its device.
+type PortEvent struct {
+	Type PortEventType
+	Name string // device node in use
+	Err  error  // why the port was lost, nil for PortConnected
+}
+
+var (
+	ErrDisconnected  = errors.New("Serial port disconnected")
+	ErrDeviceRemoved = errors.New("Serial device removed")
+)
+
+// ReconnectOptions tunes a ReconnectingPort, zero fields take the defaults.
+type ReconnectOptions struct {
+	// When set, the device is looked up with FindPort on every attempt
+	// instead of opening Config.Name, so it is found again after
+	// re-enumerating under another name.
+	Filter PortFilter
+
+	MinBackoff   time.Duration // first retry delay, default 500ms
+	MaxBackoff   time.Duration // retry delay cap, default 30s
+	PollInterval time.Duration // device node check interval, default 1s
+}
+
+// ReconnectingPort is a serial port that survives its device going away.
+// On an I/O error or the removal of the device node it closes the port and
+// reopens it with backoff, reapplying the settings, the deadlines and the
+// last DTR/RTS levels. Read blocks while disconnected, until the read
+// deadline if any; the other calls fail with ErrDisconnected.
+type ReconnectingPort struct {
+	mConfig  Config
+	mOptions ReconnectOptions
+
+	mLock      sync.Mutex
+	mPort      *Port
+	mName      string
+	mConnected chan struct{} // closed while mPort is set
+	mDropped   chan struct{} // closed when mPort is dropped
+	mDTR       *bool
+	mRTS       *bool
+	mRDeadline time.Time
+	mWDeadline time.Time
+	mQueue     []PortEvent // events not delivered yet
+
+	mLost    chan error
+	mEvents  chan PortEvent
+	mQueued  chan struct{} // signals deliverEvents
+	mClosing chan struct{}
+	mDone    chan struct{}
+	mClose   sync.Once
+}
+
+// NewReconnectingPort returns at once and connects in the background, a
+// PortConnected event tells when the device is up. Events queue up until
+// they are received from the channel returned by Events.
+func NewReconnectingPort(c *Config, opts *ReconnectOptions) (*ReconnectingPort, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+
+	r := &ReconnectingPort{
+		mConfig:    *c,
+		mConnected: make(chan struct{}),
+		mLost:      make(chan error, 1),
+		mEvents:    make(chan PortEvent),
+		mQueued:    make(chan struct{}, 1),
+		mClosing:   make(chan struct{}),
+		mDone:      make(chan struct{}),
+	}
+	if opts != nil {
+		r.mOptions = *opts
+	}
+	if r.mOptions.MinBackoff <= 0 {
+		r.mOptions.MinBackoff = time.Millisecond * 500
+	}
+	if r.mOptions.MaxBackoff < r.mOptions.MinBackoff {
+		r.mOptions.MaxBackoff = time.Second * 30
+	}
+	if r.mOptions.PollInterval <= 0 {
+		r.mOptions.PollInterval = time.Second
+	}
+
+	go r.run()
+	go r.deliverEvents()
+	return r, nil
+}
+
+// Events delivers connect and disconnect notifications.
+func (r *ReconnectingPort) Events() <-chan PortEvent {
+	return r.mEvents
+}
+
+// emit queues e, connection state changes are never dropped.
+func (r *ReconnectingPort) emit(e PortEvent) {
+	r.mLock.Lock()
+	r.mQueue = append(r.mQueue, e)
+	r.mLock.Unlock()
+
+	select {
+	case r.mQueued <- struct{}{}:
+	default:
+	}
+}
+
+// deliverEvents sends the queued events in order until Close.
+func (r *ReconnectingPort) deliverEvents() {
+	for {
+		r.mLock.Lock()
+		if len(r.mQueue) == 0 {
+			r.mLock.Unlock()
+			select {
+			case <-r.mQueued:
+				continue
+			case <-r.mDone:
+				return
+			}
+		}
+		e := r.mQueue[0]
+		r.mQueue = r.mQueue[1:]
+		r.mLock.Unlock()
+
+		select {
+		case r.mEvents <- e:
+		case <-r.mDone:
+			return
+		}
+	}
+}
+
+func (r *ReconnectingPort) open() (*Port, string, error) {
+	r.mLock.Lock()
+	c := r.mConfig
+	r.mLock.Unlock()
+	if r.mOptions.Filter != nil {
+		info, err := FindPort(r.mOptions.Filter)
+		if err != nil {
+			return nil, "", err
+		}
+		c.Name = info.Device
+	}
+
+	p, err := openPort(&c)
+	if err != nil {
+		return nil, c.Name, err
+	}
+
+	r.mLock.Lock()
+	defer r.mLock.Unlock()
+	if r.mDTR != nil {
+		p.SetDTR(*r.mDTR)
+	}
+	if r.mRTS != nil {
+		p.SetRTS(*r.mRTS)
+	}
+	if !r.mRDeadline.IsZero() {
+		p.SetReadDeadline(r.mRDeadline)
+	}
+	if !r.mWDeadline.IsZero() {
+		p.SetWriteDeadline(r.mWDeadline)
+	}
+	return p, c.Name, nil
+}
+
+func (r *ReconnectingPort) run() {
+	defer close(r.mDone)
+
+	backoff := r.mOptions.MinBackoff
+	for {
+		p, name, err := r.open()
+		if err != nil {
+			select {
+			case <-time.After(backoff):
+			case <-r.mClosing:
+				return
+			}
+			backoff *= 2
+			if backoff > r.mOptions.MaxBackoff {
+				backoff = r.mOptions.MaxBackoff
+			}
+			continue
+		}
+		backoff = r.mOptions.MinBackoff
+
+		r.mLock.Lock()
+		r.mPort = p
+		r.mName = name
+		r.mDropped = make(chan struct{})
+		close(r.mConnected)
+		r.mLock.Unlock()
+		r.emit(PortEvent{Type: PortConnected, Name: name})
+
+		err = r.watch(name)
+		r.mLock.Lock()
+		r.mPort = nil
+		r.mConnected = make(chan struct{})
+		close(r.mDropped)
+		r.mLock.Unlock()
+		p.Close()
+
+		if err == nil {
+			return
+		}
+		r.emit(PortEvent{Type: PortDisconnected, Name: name, Err: err})
+	}
+}
+
+// watch waits until the port is lost or closed, nil means closed.
+func (r *ReconnectingPort) watch(name string) error {
+	ticker := time.NewTicker(r.mOptions.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-r.mLost:
+			return err
+		case <-ticker.C:
+			if _, err := os.Stat(name); os.IsNotExist(err) {
+				return ErrDeviceRemoved
+			}
+		case <-r.mClosing:
+			return nil
+		}
+	}
+}
+
+// lost reports an I/O error on p, unless p was already replaced.
+func (r *ReconnectingPort) lost(p *Port, err error) {
+	r.mLock.Lock()
+	current := r.mPort == p
+	r.mLock.Unlock()
+	if !current {
+		return
+	}
+
+	select {
+	case r.mLost <- err:
+	default:
+	}
+}
+
+// waitDropped blocks until the lost port p is dropped by run, or Close.
+func (r *ReconnectingPort) waitDropped(p *Port) {
+	r.mLock.Lock()
+	current, dropped := r.mPort == p, r.mDropped
+	r.mLock.Unlock()
+	if !current {
+		return
+	}
+
+	select {
+	case <-dropped:
+	case <-r.mClosing:
+	}
+}
+
+// current waits for a connected port.
+func (r *ReconnectingPort) current(ctx context.Context) (*Port, error) {
+	for {
+		r.mLock.Lock()
+		p, connected := r.mPort, r.mConnected
+		r.mLock.Unlock()
+		if p != nil {
+			return p, nil
+		}
+
+		select {
+		case <-connected:
+		case <-r.mClosing:
+			return nil, ErrPortClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Name returns the device node currently in use, "" while disconnected.
+func (r *ReconnectingPort) Name() string {
+	r.mLock.Lock()
+	defer r.mLock.Unlock()
+	if r.mPort == nil {
+		return ""
+	}
+	return r.mName
+}
+
+// Read blocks across reconnects and only fails once the port is closed or
+// the read deadline passes.
+func (r *ReconnectingPort) Read(b []byte) (int, error) {
+	for {
+		p, err := r.readPort()
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := p.Read(b)
+		if err == nil || isTimeout(err) {
+			return n, err
+		}
+
+		select {
+		case <-r.mClosing:
+			return n, ErrPortClosed
+		default:
+		}
+
+		r.lost(p, err)
+		if n > 0 {
+			return n, nil
+		}
+		// a hung up port fails at once, wait for the next one
+		r.waitDropped(p)
+	}
+}
+
+// readPort waits for a connected port until the read deadline.
+func (r *ReconnectingPort) readPort() (*Port, error) {
+	r.mLock.Lock()
+	deadline := r.mRDeadline
+	r.mLock.Unlock()
+	if deadline.IsZero() {
+		return r.current(context.Background())
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	p, err := r.current(ctx)
+	if err == context.DeadlineExceeded {
+		err = os.ErrDeadlineExceeded
+	}
+	return p, err
+}
+
+func (r *ReconnectingPort) Write(b []byte) (int, error) {
+	r.mLock.Lock()
+	p := r.mPort
+	r.mLock.Unlock()
+	if p == nil {
+		return 0, ErrDisconnected
+	}
+
+	n, err := p.Write(b)
+	if err != nil && !isTimeout(err) {
+		r.lost(p, err)
+	}
+	return n, err
+}
+
+// Close stops reconnecting and closes the port.
+func (r *ReconnectingPort) Close() error {
+	r.mClose.Do(func() {
+		close(r.mClosing)
+	})
+	<-r.mDone
+	return nil
+}
+
+// Sets DTR now and after every reconnect
+func (r *ReconnectingPort) SetDTR(on bool) error {
+	r.mLock.Lock()
+	r.mDTR = &on
+	p := r.mPort
+	r.mLock.Unlock()
+	if p == nil {
+		return ErrDisconnected
+	}
+	return p.SetDTR(on)
+}
+
+// Sets RTS now and after every reconnect
+func (r *ReconnectingPort) SetRTS(on bool) error {
+	r.mLock.Lock()
+	r.mRTS = &on
+	p := r.mPort
+	r.mLock.Unlock()
+	if p == nil {
+		return ErrDisconnected
+	}
+	return p.SetRTS(on)
+}
+
+func (r *ReconnectingPort) GetModemStatus() (ModemStatus, error) {
+	p := r.port()
+	if p == nil {
+		return ModemStatus{}, ErrDisconnected
+	}
+	return p.GetModemStatus()
+}
+
+func (r *ReconnectingPort) WaitForModemStatusChange(ctx context.Context) (ModemStatus, error) {
+	p, err := r.current(ctx)
+	if err != nil {
+		return ModemStatus{}, err
+	}
+	return p.WaitForModemStatusChange(ctx)
+}
+
+// port returns the connected port, nil while disconnected.
+func (r *ReconnectingPort) port() *Port {
+	r.mLock.Lock()
+	defer r.mLock.Unlock()
+	return r.mPort
+}
+
+// Changes the line settings now and for every reconnect, c.Name is
+// ignored.
+func (r *ReconnectingPort) Configure(c *Config) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	r.mLock.Lock()
+	name := r.mConfig.Name
+	r.mConfig = *c
+	r.mConfig.Name = name
+	p := r.mPort
+	r.mLock.Unlock()
+	if p == nil {
+		return ErrDisconnected
+	}
+	return p.Configure(c)
+}
+
+// Sets the read deadline now and for every reconnect, it also ends a Read
+// waiting for the device.
+func (r *ReconnectingPort) SetReadDeadline(t time.Time) error {
+	r.mLock.Lock()
+	r.mRDeadline = t
+	p := r.mPort
+	r.mLock.Unlock()
+	if p == nil {
+		return nil
+	}
+	return p.SetReadDeadline(t)
+}
+
+// Sets the write deadline now and for every reconnect.
+func (r *ReconnectingPort) SetWriteDeadline(t time.Time) error {
+	r.mLock.Lock()
+	r.mWDeadline = t
+	p := r.mPort
+	r.mLock.Unlock()
+	if p == nil {
+		return nil
+	}
+	return p.SetWriteDeadline(t)
+}
+
+func (r *ReconnectingPort) SendBreak(d time.Duration) error {
+	p := r.port()
+	if p == nil {
+		return ErrDisconnected
+	}
+	if b, ok := interface{}(p).(BreakSender); ok {
+		return b.SendBreak(d)
+	}
+	return ErrNotSupported
+}
+
+func (r *ReconnectingPort) SetBreak(on bool) error {
+	p := r.port()
+	if p == nil {
+		return ErrDisconnected
+	}
+	if b, ok := interface{}(p).(BreakSetter); ok {
+		return b.SetBreak(on)
+	}
+	return ErrNotSupported
+}
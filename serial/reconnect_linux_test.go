@@ -0,0 +1,193 @@
+package serial
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/xiqingping/golibs/serial/virtual"
+)
+
+// plugDevice is a device node, a symlink to a pty that is swapped for a
+// new one on every plug.
+type plugDevice struct {
+	t    *testing.T
+	name string
+	pair *virtual.Pair
+}
+
+func newPlugDevice(t *testing.T) *plugDevice {
+	d := &plugDevice{t: t, name: filepath.Join(t.TempDir(), "ttyTEST")}
+	t.Cleanup(func() {
+		if d.pair != nil {
+			d.pair.Close()
+		}
+	})
+	d.plug()
+	return d
+}
+
+func (d *plugDevice) plug() {
+	pair, err := virtual.OpenPair()
+	if err != nil {
+		d.t.Skip("no pty:", err)
+	}
+	os.Remove(d.name)
+	if err := os.Symlink(pair.Name(), d.name); err != nil {
+		d.t.Fatal(err)
+	}
+	d.pair = pair
+}
+
+func (d *plugDevice) unplug() {
+	d.pair.Hangup()
+}
+
+func newTestReconnectingPort(t *testing.T, d *plugDevice) *ReconnectingPort {
+	r, err := NewReconnectingPort(&Config{Name: d.name, Baud: 115200}, &ReconnectOptions{
+		MinBackoff:   10 * time.Millisecond,
+		MaxBackoff:   50 * time.Millisecond,
+		PollInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timeout waiting for " + what)
+		}
+	}
+}
+
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// Read waits for the device to come back instead of spinning on the hung
+// up port.
+func TestReconnectReadBlocks(t *testing.T) {
+	d := newPlugDevice(t)
+	r := newTestReconnectingPort(t, d)
+	waitFor(t, "connect", func() bool { return r.Name() != "" })
+
+	type result struct {
+		data string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		b := make([]byte, 16)
+		n, err := r.Read(b)
+		done <- result{string(b[:n]), err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the pty node is gone until plug below
+	d.unplug()
+	waitFor(t, "disconnect", func() bool { return r.Name() == "" })
+	start := cpuTime()
+	time.Sleep(300 * time.Millisecond)
+	if used := cpuTime() - start; used > 100*time.Millisecond {
+		t.Fatalf("%v of CPU used while disconnected", used)
+	}
+
+	d.plug()
+	waitFor(t, "reconnect", func() bool { return r.Name() != "" })
+	d.pair.Write([]byte("OK"))
+
+	select {
+	case res := <-done:
+		if res.err != nil || res.data != "OK" {
+			t.Fatalf("Read = %q, %v", res.data, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read blocked after reconnect")
+	}
+}
+
+// Connection events are kept for a slow receiver.
+func TestReconnectEventsQueued(t *testing.T) {
+	d := newPlugDevice(t)
+	r := newTestReconnectingPort(t, d)
+
+	const cycles = 12
+	for i := 0; i < cycles; i++ {
+		waitFor(t, "connect", func() bool { return r.Name() != "" })
+		d.unplug()
+		waitFor(t, "disconnect", func() bool { return r.Name() == "" })
+		d.plug()
+	}
+	waitFor(t, "connect", func() bool { return r.Name() != "" })
+
+	for i := 0; i < 2*cycles+1; i++ {
+		want := PortConnected
+		if i%2 == 1 {
+			want = PortDisconnected
+		}
+		select {
+		case e := <-r.Events():
+			if e.Type != want || e.Name != d.name {
+				t.Fatalf("event %d: %v %s, want %v", i, e.Type, e.Name, want)
+			}
+			if want == PortDisconnected && e.Err == nil {
+				t.Fatalf("event %d: no error", i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d missing", i)
+		}
+	}
+}
+
+// Calls that can't wait for the device fail at once while disconnected,
+// settings made meanwhile apply after the reconnect.
+func TestReconnectDisconnectedCalls(t *testing.T) {
+	d := newPlugDevice(t)
+	r := newTestReconnectingPort(t, d)
+	waitFor(t, "connect", func() bool { return r.Name() != "" })
+	d.unplug()
+	waitFor(t, "disconnect", func() bool { return r.Name() == "" })
+
+	if _, err := r.GetModemStatus(); err != ErrDisconnected {
+		t.Fatalf("GetModemStatus error %v", err)
+	}
+	if err := r.SendBreak(time.Millisecond); err != ErrDisconnected {
+		t.Fatalf("SendBreak error %v", err)
+	}
+	if err := r.SetBreak(false); err != ErrDisconnected {
+		t.Fatalf("SetBreak error %v", err)
+	}
+	if err := r.Configure(&Config{Baud: 9600}); err != ErrDisconnected {
+		t.Fatalf("Configure error %v", err)
+	}
+
+	// the read deadline ends a Read waiting for the device
+	if err := r.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 16)); !os.IsTimeout(err) {
+		t.Fatalf("Read error %v", err)
+	}
+	r.SetReadDeadline(time.Time{})
+
+	d.plug()
+	waitFor(t, "reconnect", func() bool { return r.Name() != "" })
+	if err := r.SendBreak(time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	r.mLock.Lock()
+	c := r.mConfig
+	r.mLock.Unlock()
+	if c.Baud != 9600 || c.Name != d.name {
+		t.Fatalf("config %+v", c)
+	}
+}
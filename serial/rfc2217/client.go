@@ -0,0 +1,586 @@
+/*
+Package rfc2217 implements RFC 2217, the Telnet Com Port Control Option,
+to use serial ports over the network. Importing it lets serial open ports
+named rfc2217://host:port:
+
+	import _ "github.com/xiqingping/golibs/serial/rfc2217"
+
+	port, err := serial.NewSerialPort("rfc2217://rack1:4001", 115200)
+
+The Server exports a local port to such clients, or to raw TCP clients
+(socket://host:port) when Raw is set.
+*/
+package rfc2217
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/xiqingping/golibs/serial"
+)
+
+func init() {
+	serial.RegisterScheme("rfc2217", func(c *serial.Config) (io.ReadWriteCloser, error) {
+		p, err := Open(c)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	})
+}
+
+// How long the client waits for the server to acknowledge a request.
+var DefaultTimeout = time.Second * 3
+
+// Receive buffer limits: the server is asked to suspend sending once
+// bufferHigh bytes are unread and to resume below bufferLow. The connection
+// isn't read at all while bufferMax bytes are unread.
+const (
+	bufferHigh = 64 * 1024
+	bufferLow  = 16 * 1024
+	bufferMax  = 256 * 1024
+)
+
+var (
+	ErrRefused = errors.New("Server refused the COM port option")
+	ErrTimeout = errors.New("Server response timeout")
+)
+
+// Client is a serial port on an RFC 2217 server. It implements the
+// serial.Configurer, serial.ModemLines, serial.BreakSender,
+// serial.BreakSetter and serial.Deadliner interfaces.
+type Client struct {
+	conn        net.Conn
+	timeout     time.Duration
+	readTimeout time.Duration
+
+	wlock   sync.Mutex
+	reqLock sync.Mutex // one acknowledged request at a time
+
+	lock          sync.Mutex
+	cond          *sync.Cond
+	buf           []byte
+	err           error // why the connection ended
+	comPort       int   // 1 accepted, -1 refused by the server
+	acks          map[byte][]byte
+	ackCount      map[byte]int
+	modem         byte
+	modemCount    int
+	suspended     bool // server sent FLOWCONTROL-SUSPEND
+	rxSuspended   bool // FLOWCONTROL-SUSPEND sent to the server
+	high, low     int  // receive buffer watermarks
+	max           int
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	signature     string
+}
+
+// Open connects to the server named by c.Name, rfc2217://host:port, and
+// applies the line settings of c. A timeout query parameter such as
+// ?timeout=5s overrides DefaultTimeout.
+func Open(c *serial.Config) (*Client, error) {
+	u, err := url.Parse(c.Name)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("No server address in \"%s\"", c.Name)
+	}
+
+	timeout := DefaultTimeout
+	if t := u.Query().Get("timeout"); t != "" {
+		if timeout, err = time.ParseDuration(t); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", u.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	p := NewClient(conn, timeout)
+	if err := p.negotiate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := p.Configure(c); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := p.request(SET_MODEMSTATE_MASK, []byte{0xff}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// NewClient runs the protocol on an established connection, the caller
+// then configures the port with Configure.
+func NewClient(conn net.Conn, timeout time.Duration) *Client {
+	p := &Client{
+		conn:     conn,
+		timeout:  timeout,
+		acks:     map[byte][]byte{},
+		ackCount: map[byte]int{},
+		high:     bufferHigh,
+		low:      bufferLow,
+		max:      bufferMax,
+	}
+	p.cond = sync.NewCond(&p.lock)
+	go p.readThread()
+	return p
+}
+
+func (p *Client) send(b []byte) error {
+	p.wlock.Lock()
+	defer p.wlock.Unlock()
+	_, err := p.conn.Write(b)
+	return err
+}
+
+// negotiate asks for binary mode and the COM port option.
+func (p *Client) negotiate() error {
+	var b []byte
+	b = append(b, command(WILL, OPT_BINARY)...)
+	b = append(b, command(DO, OPT_BINARY)...)
+	b = append(b, command(WILL, OPT_SGA)...)
+	b = append(b, command(DO, OPT_SGA)...)
+	b = append(b, command(WILL, OPT_COM_PORT)...)
+	if err := p.send(b); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.wait(time.Now().Add(p.timeout), func() bool { return p.comPort != 0 }); err != nil {
+		if err == os.ErrDeadlineExceeded {
+			return ErrTimeout
+		}
+		return err
+	}
+	if p.comPort < 0 {
+		return ErrRefused
+	}
+	return nil
+}
+
+// wait blocks until done returns true, the connection ends or the
+// deadline passes, p.lock held.
+func (p *Client) wait(deadline time.Time, done func() bool) error {
+	for !done() {
+		if p.err != nil {
+			return p.err
+		}
+		if deadline.IsZero() {
+			p.cond.Wait()
+			continue
+		}
+
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.AfterFunc(d, p.wakeup)
+		p.cond.Wait()
+		t.Stop()
+	}
+	return nil
+}
+
+func (p *Client) wakeup() {
+	p.lock.Lock()
+	p.cond.Broadcast()
+	p.lock.Unlock()
+}
+
+// request sends a COM port subcommand and returns the value the server
+// acknowledged it with.
+func (p *Client) request(cmd byte, value []byte) ([]byte, error) {
+	p.reqLock.Lock()
+	defer p.reqLock.Unlock()
+
+	p.lock.Lock()
+	count := p.ackCount[cmd]
+	p.lock.Unlock()
+
+	if err := p.send(subnegotiation(cmd, value)); err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	err := p.wait(time.Now().Add(p.timeout), func() bool { return p.ackCount[cmd] != count })
+	if err == os.ErrDeadlineExceeded {
+		return nil, ErrTimeout
+	}
+	return p.acks[cmd], err
+}
+
+func (p *Client) readThread() {
+	var d decoder
+	b := make([]byte, 4096)
+	for {
+		p.lock.Lock()
+		for len(p.buf) >= p.max && !p.closed {
+			p.cond.Wait()
+		}
+		p.lock.Unlock()
+
+		n, err := p.conn.Read(b)
+
+		var replies []byte
+		p.lock.Lock()
+		p.buf = d.feed(b[:n], p.buf, func(cmd, opt byte) {
+			replies = append(replies, p.onCommand(cmd, opt)...)
+		}, p.onSub)
+		if err != nil {
+			p.err = err
+		}
+		if len(p.buf) >= p.high && !p.rxSuspended && p.err == nil {
+			p.rxSuspended = true
+			replies = append(replies, subnegotiation(FLOWCONTROL_SUSPEND, nil)...)
+		}
+		p.cond.Broadcast()
+		p.lock.Unlock()
+
+		if len(replies) > 0 {
+			p.send(replies)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// onCommand answers the option requests of the server, p.lock held.
+func (p *Client) onCommand(cmd, opt byte) []byte {
+	switch cmd {
+	case DO:
+		switch opt {
+		case OPT_COM_PORT:
+			p.comPort = 1
+		case OPT_BINARY, OPT_SGA:
+		default:
+			return command(WONT, opt)
+		}
+	case DONT:
+		if opt == OPT_COM_PORT {
+			p.comPort = -1
+		}
+	case WILL:
+		switch opt {
+		case OPT_BINARY, OPT_SGA:
+		default:
+			return command(DONT, opt)
+		}
+	}
+	return nil
+}
+
+// onSub handles the COM port notifications and acknowledgements, p.lock
+// held.
+func (p *Client) onSub(sb []byte) {
+	if len(sb) < 2 || sb[0] != OPT_COM_PORT || sb[1] < SERVER_OFFSET {
+		return
+	}
+	cmd := sb[1] - SERVER_OFFSET
+	value := append([]byte(nil), sb[2:]...)
+
+	switch cmd {
+	case NOTIFY_MODEMSTATE:
+		if len(value) > 0 {
+			p.modem = value[0]
+			p.modemCount++
+		}
+	case NOTIFY_LINESTATE:
+	case FLOWCONTROL_SUSPEND:
+		p.suspended = true
+	case FLOWCONTROL_RESUME:
+		p.suspended = false
+	case SIGNATURE:
+		p.signature = string(value)
+		fallthrough
+	default:
+		p.acks[cmd] = value
+		p.ackCount[cmd]++
+	}
+}
+
+func (p *Client) Read(b []byte) (int, error) {
+	n, resume, err := p.read(b)
+	if resume {
+		p.send(subnegotiation(FLOWCONTROL_RESUME, nil))
+	}
+	return n, err
+}
+
+// read takes the received data and reports whether the server has to be
+// asked to resume sending.
+func (p *Client) read(b []byte) (int, bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	deadline := p.readDeadline
+	if p.readTimeout > 0 {
+		if t := time.Now().Add(p.readTimeout); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+
+	// a deadline change wakes the wait up, which picks the new one
+	for len(p.buf) == 0 {
+		if err := p.wait(deadline, func() bool { return len(p.buf) > 0 || !p.readDeadline.Equal(deadline) }); err != nil {
+			return 0, false, err
+		}
+		if len(p.buf) == 0 {
+			deadline = p.readDeadline
+		}
+	}
+
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	if len(p.buf) == 0 {
+		p.buf = nil
+	}
+	p.cond.Broadcast()
+
+	resume := p.rxSuspended && len(p.buf) <= p.low
+	if resume {
+		p.rxSuspended = false
+	}
+	return n, resume, nil
+}
+
+func (p *Client) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	err := p.wait(p.writeDeadline, func() bool { return !p.suspended })
+	p.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := p.send(escape(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *Client) Close() error {
+	p.lock.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.lock.Unlock()
+	return p.conn.Close()
+}
+
+func (p *Client) SetReadDeadline(t time.Time) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.readDeadline = t
+	p.cond.Broadcast()
+	return nil
+}
+
+func (p *Client) SetWriteDeadline(t time.Time) error {
+	p.lock.Lock()
+	p.writeDeadline = t
+	p.cond.Broadcast()
+	p.lock.Unlock()
+	return p.conn.SetWriteDeadline(t)
+}
+
+// Signature asks the server for its description.
+func (p *Client) Signature() (string, error) {
+	v, err := p.request(SIGNATURE, nil)
+	return string(v), err
+}
+
+// Configure sends the line settings of c to the server, c.Name is
+// ignored.
+func (p *Client) Configure(c *serial.Config) error {
+	if c.RS485 != nil {
+		return fmt.Errorf("RS-485 mode - %v", serial.ErrNotSupported)
+	}
+
+	baud := make([]byte, 4)
+	binary.BigEndian.PutUint32(baud, uint32(c.Baud))
+	v, err := p.request(SET_BAUDRATE, baud)
+	if err != nil {
+		return err
+	}
+	if len(v) != 4 || binary.BigEndian.Uint32(v) != uint32(c.Baud) {
+		return fmt.Errorf("Server refused baud rate %d", c.Baud)
+	}
+
+	bits := c.DataBits
+	if bits == 0 {
+		bits = 8
+	}
+	parity := map[serial.Parity]byte{
+		serial.ParityNone:  PARITY_NONE,
+		serial.ParityOdd:   PARITY_ODD,
+		serial.ParityEven:  PARITY_EVEN,
+		serial.ParityMark:  PARITY_MARK,
+		serial.ParitySpace: PARITY_SPACE,
+	}[c.Parity]
+	stop := map[serial.StopBits]byte{
+		serial.StopBits1:     STOPSIZE_1,
+		serial.StopBits1Half: STOPSIZE_1_5,
+		serial.StopBits2:     STOPSIZE_2,
+	}[c.StopBits]
+	flow := CONTROL_FLOW_NONE
+	if c.RTSCTS {
+		flow = CONTROL_FLOW_HARDWARE
+	} else if c.XONXOFF {
+		flow = CONTROL_FLOW_XONXOFF
+	}
+
+	for _, s := range []struct {
+		cmd, value byte
+		what       string
+	}{
+		{SET_DATASIZE, byte(bits), "data size"},
+		{SET_PARITY, parity, "parity"},
+		{SET_STOPSIZE, stop, "stop size"},
+		{SET_CONTROL, flow, "flow control"},
+	} {
+		v, err := p.request(s.cmd, []byte{s.value})
+		if err != nil {
+			return err
+		}
+		if len(v) != 1 || v[0] != s.value {
+			return fmt.Errorf("Server refused %s %d", s.what, s.value)
+		}
+	}
+
+	p.lock.Lock()
+	p.readTimeout = c.ReadTimeout
+	p.lock.Unlock()
+	return nil
+}
+
+func (p *Client) control(value byte) error {
+	v, err := p.request(SET_CONTROL, []byte{value})
+	if err != nil {
+		return err
+	}
+	if len(v) != 1 || v[0] != value {
+		return fmt.Errorf("Server refused control %d", value)
+	}
+	return nil
+}
+
+func (p *Client) SetDTR(on bool) error {
+	if on {
+		return p.control(CONTROL_DTR_ON)
+	}
+	return p.control(CONTROL_DTR_OFF)
+}
+
+func (p *Client) SetRTS(on bool) error {
+	if on {
+		return p.control(CONTROL_RTS_ON)
+	}
+	return p.control(CONTROL_RTS_OFF)
+}
+
+func modemStatus(state byte) serial.ModemStatus {
+	return serial.ModemStatus{
+		CTS: state&MODEM_CTS != 0,
+		DSR: state&MODEM_DSR != 0,
+		DCD: state&MODEM_DCD != 0,
+		RI:  state&MODEM_RI != 0,
+	}
+}
+
+// GetModemStatus returns the state last notified by the server.
+func (p *Client) GetModemStatus() (serial.ModemStatus, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err != nil {
+		return serial.ModemStatus{}, p.err
+	}
+	return modemStatus(p.modem), nil
+}
+
+func (p *Client) WaitForModemStatusChange(ctx context.Context) (serial.ModemStatus, error) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.wakeup()
+		case <-stop:
+		}
+	}()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	before := modemStatus(p.modem)
+	for {
+		count := p.modemCount
+		err := p.wait(time.Time{}, func() bool { return p.modemCount != count || ctx.Err() != nil })
+		if err != nil {
+			return serial.ModemStatus{}, err
+		}
+		if err := ctx.Err(); err != nil {
+			return serial.ModemStatus{}, err
+		}
+		if s := modemStatus(p.modem); s != before {
+			return s, nil
+		}
+	}
+}
+
+// SendBreak holds the line in the BREAK condition for d.
+func (p *Client) SendBreak(d time.Duration) error {
+	if err := p.SetBreak(true); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return p.SetBreak(false)
+}
+
+// SetBreak sets or clears the BREAK condition.
+func (p *Client) SetBreak(on bool) error {
+	if on {
+		return p.control(CONTROL_BREAK_ON)
+	}
+	return p.control(CONTROL_BREAK_OFF)
+}
+
+// Flush discards the data buffered by the server port and by the client.
+func (p *Client) Flush() error {
+	// a full buffer stops the acknowledgement from being read
+	p.discard()
+	if _, err := p.request(PURGE_DATA, []byte{PURGE_BOTH}); err != nil {
+		return err
+	}
+	p.discard()
+	return nil
+}
+
+// discard drops the received data, resuming the server if it was
+// suspended.
+func (p *Client) discard() {
+	p.lock.Lock()
+	p.buf = nil
+	p.cond.Broadcast()
+	resume := p.rxSuspended
+	p.rxSuspended = false
+	p.lock.Unlock()
+
+	if resume {
+		p.send(subnegotiation(FLOWCONTROL_RESUME, nil))
+	}
+}
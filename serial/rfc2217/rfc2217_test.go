@@ -0,0 +1,359 @@
+package rfc2217
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xiqingping/golibs/serial"
+)
+
+// fakePort is the local port of the server. What the test writes to dev
+// is read by the server, what the server writes is kept in written.
+type fakePort struct {
+	in  *io.PipeReader
+	dev *io.PipeWriter
+
+	lock    sync.Mutex
+	written []byte
+	config  serial.Config
+	dtr     bool
+	rts     bool
+	brk     bool
+	breaks  []time.Duration
+	status  serial.ModemStatus
+	changed chan struct{} // closed and renewed on every status change
+}
+
+func newFakePort() *fakePort {
+	r, w := io.Pipe()
+	return &fakePort{in: r, dev: w, dtr: true, rts: true, changed: make(chan struct{})}
+}
+
+func (p *fakePort) Read(b []byte) (int, error) {
+	return p.in.Read(b)
+}
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.written = append(p.written, b...)
+	return len(b), nil
+}
+
+func (p *fakePort) Configure(c *serial.Config) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.config = *c
+	return nil
+}
+
+func (p *fakePort) SetDTR(on bool) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.dtr = on
+	return nil
+}
+
+func (p *fakePort) SetRTS(on bool) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.rts = on
+	return nil
+}
+
+func (p *fakePort) GetModemStatus() (serial.ModemStatus, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.status, nil
+}
+
+func (p *fakePort) WaitForModemStatusChange(ctx context.Context) (serial.ModemStatus, error) {
+	p.lock.Lock()
+	changed := p.changed
+	p.lock.Unlock()
+
+	select {
+	case <-changed:
+		return p.GetModemStatus()
+	case <-ctx.Done():
+		return serial.ModemStatus{}, ctx.Err()
+	}
+}
+
+func (p *fakePort) setStatus(s serial.ModemStatus) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.status = s
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// state returns a snapshot of the port under its lock.
+func (p *fakePort) state() fakePort {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return fakePort{
+		written: append([]byte(nil), p.written...),
+		config:  p.config,
+		dtr:     p.dtr,
+		rts:     p.rts,
+		brk:     p.brk,
+		breaks:  append([]time.Duration(nil), p.breaks...),
+	}
+}
+
+// breakPort can hold the BREAK condition.
+type breakPort struct{ *fakePort }
+
+func (p breakPort) SetBreak(on bool) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.brk = on
+	return nil
+}
+
+// timedBreakPort can only send a BREAK of a given length.
+type timedBreakPort struct{ *fakePort }
+
+func (p timedBreakPort) SendBreak(d time.Duration) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.breaks = append(p.breaks, d)
+	return nil
+}
+
+// serve exports port on a local address and connects a client to it.
+func serve(t *testing.T, port io.ReadWriter, dev io.Closer) *Client {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewServer(port, &serial.Config{Baud: 9600}).Serve(l)
+
+	c, err := Open(&serial.Config{Name: "rfc2217://" + l.Addr().String(), Baud: 9600})
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		l.Close()
+		dev.Close()
+	})
+	return c
+}
+
+// waitUntil polls cond until it is true.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timeout waiting for " + what)
+		}
+	}
+}
+
+func TestLoopbackData(t *testing.T) {
+	p := newFakePort()
+	c := serve(t, p, p.dev)
+
+	// IAC is escaped on the wire
+	out := []byte("AT\xff\r")
+	if _, err := c.Write(out); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "port data", func() bool { return string(p.state().written) == string(out) })
+
+	in := []byte("OK\xff\xff\r\n")
+	go p.dev.Write(in)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := []byte{}
+	buf := make([]byte, 16)
+	for len(got) < len(in) {
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != string(in) {
+		t.Fatalf("read %q, want %q", got, in)
+	}
+}
+
+func TestLoopbackSettings(t *testing.T) {
+	p := newFakePort()
+	c := serve(t, p, p.dev)
+
+	want := serial.Config{
+		Baud:     57600,
+		DataBits: 7,
+		Parity:   serial.ParityEven,
+		StopBits: serial.StopBits2,
+		RTSCTS:   true,
+	}
+	if err := c.Configure(&want); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.state().config; got != want {
+		t.Fatalf("port config %+v, want %+v", got, want)
+	}
+
+	if err := c.SetDTR(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetRTS(false); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.state(); s.dtr || s.rts {
+		t.Fatalf("DTR %v, RTS %v", s.dtr, s.rts)
+	}
+
+	if sig, err := c.Signature(); err != nil || sig != ServerSignature {
+		t.Fatalf("Signature = %q, %v", sig, err)
+	}
+}
+
+func TestLoopbackModemStatus(t *testing.T) {
+	p := newFakePort()
+	c := serve(t, p, p.dev)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.setStatus(serial.ModemStatus{CTS: true, DCD: true})
+	}()
+	s, err := c.WaitForModemStatusChange(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != (serial.ModemStatus{CTS: true, DCD: true}) {
+		t.Fatalf("status %+v", s)
+	}
+}
+
+func TestLoopbackBreak(t *testing.T) {
+	p := newFakePort()
+	c := serve(t, breakPort{p}, p.dev)
+
+	if err := c.SetBreak(true); err != nil {
+		t.Fatal(err)
+	}
+	if !p.state().brk {
+		t.Fatal("BREAK not asserted on BREAK-ON")
+	}
+	if err := c.SetBreak(false); err != nil {
+		t.Fatal(err)
+	}
+	if p.state().brk {
+		t.Fatal("BREAK not cleared on BREAK-OFF")
+	}
+
+	// the server clears a BREAK left on by a client going away
+	if err := c.SetBreak(true); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	waitUntil(t, "BREAK cleared", func() bool { return !p.state().brk })
+}
+
+func TestLoopbackTimedBreak(t *testing.T) {
+	p := newFakePort()
+	c := serve(t, timedBreakPort{p}, p.dev)
+
+	if err := c.SendBreak(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	breaks := p.state().breaks
+	if len(breaks) != 1 || breaks[0] < 50*time.Millisecond {
+		t.Fatalf("breaks sent %v", breaks)
+	}
+}
+
+// readN reads n bytes from c.
+func readN(t *testing.T, c *Client, n int) []byte {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := []byte{}
+	buf := make([]byte, 4096)
+	for len(got) < n {
+		m, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("read %d of %d bytes: %v", len(got), n, err)
+		}
+		got = append(got, buf[:m]...)
+	}
+	return got
+}
+
+func TestLoopbackSuspend(t *testing.T) {
+	p := newFakePort()
+	c := serve(t, p, p.dev)
+
+	if err := c.send(subnegotiation(FLOWCONTROL_SUSPEND, nil)); err != nil {
+		t.Fatal(err)
+	}
+	// requests are served in order, the suspension is in effect once
+	// the signature comes back
+	if _, err := c.Signature(); err != nil {
+		t.Fatal(err)
+	}
+
+	in := []byte{}
+	for i := 0; i < 3*4096; i++ {
+		in = append(in, byte(i))
+	}
+	go p.dev.Write(in)
+
+	time.Sleep(100 * time.Millisecond)
+	c.lock.Lock()
+	n := len(c.buf)
+	c.lock.Unlock()
+	if n != 0 {
+		t.Fatalf("%d bytes received while suspended", n)
+	}
+
+	if err := c.send(subnegotiation(FLOWCONTROL_RESUME, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readN(t, c, len(in)); string(got) != string(in) {
+		t.Fatalf("read %d bytes differing from the %d written", len(got), len(in))
+	}
+}
+
+func TestLoopbackClientFlowControl(t *testing.T) {
+	p := newFakePort()
+	c := serve(t, p, p.dev)
+	c.lock.Lock()
+	c.high, c.low, c.max = 8*1024, 2*1024, 16*1024
+	c.lock.Unlock()
+
+	in := []byte{}
+	for i := 0; i < 256*1024; i++ {
+		in = append(in, byte(i*7))
+	}
+	go p.dev.Write(in)
+
+	// nobody reads, the client suspends the server and stops buffering
+	waitUntil(t, "suspension", func() bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.rxSuspended
+	})
+	time.Sleep(100 * time.Millisecond)
+	c.lock.Lock()
+	n := len(c.buf)
+	c.lock.Unlock()
+	if n > 16*1024+4096 {
+		t.Fatalf("%d bytes buffered, limit %d", n, 16*1024)
+	}
+
+	if got := readN(t, c, len(in)); string(got) != string(in) {
+		t.Fatalf("read %d bytes differing from the %d written", len(got), len(in))
+	}
+}
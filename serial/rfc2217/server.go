@@ -0,0 +1,496 @@
+package rfc2217
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xiqingping/golibs/serial"
+)
+
+var ErrBusy = errors.New("Port in use by another client")
+
+// Description sent in answer to a SIGNATURE request.
+var ServerSignature = "golibs rfc2217"
+
+// How long a new client waits for the previous one to leave before it is
+// refused, covering clients that reconnect at once.
+var BusyWait = time.Second
+
+/*
+Server exports a port to one network client at a time. Settings, modem
+lines, break and purge requests are applied to the port through the
+serial.Configurer, serial.ModemLines, serial.BreakSetter and
+serial.BreakSender interfaces when it implements them, a *serial.SerialPort
+does. Modem status changes are notified to the client.
+
+BREAK is held for as long as the client holds it. Ports that can only send
+a timed BREAK send it when the client ends it, for as long as it lasted.
+*/
+type Server struct {
+	// Raw serves plain TCP without telnet, for socket:// clients.
+	Raw bool
+
+	port io.ReadWriter
+	slot chan struct{} // held by the connected client
+
+	startOnce sync.Once
+	lock      sync.Mutex
+	resumed   *sync.Cond // a client resumed or left
+	config    serial.Config
+	dtr, rts  bool
+	client    *serverConn
+}
+
+// NewServer exports port, which was opened with the settings c.
+func NewServer(port io.ReadWriter, c *serial.Config) *Server {
+	s := &Server{port: port, slot: make(chan struct{}, 1), dtr: true, rts: true}
+	s.resumed = sync.NewCond(&s.lock)
+	if c != nil {
+		s.config = *c
+	}
+	if s.config.DataBits == 0 {
+		s.config.DataBits = 8
+	}
+	return s
+}
+
+// Serve accepts clients on l until it fails. A client connecting while
+// another one is served is disconnected after BusyWait.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+type serverConn struct {
+	conn      net.Conn
+	wlock     sync.Mutex
+	suspended bool // client sent FLOWCONTROL-SUSPEND
+	modemMask byte
+	breakOn   time.Time
+	breakSet  bool // BREAK asserted on the port
+}
+
+func (c *serverConn) send(b []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// ServeConn serves one client until it disconnects, then closes conn.
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	select {
+	case s.slot <- struct{}{}:
+	case <-time.After(BusyWait):
+		return ErrBusy
+	}
+
+	c := &serverConn{conn: conn, modemMask: 0xff}
+	s.lock.Lock()
+	s.client = c
+	s.lock.Unlock()
+
+	defer func() {
+		s.breakControl(c, CONTROL_BREAK_OFF)
+		s.lock.Lock()
+		s.client = nil
+		s.resumed.Broadcast()
+		s.lock.Unlock()
+		<-s.slot
+	}()
+
+	s.startOnce.Do(func() { go s.portThread() })
+
+	if !s.Raw {
+		var b []byte
+		b = append(b, command(WILL, OPT_BINARY)...)
+		b = append(b, command(DO, OPT_BINARY)...)
+		b = append(b, command(WILL, OPT_SGA)...)
+		b = append(b, command(DO, OPT_SGA)...)
+		b = append(b, command(DO, OPT_COM_PORT)...)
+		if err := c.send(b); err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go s.modemThread(ctx, c)
+	}
+
+	var d decoder
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		data := buf[:n]
+		if !s.Raw {
+			var replies []byte
+			data = d.feed(data, nil, func(cmd, opt byte) {
+				replies = append(replies, s.onCommand(cmd, opt)...)
+			}, func(sb []byte) {
+				replies = append(replies, s.onSub(c, sb)...)
+			})
+			if len(replies) > 0 {
+				if err := c.send(replies); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(data) > 0 {
+			if _, err := s.port.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// portThread forwards the port input to the current client, dropping it
+// while nobody is connected. The port isn't read while the client has
+// suspended the flow.
+func (s *Server) portThread() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.port.Read(buf)
+		if n > 0 {
+			s.lock.Lock()
+			for s.client != nil && s.client.suspended {
+				s.resumed.Wait()
+			}
+			c := s.client
+			s.lock.Unlock()
+
+			if c != nil {
+				data := buf[:n]
+				if !s.Raw {
+					data = escape(data)
+				}
+				c.send(data)
+			}
+		}
+		if err != nil {
+			if t, ok := err.(interface{ Timeout() bool }); ok && t.Timeout() {
+				continue
+			}
+
+			s.lock.Lock()
+			if s.client != nil {
+				s.client.conn.Close()
+			}
+			s.lock.Unlock()
+			return
+		}
+	}
+}
+
+// modemThread notifies the client of the modem status.
+func (s *Server) modemThread(ctx context.Context, c *serverConn) {
+	m, ok := s.port.(serial.ModemLines)
+	if !ok {
+		return
+	}
+
+	st, err := m.GetModemStatus()
+	if err != nil {
+		return
+	}
+	last := modemState(st, st)
+	c.send(subnegotiation(NOTIFY_MODEMSTATE+SERVER_OFFSET, []byte{last}))
+
+	for {
+		ns, err := m.WaitForModemStatusChange(ctx)
+		if err != nil {
+			return
+		}
+
+		state := modemState(st, ns)
+		st = ns
+		s.lock.Lock()
+		mask := c.modemMask
+		s.lock.Unlock()
+		if state&mask != 0 {
+			c.send(subnegotiation(NOTIFY_MODEMSTATE+SERVER_OFFSET, []byte{state & mask}))
+		}
+	}
+}
+
+// modemState encodes now with the delta bits against before.
+func modemState(before, now serial.ModemStatus) byte {
+	var state byte
+	if now.DCD {
+		state |= MODEM_DCD
+	}
+	if now.RI {
+		state |= MODEM_RI
+	}
+	if now.DSR {
+		state |= MODEM_DSR
+	}
+	if now.CTS {
+		state |= MODEM_CTS
+	}
+	if now.DCD != before.DCD {
+		state |= MODEM_DELTA_DCD
+	}
+	if before.RI && !now.RI {
+		state |= MODEM_RI_EDGE
+	}
+	if now.DSR != before.DSR {
+		state |= MODEM_DELTA_DSR
+	}
+	if now.CTS != before.CTS {
+		state |= MODEM_DELTA_CTS
+	}
+	return state
+}
+
+func (s *Server) onCommand(cmd, opt byte) []byte {
+	switch cmd {
+	case WILL:
+		switch opt {
+		case OPT_BINARY, OPT_SGA, OPT_COM_PORT:
+		default:
+			return command(DONT, opt)
+		}
+	case DO:
+		switch opt {
+		case OPT_BINARY, OPT_SGA:
+		default:
+			return command(WONT, opt)
+		}
+	}
+	return nil
+}
+
+// configure applies c to the port, a port that can't be configured keeps
+// its settings.
+func (s *Server) configure(c serial.Config) bool {
+	if r, ok := s.port.(serial.Configurer); ok {
+		if err := r.Configure(&c); err != nil && err != serial.ErrNotSupported {
+			return false
+		}
+	}
+	s.config = c
+	return true
+}
+
+// onSub executes a COM port request of the client and returns the
+// acknowledgement.
+func (s *Server) onSub(c *serverConn, sb []byte) []byte {
+	if len(sb) < 2 || sb[0] != OPT_COM_PORT || sb[1] >= SERVER_OFFSET {
+		return nil
+	}
+	cmd := sb[1]
+	value := sb[2:]
+
+	// a timed BREAK blocks, the break state belongs to the connection
+	if cmd == SET_CONTROL && len(value) == 1 {
+		switch value[0] {
+		case CONTROL_BREAK_REQUEST, CONTROL_BREAK_ON, CONTROL_BREAK_OFF:
+			return subnegotiation(cmd+SERVER_OFFSET, []byte{s.breakControl(c, value[0])})
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	reply := func(v ...byte) []byte {
+		return subnegotiation(cmd+SERVER_OFFSET, v)
+	}
+
+	switch cmd {
+	case SIGNATURE:
+		if len(value) == 0 {
+			return reply([]byte(ServerSignature)...)
+		}
+		return nil
+
+	case SET_BAUDRATE:
+		if len(value) != 4 {
+			return nil
+		}
+		if baud := int(binary.BigEndian.Uint32(value)); baud != 0 {
+			cfg := s.config
+			cfg.Baud = baud
+			s.configure(cfg)
+		}
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint32(v, uint32(s.config.Baud))
+		return reply(v...)
+
+	case SET_DATASIZE:
+		if len(value) == 1 && value[0] != 0 {
+			cfg := s.config
+			cfg.DataBits = int(value[0])
+			s.configure(cfg)
+		}
+		return reply(byte(s.config.DataBits))
+
+	case SET_PARITY:
+		parities := []serial.Parity{
+			PARITY_NONE:  serial.ParityNone,
+			PARITY_ODD:   serial.ParityOdd,
+			PARITY_EVEN:  serial.ParityEven,
+			PARITY_MARK:  serial.ParityMark,
+			PARITY_SPACE: serial.ParitySpace,
+		}
+		if len(value) == 1 && value[0] != PARITY_REQUEST && int(value[0]) < len(parities) {
+			cfg := s.config
+			cfg.Parity = parities[value[0]]
+			s.configure(cfg)
+		}
+		for v, p := range parities {
+			if v != int(PARITY_REQUEST) && p == s.config.Parity {
+				return reply(byte(v))
+			}
+		}
+		return nil
+
+	case SET_STOPSIZE:
+		stops := []serial.StopBits{
+			STOPSIZE_1:   serial.StopBits1,
+			STOPSIZE_2:   serial.StopBits2,
+			STOPSIZE_1_5: serial.StopBits1Half,
+		}
+		if len(value) == 1 && value[0] != STOPSIZE_REQUEST && int(value[0]) < len(stops) {
+			cfg := s.config
+			cfg.StopBits = stops[value[0]]
+			s.configure(cfg)
+		}
+		for v, st := range stops {
+			if v != int(STOPSIZE_REQUEST) && st == s.config.StopBits {
+				return reply(byte(v))
+			}
+		}
+		return nil
+
+	case SET_CONTROL:
+		if len(value) != 1 {
+			return nil
+		}
+		return reply(s.control(c, value[0]))
+
+	case FLOWCONTROL_SUSPEND:
+		c.suspended = true
+		return nil
+
+	case FLOWCONTROL_RESUME:
+		c.suspended = false
+		s.resumed.Broadcast()
+		return nil
+
+	case SET_MODEMSTATE_MASK:
+		if len(value) == 1 {
+			c.modemMask = value[0]
+		}
+		return reply(c.modemMask)
+
+	case SET_LINESTATE_MASK:
+		// line errors aren't reported by the ports
+		if len(value) == 1 {
+			return reply(value[0])
+		}
+		return nil
+
+	case PURGE_DATA:
+		if f, ok := s.port.(interface{ Flush() error }); ok {
+			f.Flush()
+		}
+		if len(value) == 1 {
+			return reply(value[0])
+		}
+		return nil
+	}
+	return nil
+}
+
+// control executes a SET-CONTROL request, s.lock held, and returns the
+// resulting state.
+func (s *Server) control(c *serverConn, value byte) byte {
+	m, _ := s.port.(serial.ModemLines)
+
+	switch value {
+	case CONTROL_FLOW_NONE, CONTROL_FLOW_XONXOFF, CONTROL_FLOW_HARDWARE:
+		cfg := s.config
+		cfg.RTSCTS = value == CONTROL_FLOW_HARDWARE
+		cfg.XONXOFF = value == CONTROL_FLOW_XONXOFF
+		s.configure(cfg)
+		fallthrough
+	case CONTROL_FLOW_REQUEST:
+		if s.config.RTSCTS {
+			return CONTROL_FLOW_HARDWARE
+		} else if s.config.XONXOFF {
+			return CONTROL_FLOW_XONXOFF
+		}
+		return CONTROL_FLOW_NONE
+
+	case CONTROL_DTR_ON, CONTROL_DTR_OFF:
+		if m != nil && m.SetDTR(value == CONTROL_DTR_ON) == nil {
+			s.dtr = value == CONTROL_DTR_ON
+		}
+		fallthrough
+	case CONTROL_DTR_REQUEST:
+		if s.dtr {
+			return CONTROL_DTR_ON
+		}
+		return CONTROL_DTR_OFF
+
+	case CONTROL_RTS_ON, CONTROL_RTS_OFF:
+		if m != nil && m.SetRTS(value == CONTROL_RTS_ON) == nil {
+			s.rts = value == CONTROL_RTS_ON
+		}
+		fallthrough
+	case CONTROL_RTS_REQUEST:
+		if s.rts {
+			return CONTROL_RTS_ON
+		}
+		return CONTROL_RTS_OFF
+	}
+
+	// inbound flow control settings are accepted as they are
+	return value
+}
+
+// breakControl executes a BREAK request of SET-CONTROL, without s.lock,
+// and returns the resulting state.
+func (s *Server) breakControl(c *serverConn, value byte) byte {
+	switch value {
+	case CONTROL_BREAK_ON:
+		if c.breakOn.IsZero() {
+			b, ok := s.port.(serial.BreakSetter)
+			c.breakSet = ok && b.SetBreak(true) == nil
+			c.breakOn = time.Now()
+		}
+	case CONTROL_BREAK_OFF:
+		if c.breakSet {
+			s.port.(serial.BreakSetter).SetBreak(false)
+		} else if b, ok := s.port.(serial.BreakSender); ok && !c.breakOn.IsZero() {
+			b.SendBreak(time.Since(c.breakOn))
+		}
+		c.breakOn = time.Time{}
+		c.breakSet = false
+	}
+
+	if c.breakOn.IsZero() {
+		return CONTROL_BREAK_OFF
+	}
+	return CONTROL_BREAK_ON
+}
@@ -0,0 +1,188 @@
+package rfc2217
+
+// Telnet commands
+const (
+	IAC  byte = 255
+	DONT byte = 254
+	DO   byte = 253
+	WONT byte = 252
+	WILL byte = 251
+	SB   byte = 250
+	SE   byte = 240
+	NOP  byte = 241
+)
+
+// Telnet options
+const (
+	OPT_BINARY   byte = 0
+	OPT_ECHO     byte = 1
+	OPT_SGA      byte = 3
+	OPT_COM_PORT byte = 44
+)
+
+// COM-PORT-OPTION subcommands sent by the client, the server answers
+// with the same code plus SERVER_OFFSET.
+const (
+	SIGNATURE           byte = 0
+	SET_BAUDRATE        byte = 1
+	SET_DATASIZE        byte = 2
+	SET_PARITY          byte = 3
+	SET_STOPSIZE        byte = 4
+	SET_CONTROL         byte = 5
+	NOTIFY_LINESTATE    byte = 6
+	NOTIFY_MODEMSTATE   byte = 7
+	FLOWCONTROL_SUSPEND byte = 8
+	FLOWCONTROL_RESUME  byte = 9
+	SET_LINESTATE_MASK  byte = 10
+	SET_MODEMSTATE_MASK byte = 11
+	PURGE_DATA          byte = 12
+
+	SERVER_OFFSET byte = 100
+)
+
+// SET-PARITY values
+const (
+	PARITY_REQUEST byte = 0
+	PARITY_NONE    byte = 1
+	PARITY_ODD     byte = 2
+	PARITY_EVEN    byte = 3
+	PARITY_MARK    byte = 4
+	PARITY_SPACE   byte = 5
+)
+
+// SET-STOPSIZE values
+const (
+	STOPSIZE_REQUEST byte = 0
+	STOPSIZE_1       byte = 1
+	STOPSIZE_2       byte = 2
+	STOPSIZE_1_5     byte = 3
+)
+
+// SET-CONTROL values
+const (
+	CONTROL_FLOW_REQUEST  byte = 0
+	CONTROL_FLOW_NONE     byte = 1
+	CONTROL_FLOW_XONXOFF  byte = 2
+	CONTROL_FLOW_HARDWARE byte = 3
+	CONTROL_BREAK_REQUEST byte = 4
+	CONTROL_BREAK_ON      byte = 5
+	CONTROL_BREAK_OFF     byte = 6
+	CONTROL_DTR_REQUEST   byte = 7
+	CONTROL_DTR_ON        byte = 8
+	CONTROL_DTR_OFF       byte = 9
+	CONTROL_RTS_REQUEST   byte = 10
+	CONTROL_RTS_ON        byte = 11
+	CONTROL_RTS_OFF       byte = 12
+)
+
+// NOTIFY-MODEMSTATE bits
+const (
+	MODEM_DCD       byte = 0x80
+	MODEM_RI        byte = 0x40
+	MODEM_DSR       byte = 0x20
+	MODEM_CTS       byte = 0x10
+	MODEM_DELTA_DCD byte = 0x08
+	MODEM_RI_EDGE   byte = 0x04
+	MODEM_DELTA_DSR byte = 0x02
+	MODEM_DELTA_CTS byte = 0x01
+)
+
+// PURGE-DATA values
+const (
+	PURGE_RECEIVE  byte = 1
+	PURGE_TRANSMIT byte = 2
+	PURGE_BOTH     byte = 3
+)
+
+// decoder splits a telnet stream into data, commands and subnegotiations.
+type decoder struct {
+	state int
+	cmd   byte
+	sb    []byte
+}
+
+const (
+	stData = iota
+	stIAC
+	stOption
+	stSB
+	stSBIAC
+)
+
+// feed decodes b, appending the data bytes to data. onCommand gets the
+// DO/DONT/WILL/WONT requests, onSub the payload of every subnegotiation.
+func (d *decoder) feed(b []byte, data []byte, onCommand func(cmd, opt byte), onSub func(sb []byte)) []byte {
+	for _, c := range b {
+		switch d.state {
+		case stData:
+			if c == IAC {
+				d.state = stIAC
+			} else {
+				data = append(data, c)
+			}
+
+		case stIAC:
+			switch c {
+			case IAC:
+				data = append(data, IAC)
+				d.state = stData
+			case DO, DONT, WILL, WONT:
+				d.cmd = c
+				d.state = stOption
+			case SB:
+				d.sb = d.sb[:0]
+				d.state = stSB
+			default:
+				d.state = stData
+			}
+
+		case stOption:
+			onCommand(d.cmd, c)
+			d.state = stData
+
+		case stSB:
+			if c == IAC {
+				d.state = stSBIAC
+			} else {
+				d.sb = append(d.sb, c)
+			}
+
+		case stSBIAC:
+			switch c {
+			case IAC:
+				d.sb = append(d.sb, IAC)
+				d.state = stSB
+			case SE:
+				onSub(d.sb)
+				d.state = stData
+			default:
+				// broken subnegotiation, drop it
+				d.state = stData
+			}
+		}
+	}
+	return data
+}
+
+// escape doubles every IAC of b.
+func escape(b []byte) []byte {
+	out := make([]byte, 0, len(b)+8)
+	for _, c := range b {
+		out = append(out, c)
+		if c == IAC {
+			out = append(out, IAC)
+		}
+	}
+	return out
+}
+
+// subnegotiation encodes a COM-PORT-OPTION subcommand.
+func subnegotiation(cmd byte, value []byte) []byte {
+	out := []byte{IAC, SB, OPT_COM_PORT, cmd}
+	out = append(out, escape(value)...)
+	return append(out, IAC, SE)
+}
+
+func command(cmd, opt byte) []byte {
+	return []byte{IAC, cmd, opt}
+}
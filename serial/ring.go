@@ -0,0 +1,108 @@
+package serial
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrFrameTooLong is the receive error when the buffered input reached the
+// maximum size of the ring without the framer finding a frame in it.
+var ErrFrameTooLong = errors.New("Frame too long")
+
+// ringBuffer is a byte ring the receive path reads into straight from the
+// port, so incoming data is only copied once when a frame is handed out.
+type ringBuffer struct {
+	buf  []byte
+	head int // offset of the first buffered byte
+	size int // number of buffered bytes
+	max  int // the ring doesn't grow beyond
+
+	spare []byte // same size as buf, used to unwrap the data
+}
+
+func newRingBuffer(capacity, max int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, capacity), max: max}
+}
+
+func (rb *ringBuffer) Len() int {
+	return rb.size
+}
+
+// readFrom does a single Read from r into the free space of the ring,
+// doubling the ring first when it is full. A full ring of the maximum size
+// fails with ErrFrameTooLong.
+func (rb *ringBuffer) readFrom(r io.Reader) (int, error) {
+	if rb.size == len(rb.buf) {
+		if len(rb.buf) >= rb.max {
+			return 0, ErrFrameTooLong
+		}
+		rb.grow()
+	}
+
+	tail := (rb.head + rb.size) % len(rb.buf)
+	end := len(rb.buf)
+	if tail < rb.head {
+		end = rb.head
+	}
+
+	n, err := r.Read(rb.buf[tail:end])
+	if n > 0 {
+		rb.size += n
+	}
+	return n, err
+}
+
+func (rb *ringBuffer) grow() {
+	n := len(rb.buf) * 2
+	if n > rb.max {
+		n = rb.max
+	}
+	buf := make([]byte, n)
+	rb.copyOut(buf)
+	rb.buf = buf
+	rb.head = 0
+}
+
+// segments returns the buffered bytes as up to two slices in order.
+func (rb *ringBuffer) segments() ([]byte, []byte) {
+	end := rb.head + rb.size
+	if end <= len(rb.buf) {
+		return rb.buf[rb.head:end], nil
+	}
+	return rb.buf[rb.head:], rb.buf[:end-len(rb.buf)]
+}
+
+// bytes returns the buffered bytes as one slice, moving them to the start
+// of the ring first when they wrap around its end.
+func (rb *ringBuffer) bytes() []byte {
+	a, b := rb.segments()
+	if len(b) == 0 {
+		return a
+	}
+
+	if len(rb.spare) != len(rb.buf) {
+		rb.spare = make([]byte, len(rb.buf))
+	}
+	rb.copyOut(rb.spare)
+	rb.buf, rb.spare = rb.spare, rb.buf
+	rb.head = 0
+	return rb.buf[:rb.size]
+}
+
+// copyOut copies the first len(p) buffered bytes to p without consuming them.
+func (rb *ringBuffer) copyOut(p []byte) int {
+	a, b := rb.segments()
+	n := copy(p, a)
+	n += copy(p[n:], b)
+	return n
+}
+
+func (rb *ringBuffer) discard(n int) {
+	if n >= rb.size {
+		rb.head = 0
+		rb.size = 0
+		return
+	}
+	rb.head = (rb.head + n) % len(rb.buf)
+	rb.size -= n
+}
@@ -0,0 +1,96 @@
+package serial
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// chunkReader returns its data in reads of at most n bytes.
+type chunkReader struct {
+	data []byte
+	n    int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestRingWrap(t *testing.T) {
+	rb := newRingBuffer(8, 64)
+	r := &chunkReader{data: []byte("abcdefghijklmnop"), n: 5}
+
+	// wrap the data around the end of the ring
+	rb.readFrom(r)
+	rb.discard(3)
+	rb.readFrom(r)
+	rb.readFrom(r)
+	if rb.Len() != 8 || len(rb.buf) != 8 {
+		t.Fatalf("len %d, size %d", rb.Len(), len(rb.buf))
+	}
+	if got := string(rb.bytes()); got != "defghijk" {
+		t.Fatalf("bytes %q", got)
+	}
+
+	// a full ring grows
+	rb.readFrom(r)
+	if got := string(rb.bytes()); got != "defghijklmnop" || len(rb.buf) != 16 {
+		t.Fatalf("bytes %q, size %d", got, len(rb.buf))
+	}
+}
+
+func TestRingMax(t *testing.T) {
+	rb := newRingBuffer(4, 10)
+	r := &chunkReader{data: bytes.Repeat([]byte("x"), 100), n: 100}
+
+	for rb.Len() < 10 {
+		if _, err := rb.readFrom(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(rb.buf) != 10 {
+		t.Fatalf("ring grew to %d", len(rb.buf))
+	}
+	if _, err := rb.readFrom(r); err != ErrFrameTooLong {
+		t.Fatalf("readFrom error %v, want %v", err, ErrFrameTooLong)
+	}
+
+	// room again once data is consumed
+	rb.discard(5)
+	if n, err := rb.readFrom(r); n != 5 || err != nil {
+		t.Fatalf("readFrom = %d, %v", n, err)
+	}
+}
+
+// endless never sends an end of line.
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+func (endless) Write(p []byte) (int, error) { return len(p), nil }
+func (endless) Close() error                { return nil }
+
+func TestReadLineTooLong(t *testing.T) {
+	sp := NewSerialPortFrom(endless{})
+	sp.StartRecv()
+	defer sp.Close()
+
+	_, err := sp.ReadLine()
+	if !errors.Is(err, ErrFrameTooLong) {
+		t.Fatalf("ReadLine error %v, want %v", err, ErrFrameTooLong)
+	}
+}
@@ -0,0 +1,6 @@
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package serial
+
+// TIOCSRS485 from <asm-generic/ioctls.h>
+const _TIOCSRS485 = 0x542f
@@ -0,0 +1,6 @@
+// +build linux,mips linux,mipsle linux,mips64 linux,mips64le
+
+package serial
+
+// TIOCSRS485 from <asm/ioctls.h> on mips: _IOW('T', 0x2F, struct serial_rs485)
+const _TIOCSRS485 = 0x8020542f
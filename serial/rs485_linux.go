@@ -0,0 +1,78 @@
+package serial
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// serial_rs485 flags from <linux/serial.h>
+const (
+	_SER_RS485_ENABLED        = 1 << 0
+	_SER_RS485_RTS_ON_SEND    = 1 << 1
+	_SER_RS485_RTS_AFTER_SEND = 1 << 2
+	_SER_RS485_RX_DURING_TX   = 1 << 4
+)
+
+type serialRS485 struct {
+	Flags              uint32
+	DelayRTSBeforeSend uint32
+	DelayRTSAfterSend  uint32
+	Padding            [5]uint32
+}
+
+func setRS485(fd uintptr, c *RS485Config) error {
+	var rs serialRS485
+
+	if c.Enabled {
+		rs.Flags |= _SER_RS485_ENABLED
+	}
+	if c.RTSOnSend {
+		rs.Flags |= _SER_RS485_RTS_ON_SEND
+	}
+	if c.RTSAfterSend {
+		rs.Flags |= _SER_RS485_RTS_AFTER_SEND
+	}
+	if c.RxDuringTx {
+		rs.Flags |= _SER_RS485_RX_DURING_TX
+	}
+	rs.DelayRTSBeforeSend = uint32(c.DelayRTSBeforeSend / time.Millisecond)
+	rs.DelayRTSAfterSend = uint32(c.DelayRTSAfterSend / time.Millisecond)
+
+	if err := ioctl(fd, _TIOCSRS485, unsafe.Pointer(&rs)); err != nil {
+		return fmt.Errorf("RS-485 mode not supported by the driver - %v", err)
+	}
+	return nil
+}
+
+// Switches the kernel RS-485 mode of the port
+func (p *Port) SetRS485(c *RS485Config) error {
+	return p.control(func(fd uintptr) error {
+		return setRS485(fd, c)
+	})
+}
+
+// Holds the line in the BREAK condition for d
+func (p *Port) SendBreak(d time.Duration) error {
+	if err := p.SetBreak(true); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return p.SetBreak(false)
+}
+
+// Sets or clears the BREAK condition
+func (p *Port) SetBreak(on bool) error {
+	req := uint(syscall.TIOCCBRK)
+	if on {
+		req = syscall.TIOCSBRK
+	}
+	err := p.control(func(fd uintptr) error {
+		return ioctl(fd, req, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("Break not supported by the driver - %v", err)
+	}
+	return nil
+}
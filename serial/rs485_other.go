@@ -0,0 +1,7 @@
+// +build !linux,!windows
+
+package serial
+
+func setRS485(fd uintptr, c *RS485Config) error {
+	return ErrNotSupported
+}
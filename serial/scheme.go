@@ -0,0 +1,90 @@
+package serial
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PortOpener opens the port named by the URL in c.Name.
+type PortOpener func(c *Config) (io.ReadWriteCloser, error)
+
+var (
+	schemeLock sync.Mutex
+	schemes    = map[string]PortOpener{
+		"socket": openSocket,
+	}
+)
+
+// RegisterScheme makes ports named scheme://... open through open, e.g.
+// importing serial/rfc2217 registers "rfc2217".
+func RegisterScheme(scheme string, open PortOpener) {
+	schemeLock.Lock()
+	defer schemeLock.Unlock()
+	schemes[strings.ToLower(scheme)] = open
+}
+
+// Open opens the port described by c. A name of the form scheme://...
+// goes to the opener registered for the scheme, anything else is a
+// local device. socket://host:port is a raw TCP connection, for
+// ser2net style servers.
+func Open(c *Config) (io.ReadWriteCloser, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+
+	i := strings.Index(c.Name, "://")
+	if i < 0 {
+		port, err := openPort(c)
+		if err != nil {
+			// keep a nil *Port out of the interface
+			return nil, err
+		}
+		return port, nil
+	}
+
+	scheme := strings.ToLower(c.Name[:i])
+	schemeLock.Lock()
+	open := schemes[scheme]
+	schemeLock.Unlock()
+	if open == nil {
+		return nil, fmt.Errorf("Unknown port scheme \"%s\"", scheme)
+	}
+	return open(c)
+}
+
+// socketPort is a raw TCP connection used as a port.
+type socketPort struct {
+	net.Conn
+	rd readDeadline
+}
+
+func openSocket(c *Config) (io.ReadWriteCloser, error) {
+	addr := strings.TrimSuffix(c.Name[len("socket://"):], "/")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p := &socketPort{Conn: conn}
+	p.rd.setTimeout(c.ReadTimeout)
+	return p, nil
+}
+
+func (p *socketPort) Read(b []byte) (int, error) {
+	p.rd.apply(p.Conn.SetReadDeadline)
+	return p.Conn.Read(b)
+}
+
+func (p *socketPort) SetReadDeadline(t time.Time) error {
+	return p.rd.setDeadline(t, p.Conn.SetReadDeadline)
+}
+
+func (p *socketPort) SetDeadline(t time.Time) error {
+	if err := p.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return p.Conn.SetWriteDeadline(t)
+}
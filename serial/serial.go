@@ -1,8 +1,13 @@
 package serial
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -10,55 +15,396 @@ const EOL_DROP_DEFULT byte = '\r'
 const EOL_DEFAULT byte = '\n'
 const LN_DEFAULT string = "\r"
 
+// Parity is the parity mode of a serial line.
+type Parity byte
+
+const (
+	ParityNone Parity = iota
+	ParityOdd
+	ParityEven
+	ParityMark
+	ParitySpace
+)
+
+// StopBits is the number of stop bits of a serial line.
+type StopBits byte
+
+const (
+	StopBits1 StopBits = iota
+	StopBits1Half
+	StopBits2
+)
+
+// Config holds the settings used to open a serial port.
+// The zero value of every line setting selects 8N1 without flow control.
+type Config struct {
+	Name     string
+	Baud     int
+	DataBits int // 5, 6, 7 or 8; 0 means 8
+	Parity   Parity
+	StopBits StopBits
+
+	RTSCTS  bool // hardware (RTS/CTS) flow control
+	XONXOFF bool // software (XON/XOFF) flow control
+
+	// When > 0 every Read fails with a timeout error after waiting
+	// that long for data, or earlier if SetReadDeadline says so.
+	ReadTimeout time.Duration
+
+	RS485 *RS485Config // kernel RS-485 half-duplex mode, nil leaves it untouched
+}
+
+// RS485Config selects how the driver toggles RTS around transmission in
+// RS-485 half-duplex mode. The delays have millisecond resolution.
+type RS485Config struct {
+	Enabled      bool
+	RTSOnSend    bool // RTS level while sending is high
+	RTSAfterSend bool // RTS level after sending is high
+	RxDuringTx   bool // keep receiving while sending
+
+	DelayRTSBeforeSend time.Duration
+	DelayRTSAfterSend  time.Duration
+}
+
+func (c *Config) dataBits() int {
+	if c.DataBits == 0 {
+		return 8
+	}
+	return c.DataBits
+}
+
+// check validates c for the port it names. Local devices are also held to
+// what the platform supports, other schemes check the rest themselves.
+func (c *Config) check() error {
+	if err := c.checkLine(); err != nil {
+		return err
+	}
+	if c.StopBits == StopBits1Half && !stopBits1Half && !strings.Contains(c.Name, "://") {
+		return errors.New("Unsupported stop bits 1.5 on this platform")
+	}
+	return nil
+}
+
+// checkLine validates the line settings of c for any kind of port.
+func (c *Config) checkLine() error {
+	if c.Baud <= 0 {
+		return fmt.Errorf("Invalid baud rate %d", c.Baud)
+	}
+	if n := c.dataBits(); n < 5 || n > 8 {
+		return fmt.Errorf("Invalid data bits %d", c.DataBits)
+	}
+	if c.Parity > ParitySpace {
+		return fmt.Errorf("Invalid parity %d", c.Parity)
+	}
+	if c.StopBits > StopBits2 {
+		return fmt.Errorf("Invalid stop bits %d", c.StopBits)
+	}
+	return nil
+}
+
+// ModemStatus is the state of the modem status lines.
+type ModemStatus struct {
+	CTS bool
+	DSR bool
+	DCD bool
+	RI  bool
+}
+
+// ModemLines is implemented by ports that can drive and sense the modem
+// control lines.
+type ModemLines interface {
+	SetDTR(on bool) error
+	SetRTS(on bool) error
+	GetModemStatus() (ModemStatus, error)
+	WaitForModemStatusChange(ctx context.Context) (ModemStatus, error)
+}
+
+// BreakSender is implemented by ports that can send a BREAK condition.
+type BreakSender interface {
+	SendBreak(d time.Duration) error
+}
+
+// BreakSetter is implemented by ports that can hold the BREAK condition
+// until it is cleared.
+type BreakSetter interface {
+	SetBreak(on bool) error
+}
+
+// RS485Setter is implemented by ports that support the RS-485 mode.
+type RS485Setter interface {
+	SetRS485(c *RS485Config) error
+}
+
+// Configurer is implemented by ports whose line settings can be changed
+// while open.
+type Configurer interface {
+	Configure(c *Config) error
+}
+
+// Deadliner is implemented by ports with net.Conn style deadlines.
+type Deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+var ErrNotSupported = errors.New("Operation not supported by the port")
+
+// A deadline in the past, used to wake up blocked I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+func isTimeout(err error) bool {
+	t, ok := err.(interface{ Timeout() bool })
+	return ok && t.Timeout()
+}
+
+// ioContext runs fn, a single Read or Write, and interrupts it through
+// setDeadline when ctx is done first.
+func ioContext(ctx context.Context, setDeadline func(time.Time) error, fn func() (int, error)) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	d, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		setDeadline(d)
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			setDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+
+	n, err := fn()
+	close(stop)
+	<-stopped
+	setDeadline(time.Time{})
+
+	if err != nil {
+		if hasDeadline && !time.Now().Before(d) {
+			// the poller can hit the deadline before the context timer fires
+			<-ctx.Done()
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// readDeadline combines Config.ReadTimeout with the deadline set by
+// SetReadDeadline, a Read waits until the earlier of the two.
+type readDeadline struct {
+	lock     sync.Mutex
+	timeout  time.Duration
+	deadline time.Time
+}
+
+// apply passes the deadline of a Read starting now to set.
+func (d *readDeadline) apply(set func(time.Time) error) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	t := d.deadline
+	if d.timeout > 0 {
+		if next := time.Now().Add(d.timeout); t.IsZero() || next.Before(t) {
+			t = next
+		}
+	}
+	return set(t)
+}
+
+// setDeadline changes the deadline, a Read in progress is given the new
+// one through set.
+func (d *readDeadline) setDeadline(t time.Time, set func(time.Time) error) error {
+	d.lock.Lock()
+	d.deadline = t
+	d.lock.Unlock()
+	return d.apply(set)
+}
+
+func (d *readDeadline) setTimeout(timeout time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.timeout = timeout
+}
+
+// Interval used to poll the modem status when the driver can't wait for a change.
+var ModemPollInterval = time.Millisecond * 50
+
+// pollModemStatus polls get until the status differs from before.
+func pollModemStatus(ctx context.Context, before ModemStatus, get func() (ModemStatus, error)) (ModemStatus, error) {
+	ticker := time.NewTicker(ModemPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now, err := get()
+			if err != nil {
+				return ModemStatus{}, err
+			}
+			if now != before {
+				return now, nil
+			}
+		case <-ctx.Done():
+			return ModemStatus{}, ctx.Err()
+		}
+	}
+}
+
+// ErrPortClosed is returned by ReadLine once the port has been closed.
+var ErrPortClosed = errors.New("Serial port closed")
+
+// ReadError is returned by ReadLine when reading the port failed and the
+// receive goroutine stopped.
+type ReadError struct {
+	Err error
+}
+
+func (e *ReadError) Error() string {
+	return "Serial port read error - " + e.Err.Error()
+}
+
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// Unplugged reports whether the read failed because the device went away:
+// a hung up tty reads as EOF, some drivers fail with EIO instead.
+func (e *ReadError) Unplugged() bool {
+	return e.Err == io.EOF || errors.Is(e.Err, syscall.EIO)
+}
+
 type SerialPort struct {
 	mPort     io.ReadWriteCloser
+	mConfig   Config
 	mName     string
 	mBaud     int
 	mEol      byte
 	mLn       string
-	mBuffer   []byte
 	mLineChan chan []byte
+	mFramer   Framer
+
+	mLock      sync.Mutex
+	mStarted   bool
+	mClosed    bool
+	mClosing   chan struct{} // closed by Close
+	mRecvDone  chan struct{} // closed when readThread exits
+	mRecvError error
 }
 
+// Opens name with 8N1 settings. Reads time out after a second, like they
+// always did, use NewSerialPortConfig for reads that wait for data.
 func NewSerialPort(name string, baud int) (*SerialPort, error) {
+	return NewSerialPortConfig(&Config{
+		Name:        name,
+		Baud:        baud,
+		ReadTimeout: time.Second,
+	})
+}
+
+// NewSerialPortConfig opens the port described by c.
+func NewSerialPortConfig(c *Config) (*SerialPort, error) {
 	s := SerialPort{
 		mPort:     nil,
 		mEol:      EOL_DEFAULT,
 		mLn:       LN_DEFAULT,
 		mLineChan: nil,
+		mClosing:  make(chan struct{}),
 	}
 
-	if err := s.open(name, baud, time.Second); err != nil {
+	if err := s.open(c); err != nil {
 		return nil, err
 	}
 
 	return &s, nil
 }
 
+// NewSerialPortFrom wraps an already open port, e.g. a ReconnectingPort.
+func NewSerialPortFrom(port io.ReadWriteCloser) *SerialPort {
+	return &SerialPort{
+		mPort:     port,
+		mEol:      EOL_DEFAULT,
+		mLn:       LN_DEFAULT,
+		mLineChan: nil,
+		mClosing:  make(chan struct{}),
+	}
+}
+
+// Starts the goroutine splitting the input into lines for ReadLine.
 func (s *SerialPort) StartRecv() {
+	s.mLock.Lock()
+	defer s.mLock.Unlock()
+	if s.mStarted || s.mClosed {
+		return
+	}
+
+	s.mStarted = true
 	s.mLineChan = make(chan []byte)
+	s.mRecvDone = make(chan struct{})
 	go s.readThread()
-
 }
 
+// Initial size of the receive ring, it grows for longer lines.
+const READ_BUFFER_SIZE = 4096
+
+// Maximum size of the receive ring. Input that fills it without a frame
+// stops the receive goroutine with a *ReadError wrapping ErrFrameTooLong.
+const MAX_READ_BUFFER_SIZE = 1024 * 1024
+
+// readThread splits the input with the framer and owns mLineChan, which
+// it closes on exit after mRecvError is set.
 func (s *SerialPort) readThread() {
-	b := make([]byte, 1)
-	s.mBuffer = []byte{}
+	defer close(s.mRecvDone)
+	defer close(s.mLineChan)
+
+	framer := s.mFramer
+	if framer == nil {
+		framer = &LineFramer{EOL: s.mEol}
+	}
+
+	ring := newRingBuffer(READ_BUFFER_SIZE, MAX_READ_BUFFER_SIZE)
 	for {
-		n, err := s.mPort.Read(b)
-		if err != nil {
-			break
+		if _, err := ring.readFrom(s.mPort); err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			select {
+			case <-s.mClosing:
+				s.mRecvError = ErrPortClosed
+			default:
+				s.mRecvError = &ReadError{Err: err}
+			}
+			return
 		}
 
-		if n != 1 {
-			continue
-		}
-		if b[0] == s.mEol {
-			s.mLineChan <- s.mBuffer
-			s.mBuffer = []byte{}
-			continue
+		for ring.Len() > 0 {
+			advance, frame, err := framer.Frame(ring.bytes())
+			if err != nil {
+				s.mRecvError = &ReadError{Err: err}
+				return
+			}
+			if advance == 0 {
+				break
+			}
+			if frame == nil {
+				ring.discard(advance)
+				continue
+			}
+			out := make([]byte, len(frame))
+			copy(out, frame)
+			ring.discard(advance)
+
+			select {
+			case s.mLineChan <- out:
+			case <-s.mClosing:
+				s.mRecvError = ErrPortClosed
+				return
+			}
 		}
-		s.mBuffer = append(s.mBuffer, b[0])
 	}
 }
 
@@ -66,45 +412,120 @@ func (s *SerialPort) SetLn(ln string) {
 	s.mLn = ln
 }
 
+// Sets the byte ending the lines returned by ReadLine, it replaces any
+// framer set before. Call it before StartRecv.
 func (s *SerialPort) SetEOL(eol byte) {
 	s.mEol = eol
+	s.mFramer = nil
 }
 
-func (s *SerialPort) open(name string, baud int, timeout ...time.Duration) error {
-	var readTimeout time.Duration
+// Sets how the receive goroutine splits the input into the frames returned
+// by ReadFrame and ReadLine. Call it before StartRecv.
+func (s *SerialPort) SetFramer(f Framer) {
+	s.mFramer = f
+}
 
-	if len(timeout) > 0 {
-		readTimeout = timeout[0]
+func (s *SerialPort) open(c *Config) error {
+	if err := c.check(); err != nil {
+		return fmt.Errorf("Unable to open port \"%s\" - %s", c.Name, err)
 	}
 
-	port, err := openPort(name, baud, readTimeout)
+	port, err := Open(c)
 	if err != nil {
-		return fmt.Errorf("Unable to open port \"%s\" - %s", name, err)
+		return fmt.Errorf("Unable to open port \"%s\" - %s", c.Name, err)
 	}
 
-	s.mName = name
-	s.mBaud = baud
+	s.mConfig = *c
+	s.mName = c.Name
+	s.mBaud = c.Baud
 	s.mPort = port
 	return nil
 }
 
+// Returns the next line received. Once the receive goroutine stopped it
+// returns ErrPortClosed after Close, or a *ReadError if reading failed.
 func (sp *SerialPort) ReadLine() (string, error) {
 	r, ok := <-sp.mLineChan
 	if ok {
 		return string(r), nil
 	}
-	return "", fmt.Errorf("Serial port closed.")
+	return "", sp.mRecvError
 }
 
+// Returns the next frame received, see ReadLine for the errors.
+func (sp *SerialPort) ReadFrame() ([]byte, error) {
+	r, ok := <-sp.mLineChan
+	if ok {
+		return r, nil
+	}
+	return nil, sp.mRecvError
+}
+
+// Like ReadFrame, but gives up when ctx is done.
+func (sp *SerialPort) ReadFrameContext(ctx context.Context) ([]byte, error) {
+	select {
+	case r, ok := <-sp.mLineChan:
+		if ok {
+			return r, nil
+		}
+		return nil, sp.mRecvError
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Encodes payload with the framer and writes it. The framer must
+// implement FrameEncoder.
+func (sp *SerialPort) WriteFrame(payload []byte) error {
+	var framer Framer = sp.mFramer
+	if framer == nil {
+		framer = &LineFramer{EOL: sp.mEol}
+	}
+	enc, ok := framer.(FrameEncoder)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	buf, err := enc.Encode(payload)
+	if err != nil {
+		return err
+	}
+	_, err = sp.Write(buf)
+	return err
+}
+
+// Like ReadLine, but gives up when ctx is done.
+func (sp *SerialPort) ReadLineContext(ctx context.Context) (string, error) {
+	select {
+	case r, ok := <-sp.mLineChan:
+		if ok {
+			return string(r), nil
+		}
+		return "", sp.mRecvError
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Closes the port and waits for the receive goroutine to exit. Calling it
+// more than once is harmless.
 func (sp *SerialPort) Close() error {
-	var err error
+	sp.mLock.Lock()
+	if sp.mClosed {
+		sp.mLock.Unlock()
+		return nil
+	}
+	sp.mClosed = true
+	close(sp.mClosing)
+	sp.mLock.Unlock()
 
+	var err error
 	if sp.mPort != nil {
 		err = sp.mPort.Close()
 	}
 
-	if sp.mLineChan != nil {
-		close(sp.mLineChan)
+	if sp.mRecvDone != nil {
+		<-sp.mRecvDone
 	}
 	return err
 }
@@ -116,32 +537,175 @@ func (sp *SerialPort) Write(data []byte) (int, error) {
 	return sp.mPort.Write(data)
 }
 
-func (sp *SerialPort) Read(b []byte) (int, error) {
+func (sp *SerialPort) deadliner() (Deadliner, error) {
 	if nil == sp.mPort {
-		return 0, fmt.Errorf("Serial port is not open")
+		return nil, fmt.Errorf("Serial port is not open")
 	}
+	d, ok := sp.mPort.(Deadliner)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return d, nil
+}
 
-	return sp.mPort.Read(b)
+// Sets the deadline for Read calls, a zero t disables it.
+func (sp *SerialPort) SetReadDeadline(t time.Time) error {
+	d, err := sp.deadliner()
+	if err != nil {
+		return err
+	}
+	return d.SetReadDeadline(t)
 }
 
-func posixTimeoutValues(readTimeout time.Duration) (vmin uint8, vtime uint8) {
-	const MAXUINT8 = 1<<8 - 1 // 255
-	// set blocking / non-blocking read
-	var minBytesToRead uint8 = 1
-	var readTimeoutInDeci int64
-	if readTimeout > 0 {
-		// EOF on zero read
-		minBytesToRead = 0
-		// convert timeout to deciseconds as expected by VTIME
-		readTimeoutInDeci = (readTimeout.Nanoseconds() / 1e6 / 100)
-		// capping the timeout
-		if readTimeoutInDeci < 1 {
-			// min possible timeout 1 Deciseconds (0.1s)
-			readTimeoutInDeci = 1
-		} else if readTimeoutInDeci > MAXUINT8 {
-			// max possible timeout is 255 deciseconds (25.5s)
-			readTimeoutInDeci = MAXUINT8
-		}
+// Sets the deadline for Write calls, a zero t disables it.
+func (sp *SerialPort) SetWriteDeadline(t time.Time) error {
+	d, err := sp.deadliner()
+	if err != nil {
+		return err
+	}
+	return d.SetWriteDeadline(t)
+}
+
+// Like Read, but gives up when ctx is done. The read deadline is cleared
+// when it returns, a ReadTimeout of the port still applies.
+func (sp *SerialPort) ReadContext(ctx context.Context, b []byte) (int, error) {
+	d, err := sp.deadliner()
+	if err != nil {
+		return 0, err
+	}
+	return ioContext(ctx, d.SetReadDeadline, func() (int, error) {
+		return sp.mPort.Read(b)
+	})
+}
+
+// Like Write, but gives up when ctx is done. The write deadline is cleared
+// when it returns.
+func (sp *SerialPort) WriteContext(ctx context.Context, b []byte) (int, error) {
+	d, err := sp.deadliner()
+	if err != nil {
+		return 0, err
+	}
+	return ioContext(ctx, d.SetWriteDeadline, func() (int, error) {
+		return sp.mPort.Write(b)
+	})
+}
+
+func (sp *SerialPort) modemLines() (ModemLines, error) {
+	if nil == sp.mPort {
+		return nil, fmt.Errorf("Serial port is not open")
+	}
+	m, ok := sp.mPort.(ModemLines)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return m, nil
+}
+
+func (sp *SerialPort) SetDTR(on bool) error {
+	m, err := sp.modemLines()
+	if err != nil {
+		return err
+	}
+	return m.SetDTR(on)
+}
+
+func (sp *SerialPort) SetRTS(on bool) error {
+	m, err := sp.modemLines()
+	if err != nil {
+		return err
+	}
+	return m.SetRTS(on)
+}
+
+func (sp *SerialPort) GetModemStatus() (ModemStatus, error) {
+	m, err := sp.modemLines()
+	if err != nil {
+		return ModemStatus{}, err
+	}
+	return m.GetModemStatus()
+}
+
+// Blocks until one of the modem status lines changes or ctx is done.
+func (sp *SerialPort) WaitForModemStatusChange(ctx context.Context) (ModemStatus, error) {
+	m, err := sp.modemLines()
+	if err != nil {
+		return ModemStatus{}, err
+	}
+	return m.WaitForModemStatusChange(ctx)
+}
+
+// Holds the line in the BREAK condition for d.
+func (sp *SerialPort) SendBreak(d time.Duration) error {
+	if nil == sp.mPort {
+		return fmt.Errorf("Serial port is not open")
+	}
+	b, ok := sp.mPort.(BreakSender)
+	if !ok {
+		return ErrNotSupported
+	}
+	return b.SendBreak(d)
+}
+
+// Sets or clears the BREAK condition.
+func (sp *SerialPort) SetBreak(on bool) error {
+	if nil == sp.mPort {
+		return fmt.Errorf("Serial port is not open")
+	}
+	b, ok := sp.mPort.(BreakSetter)
+	if !ok {
+		return ErrNotSupported
 	}
-	return minBytesToRead, uint8(readTimeoutInDeci)
+	return b.SetBreak(on)
+}
+
+// Returns the settings the port was opened or last configured with.
+func (sp *SerialPort) Config() Config {
+	return sp.mConfig
+}
+
+// Changes the line settings of the open port, c.Name is ignored.
+func (sp *SerialPort) Configure(c *Config) error {
+	if nil == sp.mPort {
+		return fmt.Errorf("Serial port is not open")
+	}
+	// the port applies its own limits
+	if err := c.checkLine(); err != nil {
+		return err
+	}
+	r, ok := sp.mPort.(Configurer)
+	if !ok {
+		return ErrNotSupported
+	}
+	if err := r.Configure(c); err != nil {
+		return err
+	}
+	name := sp.mConfig.Name
+	sp.mConfig = *c
+	sp.mConfig.Name = name
+	sp.mBaud = c.Baud
+	return nil
+}
+
+// Changes the RS-485 mode of the port.
+func (sp *SerialPort) SetRS485(c *RS485Config) error {
+	if nil == sp.mPort {
+		return fmt.Errorf("Serial port is not open")
+	}
+	r, ok := sp.mPort.(RS485Setter)
+	if !ok {
+		return ErrNotSupported
+	}
+	if err := r.SetRS485(c); err != nil {
+		return err
+	}
+	sp.mConfig.RS485 = c
+	return nil
+}
+
+func (sp *SerialPort) Read(b []byte) (int, error) {
+	if nil == sp.mPort {
+		return 0, fmt.Errorf("Serial port is not open")
+	}
+
+	return sp.mPort.Read(b)
 }
@@ -3,14 +3,38 @@
 package serial
 
 import (
+	"fmt"
 	"os"
-	"io"
 	"syscall"
-	"time"
 	"unsafe"
 )
 
-func openPort(name string, baud int, readTimeout time.Duration) (p *Port, err error) {
+// Control flags missing from the syscall package.
+const (
+	_CMSPAR  = 0x40000000
+	_CRTSCTS = 0x80000000
+)
+
+func openPort(c *Config) (p *Port, err error) {
+	// The descriptor stays non-blocking so the runtime poller can serve
+	// deadlines and unblock readers on Close.
+	fd, err := syscall.Open(c.Name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0666)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: c.Name, Err: err}
+	}
+
+	if err = configure(uintptr(fd), c); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	port := &Port{f: os.NewFile(uintptr(fd), c.Name)}
+	port.rd.setTimeout(c.ReadTimeout)
+	return port, nil
+}
+
+// configure applies the line settings of c to the tty fd.
+func configure(fd uintptr, c *Config) error {
 	var bauds = map[int]uint32{
 		50:      syscall.B50,
 		75:      syscall.B75,
@@ -44,69 +68,120 @@ func openPort(name string, baud int, readTimeout time.Duration) (p *Port, err er
 		4000000: syscall.B4000000,
 	}
 
-	rate := bauds[baud]
-
-	if rate == 0 {
-		return
+	// Rates missing from the table are programmed through termios2 once
+	// the port is configured.
+	rate, ok := bauds[c.Baud]
+	if !ok {
+		rate = syscall.B38400
 	}
 
-	f, err := os.OpenFile(name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0666)
+	cflag, iflag, err := lineFlags(c)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	defer func() {
-		if err != nil && f != nil {
-			f.Close()
-		}
-	}()
-
-	fd := f.Fd()
-	vmin, vtime := posixTimeoutValues(readTimeout)
 	t := syscall.Termios{
-		Iflag:  syscall.IGNPAR,
-		Cflag:  syscall.CS8 | syscall.CREAD | syscall.CLOCAL | rate,
-		Cc:     [32]uint8{syscall.VMIN: vmin, syscall.VTIME: vtime},
+		Iflag:  iflag,
+		Cflag:  cflag | syscall.CREAD | syscall.CLOCAL | rate,
 		Ispeed: rate,
 		Ospeed: rate,
 	}
+	// Cc is shorter on some architectures, riscv64 among them
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
 
 	if _, _, errno := syscall.Syscall6(
 		syscall.SYS_IOCTL,
-		uintptr(fd),
+		fd,
 		uintptr(syscall.TCSETS),
 		uintptr(unsafe.Pointer(&t)),
 		0,
 		0,
 		0,
 	); errno != 0 {
-		return nil, errno
+		return errno
 	}
 
-	if err = syscall.SetNonblock(int(fd), false); err != nil {
-		return
+	if !ok {
+		if err = setCustomBaud(fd, c.Baud); err != nil {
+			return err
+		}
 	}
 
-	return &Port{f: f}, nil
+	if c.RS485 != nil {
+		if err = setRS485(fd, c.RS485); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lineFlags converts the line settings of c to termios c_cflag and c_iflag bits.
+func lineFlags(c *Config) (cflag, iflag uint32, err error) {
+	iflag = syscall.IGNPAR
+
+	switch c.dataBits() {
+	case 5:
+		cflag |= syscall.CS5
+	case 6:
+		cflag |= syscall.CS6
+	case 7:
+		cflag |= syscall.CS7
+	default:
+		cflag |= syscall.CS8
+	}
+
+	switch c.Parity {
+	case ParityOdd:
+		cflag |= syscall.PARENB | syscall.PARODD
+	case ParityEven:
+		cflag |= syscall.PARENB
+	case ParityMark:
+		cflag |= syscall.PARENB | syscall.PARODD | _CMSPAR
+	case ParitySpace:
+		cflag |= syscall.PARENB | _CMSPAR
+	}
+	if c.Parity != ParityNone {
+		iflag |= syscall.INPCK
+	}
+
+	switch c.StopBits {
+	case StopBits1:
+	case StopBits2:
+		cflag |= syscall.CSTOPB
+	default:
+		return 0, 0, fmt.Errorf("Unsupported stop bits %d", c.StopBits)
+	}
+
+	if c.RTSCTS {
+		cflag |= _CRTSCTS
+	}
+	if c.XONXOFF {
+		iflag |= syscall.IXON | syscall.IXOFF
+	}
+	return
+}
+
+// termiosFlags returns the c_cflag and c_iflag bits lineFlags sets for c.
+func termiosFlags(c *Config) (cflag, iflag uint64, err error) {
+	cf, ifl, err := lineFlags(c)
+	return uint64(cf), uint64(ifl), err
 }
 
 type Port struct {
 	// We intentionly do not use an "embedded" struct so that we
 	// don't export File
 	f *os.File
+
+	rd readDeadline
+	mw modemWaiter
 }
 
 func (p *Port) Read(b []byte) (n int, err error) {
-	for {
-		n, err = p.f.Read(b)
-		if err == nil {
-			return
-		}
-
-		if err != io.EOF {
-			return
-		}
-	}
+	p.rd.apply(p.f.SetReadDeadline)
+	// With VMIN=1 a read returns no data only after a hangup, which
+	// File.Read reports as io.EOF
+	return p.f.Read(b)
 }
 
 func (p *Port) Write(b []byte) (n int, err error) {
@@ -117,13 +192,18 @@ func (p *Port) Write(b []byte) (n int, err error) {
 // or data received but not read
 func (p *Port) Flush() error {
 	const TCFLSH = 0x540B
-	_, _, err := syscall.Syscall(
-		syscall.SYS_IOCTL,
-		uintptr(p.f.Fd()),
-		uintptr(TCFLSH),
-		uintptr(syscall.TCIOFLUSH),
-	)
-	return err
+	return p.control(func(fd uintptr) error {
+		_, _, errno := syscall.Syscall(
+			syscall.SYS_IOCTL,
+			fd,
+			uintptr(TCFLSH),
+			uintptr(syscall.TCIOFLUSH),
+		)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
 }
 
 func (p *Port) Close() (err error) {
@@ -0,0 +1,299 @@
+package serial
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xiqingping/golibs/serial/virtual"
+)
+
+// openPtySerial opens a SerialPort on a pty, the Pair is the device side.
+func openPtySerial(t testing.TB) (*SerialPort, *virtual.Pair) {
+	pair, err := virtual.OpenPair()
+	if err != nil {
+		t.Skip("no pty:", err)
+	}
+	t.Cleanup(func() { pair.Close() })
+
+	sp, err := NewSerialPort(pair.Name(), 115200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp.Close() })
+	return sp, pair
+}
+
+// closeWithin fails the test when Close takes longer than d.
+func closeWithin(t *testing.T, sp *SerialPort, d time.Duration) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- sp.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(d):
+		t.Fatal("Close blocked")
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	sp, pair := openPtySerial(t)
+	sp.StartRecv()
+
+	pair.Write([]byte("OK\r\n+CSQ: 20,99\r\n"))
+	for _, want := range []string{"OK\r", "+CSQ: 20,99\r"} {
+		if l, err := sp.ReadLine(); err != nil || l != want {
+			t.Fatalf("ReadLine = %q, %v, want %q", l, err, want)
+		}
+	}
+}
+
+func TestCloseDuringRead(t *testing.T) {
+	sp, _ := openPtySerial(t)
+	sp.StartRecv()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := sp.ReadLine(); err != ErrPortClosed {
+				t.Errorf("ReadLine error %v, want %v", err, ErrPortClosed)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	closeWithin(t, sp, 5*time.Second)
+	wg.Wait()
+
+	// closing again is harmless
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Lines nobody reads must not keep the receive goroutine, and so Close,
+// from finishing.
+func TestCloseWithUnreadLines(t *testing.T) {
+	sp, pair := openPtySerial(t)
+	sp.StartRecv()
+
+	pair.Write([]byte("one\ntwo\nthree\n"))
+	time.Sleep(50 * time.Millisecond)
+	closeWithin(t, sp, 5*time.Second)
+
+	if _, err := sp.ReadLine(); err != ErrPortClosed {
+		t.Fatalf("ReadLine error %v, want %v", err, ErrPortClosed)
+	}
+}
+
+func TestReadErrorUnplugged(t *testing.T) {
+	sp, pair := openPtySerial(t)
+	sp.StartRecv()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sp.ReadLine()
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	pair.Hangup()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadLine blocked after hangup")
+	}
+	var re *ReadError
+	if !errors.As(err, &re) || !re.Unplugged() {
+		t.Fatalf("ReadLine error %v, want an unplugged ReadError", err)
+	}
+
+	// the error stays
+	if _, err := sp.ReadLine(); !errors.As(err, &re) {
+		t.Fatalf("ReadLine error %v after unplug", err)
+	}
+	closeWithin(t, sp, 5*time.Second)
+}
+
+// benchLines writes lines of 64 bytes to w until stop is closed.
+func benchLines(w io.Writer, stop chan struct{}) {
+	block := bytes.Repeat([]byte(strings.Repeat("x", 63)+"\n"), 64)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if _, err := w.Write(block); err != nil {
+			return
+		}
+	}
+}
+
+// BenchmarkReadLine reads lines through the receive ring.
+func BenchmarkReadLine(b *testing.B) {
+	sp, pair := openPtySerial(b)
+	sp.StartRecv()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go benchLines(pair, stop)
+
+	b.SetBytes(64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sp.ReadLine(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadLineByteWise reads the same lines one byte per Read, as the
+// receive goroutine did before the ring, for comparison.
+func BenchmarkReadLineByteWise(b *testing.B) {
+	pair, err := virtual.OpenPair()
+	if err != nil {
+		b.Skip("no pty:", err)
+	}
+	defer pair.Close()
+	p, err := openPort(&Config{Name: pair.Name(), Baud: 115200})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer p.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go benchLines(pair, stop)
+
+	b.SetBytes(64)
+	b.ResetTimer()
+	c := make([]byte, 1)
+	line := []byte{}
+	for i := 0; i < b.N; {
+		if _, err := p.Read(c); err != nil {
+			b.Fatal(err)
+		}
+		if c[0] == '\n' {
+			line = []byte{}
+			i++
+			continue
+		}
+		line = append(line, c[0])
+	}
+}
+
+// openPtyConfig opens a SerialPort on a pty with the settings of c.
+func openPtyConfig(t *testing.T, c Config) (*SerialPort, *virtual.Pair) {
+	pair, err := virtual.OpenPair()
+	if err != nil {
+		t.Skip("no pty:", err)
+	}
+	t.Cleanup(func() { pair.Close() })
+
+	c.Name = pair.Name()
+	sp, err := NewSerialPortConfig(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp.Close() })
+	return sp, pair
+}
+
+func TestReadTimeoutDefault(t *testing.T) {
+	sp, _ := openPtySerial(t)
+
+	start := time.Now()
+	_, err := sp.Read(make([]byte, 16))
+	if !isTimeout(err) {
+		t.Fatalf("Read: %v, want a timeout", err)
+	}
+	if d := time.Since(start); d < 900*time.Millisecond || d > 3*time.Second {
+		t.Fatalf("Read timed out after %v, want a second", d)
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	sp, pair := openPtyConfig(t, Config{Baud: 115200})
+	buf := make([]byte, 16)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := sp.ReadContext(ctx, buf); err != context.Canceled {
+		t.Fatalf("cancelled ReadContext: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := sp.ReadContext(ctx, buf); err != context.DeadlineExceeded {
+		t.Fatalf("ReadContext past the deadline: %v", err)
+	}
+
+	pair.Write([]byte("OK"))
+	if n, err := sp.ReadContext(context.Background(), buf); err != nil || string(buf[:n]) != "OK" {
+		t.Fatalf("ReadContext = %q, %v", buf[:n], err)
+	}
+
+	// the deadline of the context doesn't outlive the call
+	time.AfterFunc(100*time.Millisecond, func() { pair.Write([]byte("x")) })
+	if n, err := sp.Read(buf); err != nil || string(buf[:n]) != "x" {
+		t.Fatalf("Read after ReadContext = %q, %v", buf[:n], err)
+	}
+}
+
+func TestReadDeadlineAndTimeout(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		timeout  time.Duration
+		deadline time.Duration
+	}{
+		{"deadline first", 5 * time.Second, 100 * time.Millisecond},
+		{"timeout first", 100 * time.Millisecond, 5 * time.Second},
+		{"deadline only", 0, 100 * time.Millisecond},
+	} {
+		sp, _ := openPtyConfig(t, Config{Baud: 115200, ReadTimeout: c.timeout})
+		if err := sp.SetReadDeadline(time.Now().Add(c.deadline)); err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		_, err := sp.Read(make([]byte, 16))
+		if !isTimeout(err) {
+			t.Fatalf("%s: Read: %v, want a timeout", c.name, err)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Fatalf("%s: Read timed out after %v", c.name, d)
+		}
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	sp, _ := openPtyConfig(t, Config{Baud: 115200})
+
+	// nobody reads the device, the pty buffer fills up
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	big := make([]byte, 1024*1024)
+	n, err := sp.WriteContext(ctx, big)
+	if err != context.DeadlineExceeded || n >= len(big) {
+		t.Fatalf("WriteContext = %d, %v", n, err)
+	}
+
+	if err := sp.SetWriteDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sp.Write(big); !isTimeout(err) {
+		t.Fatalf("Write past the deadline: %v", err)
+	}
+}
@@ -4,6 +4,10 @@ package serial
 
 // #include <termios.h>
 // #include <unistd.h>
+//
+// #ifndef CMSPAR
+// #define CMSPAR 0
+// #endif
 import "C"
 
 // TODO: Maybe change to using syscall package + ioctl instead of cgo
@@ -11,33 +15,58 @@ import "C"
 import (
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"syscall"
-	"time"
 	//"unsafe"
 )
 
-func openPort(name string, baud int, readTimeout time.Duration) (p *Port, err error) {
-	f, err := os.OpenFile(name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0666)
+func openPort(c *Config) (p *Port, err error) {
+	// The descriptor stays non-blocking so the runtime poller can serve
+	// deadlines and unblock readers on Close.
+	rawFd, err := syscall.Open(c.Name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0666)
 	if err != nil {
-		return
+		return nil, &os.PathError{Op: "open", Path: c.Name, Err: err}
 	}
 
-	fd := C.int(f.Fd())
-	if C.isatty(fd) != 1 {
-		f.Close()
+	if C.isatty(C.int(rawFd)) != 1 {
+		syscall.Close(rawFd)
 		return nil, errors.New("File is not a tty")
 	}
 
+	if err = configure(uintptr(rawFd), c); err != nil {
+		syscall.Close(rawFd)
+		return nil, err
+	}
+
+	/*
+				r1, _, e = syscall.Syscall(syscall.SYS_IOCTL,
+			                uintptr(f.Fd()),
+			                uintptr(0x80045402), // IOSSIOSPEED
+			                uintptr(unsafe.Pointer(&baud)));
+			        if e != 0 || r1 != 0 {
+			                s := fmt.Sprint("Baudrate syscall error:", e, r1)
+					f.Close()
+		                        return nil, os.NewError(s)
+				}
+	*/
+
+	port := &Port{f: os.NewFile(uintptr(rawFd), c.Name)}
+	port.rd.setTimeout(c.ReadTimeout)
+	return port, nil
+}
+
+// configure applies the line settings of c to the tty rawFd.
+func configure(rawFd uintptr, c *Config) (err error) {
+	fd := C.int(rawFd)
+
 	var st C.struct_termios
 	_, err = C.tcgetattr(fd, &st)
 	if err != nil {
-		f.Close()
-		return nil, err
+		return err
 	}
 	var speed C.speed_t
-	switch baud {
+	custom := false
+	switch c.Baud {
 	case 115200:
 		speed = C.B115200
 	case 57600:
@@ -53,90 +82,127 @@ func openPort(name string, baud int, readTimeout time.Duration) (p *Port, err er
 	case 2400:
 		speed = C.B2400
 	default:
-		f.Close()
-		return nil, fmt.Errorf("Unknown baud rate %v", baud)
+		// Programmed through setCustomBaud once the port is configured
+		speed = C.B38400
+		custom = true
 	}
 
 	_, err = C.cfsetispeed(&st, speed)
 	if err != nil {
-		f.Close()
-		return nil, err
+		return err
 	}
 	_, err = C.cfsetospeed(&st, speed)
 	if err != nil {
-		f.Close()
-		return nil, err
+		return err
 	}
 
 	// Turn off break interrupts, CR->NL, Parity checks, strip, and IXON
 	st.c_iflag &= ^C.tcflag_t(C.BRKINT | C.ICRNL | C.INPCK | C.ISTRIP | C.IXOFF | C.IXON | C.PARMRK)
 
-	// Select local mode, turn off parity, set to 8 bits
-	st.c_cflag &= ^C.tcflag_t(C.CSIZE | C.PARENB)
-	st.c_cflag |= (C.CLOCAL | C.CREAD | C.CS8)
+	// Select local mode, clear size, parity, stop bits and flow control
+	st.c_cflag &= ^C.tcflag_t(C.CSIZE | C.PARENB | C.PARODD | C.CMSPAR | C.CSTOPB | C.CRTSCTS)
+	st.c_cflag |= (C.CLOCAL | C.CREAD)
+
+	if err = setLineFlags(&st, c); err != nil {
+		return err
+	}
 
 	// Select raw mode
 	st.c_lflag &= ^C.tcflag_t(C.ICANON | C.ECHO | C.ECHOE | C.ISIG)
 	st.c_oflag &= ^C.tcflag_t(C.OPOST)
 
-	// set blocking / non-blocking read
-	/*
-	*	http://man7.org/linux/man-pages/man3/termios.3.html
-	* - Supports blocking read and read with timeout operations
-	 */
-	vmin, vtime := posixTimeoutValues(readTimeout)
-	st.c_cc[C.VMIN] = C.cc_t(vmin)
-	st.c_cc[C.VTIME] = C.cc_t(vtime)
+	// Reads are non-blocking, timeouts are deadlines on the poller
+	st.c_cc[C.VMIN] = 1
+	st.c_cc[C.VTIME] = 0
 
 	_, err = C.tcsetattr(fd, C.TCSANOW, &st)
 	if err != nil {
-		f.Close()
-		return nil, err
+		return err
 	}
 
-	//fmt.Println("Tweaking", name)
-	r1, _, e := syscall.Syscall(syscall.SYS_FCNTL,
-		uintptr(f.Fd()),
-		uintptr(syscall.F_SETFL),
-		uintptr(0))
-	if e != 0 || r1 != 0 {
-		s := fmt.Sprint("Clearing NONBLOCK syscall error:", e, r1)
-		f.Close()
-		return nil, errors.New(s)
+	if custom {
+		if err = setCustomBaud(rawFd, c.Baud); err != nil {
+			return err
+		}
 	}
 
-	/*
-				r1, _, e = syscall.Syscall(syscall.SYS_IOCTL,
-			                uintptr(f.Fd()),
-			                uintptr(0x80045402), // IOSSIOSPEED
-			                uintptr(unsafe.Pointer(&baud)));
-			        if e != 0 || r1 != 0 {
-			                s := fmt.Sprint("Baudrate syscall error:", e, r1)
-					f.Close()
-		                        return nil, os.NewError(s)
-				}
-	*/
+	if c.RS485 != nil {
+		if err = setRS485(rawFd, c.RS485); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setLineFlags applies data bits, parity, stop bits and flow control of c to st.
+func setLineFlags(st *C.struct_termios, c *Config) error {
+	switch c.dataBits() {
+	case 5:
+		st.c_cflag |= C.CS5
+	case 6:
+		st.c_cflag |= C.CS6
+	case 7:
+		st.c_cflag |= C.CS7
+	default:
+		st.c_cflag |= C.CS8
+	}
 
-	return &Port{f: f}, nil
+	switch c.Parity {
+	case ParityOdd:
+		st.c_cflag |= C.PARENB | C.PARODD
+	case ParityEven:
+		st.c_cflag |= C.PARENB
+	case ParityMark, ParitySpace:
+		if C.CMSPAR == 0 {
+			return errors.New("Mark/space parity is not supported")
+		}
+		st.c_cflag |= C.PARENB | C.CMSPAR
+		if c.Parity == ParityMark {
+			st.c_cflag |= C.PARODD
+		}
+	}
+	if c.Parity != ParityNone {
+		st.c_iflag |= C.INPCK | C.IGNPAR
+	}
+
+	switch c.StopBits {
+	case StopBits1:
+	case StopBits2:
+		st.c_cflag |= C.CSTOPB
+	default:
+		return fmt.Errorf("Unsupported stop bits %d", c.StopBits)
+	}
+
+	if c.RTSCTS {
+		st.c_cflag |= C.CRTSCTS
+	}
+	if c.XONXOFF {
+		st.c_iflag |= C.IXON | C.IXOFF
+	}
+	return nil
+}
+
+// termiosFlags returns the c_cflag and c_iflag bits setLineFlags sets for c.
+func termiosFlags(c *Config) (cflag, iflag uint64, err error) {
+	var st C.struct_termios
+	err = setLineFlags(&st, c)
+	return uint64(st.c_cflag), uint64(st.c_iflag), err
 }
 
 type Port struct {
 	// We intentionly do not use an "embedded" struct so that we
 	// don't export File
 	f *os.File
+
+	rd readDeadline
+	mw modemWaiter
 }
 
 func (p *Port) Read(b []byte) (n int, err error) {
-	for {
-		n, err = p.f.Read(b)
-		if err == nil {
-			return
-		}
-
-		if err != io.EOF {
-			return
-		}
-	}
+	p.rd.apply(p.f.SetReadDeadline)
+	// With VMIN=1 a read returns no data only after a hangup, which
+	// File.Read reports as io.EOF
+	return p.f.Read(b)
 }
 
 func (p *Port) Write(b []byte) (n int, err error) {
@@ -146,8 +212,10 @@ func (p *Port) Write(b []byte) (n int, err error) {
 // Discards data written to the port but not transmitted,
 // or data received but not read
 func (p *Port) Flush() error {
-	_, err := C.tcflush(C.int(p.f.Fd()), C.TCIOFLUSH)
-	return err
+	return p.control(func(fd uintptr) error {
+		_, err := C.tcflush(C.int(fd), C.TCIOFLUSH)
+		return err
+	})
 }
 
 func (p *Port) Close() (err error) {
@@ -0,0 +1,36 @@
+package serial
+
+import "testing"
+
+func TestConfigCheck(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		c    Config
+		ok   bool
+	}{
+		{"defaults", Config{Baud: 115200}, true},
+		{"no baud", Config{}, false},
+		{"negative baud", Config{Baud: -9600}, false},
+		{"5 data bits", Config{Baud: 9600, DataBits: 5}, true},
+		{"4 data bits", Config{Baud: 9600, DataBits: 4}, false},
+		{"9 data bits", Config{Baud: 9600, DataBits: 9}, false},
+		{"space parity", Config{Baud: 9600, Parity: ParitySpace}, true},
+		{"bad parity", Config{Baud: 9600, Parity: ParitySpace + 1}, false},
+		{"2 stop bits", Config{Baud: 9600, StopBits: StopBits2}, true},
+		{"bad stop bits", Config{Baud: 9600, StopBits: StopBits2 + 1}, false},
+		{"1.5 stop bits", Config{Name: "/dev/ttyS0", Baud: 9600, StopBits: StopBits1Half}, stopBits1Half},
+		{"1.5 stop bits remote", Config{Name: "rfc2217://host:2217", Baud: 9600, StopBits: StopBits1Half}, true},
+	} {
+		if err := c.c.check(); (err == nil) != c.ok {
+			t.Errorf("%s: check() = %v", c.name, err)
+		}
+	}
+}
+
+// A remote port takes 1.5 stop bits even where the platform can't.
+func TestConfigCheckLine(t *testing.T) {
+	c := Config{Baud: 9600, StopBits: StopBits1Half}
+	if err := c.checkLine(); err != nil {
+		t.Fatal(err)
+	}
+}
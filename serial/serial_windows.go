@@ -3,6 +3,7 @@
 package serial
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"sync"
@@ -11,6 +12,9 @@ import (
 	"unsafe"
 )
 
+// The DCB takes 1.5 stop bits as is.
+const stopBits1Half = true
+
 type Port struct {
 	f  *os.File
 	fd syscall.Handle
@@ -18,6 +22,12 @@ type Port struct {
 	wl sync.Mutex
 	ro *syscall.Overlapped
 	wo *syscall.Overlapped
+
+	dl    sync.Mutex
+	rdl   time.Time      // read deadline
+	wdl   time.Time      // write deadline
+	rwake syscall.Handle // signalled when rdl changes
+	wwake syscall.Handle // signalled when wdl changes
 }
 
 type structDCB struct {
@@ -37,7 +47,12 @@ type structTimeouts struct {
 	WriteTotalTimeoutConstant   uint32
 }
 
-func openPort(name string, baud int, readTimeout time.Duration) (p *Port, err error) {
+func openPort(c *Config) (p *Port, err error) {
+	if c.RS485 != nil {
+		return nil, fmt.Errorf("RS-485 mode not supported - %v", ErrNotSupported)
+	}
+
+	name := c.Name
 	if len(name) > 0 && name[0] != '\\' {
 		name = "\\\\.\\" + name
 	}
@@ -59,13 +74,13 @@ func openPort(name string, baud int, readTimeout time.Duration) (p *Port, err er
 		}
 	}()
 
-	if err = setCommState(h, baud); err != nil {
+	if err = setCommState(h, c); err != nil {
 		return
 	}
 	if err = setupComm(h, 64, 64); err != nil {
 		return
 	}
-	if err = setCommTimeouts(h, readTimeout); err != nil {
+	if err = setCommTimeouts(h, c.ReadTimeout); err != nil {
 		return
 	}
 	if err = setCommMask(h); err != nil {
@@ -80,17 +95,115 @@ func openPort(name string, baud int, readTimeout time.Duration) (p *Port, err er
 	if err != nil {
 		return
 	}
+	rwake, err := newEvent(false)
+	if err != nil {
+		return
+	}
+	wwake, err := newEvent(false)
+	if err != nil {
+		syscall.CloseHandle(rwake)
+		return
+	}
 	port := new(Port)
 	port.f = f
 	port.fd = h
 	port.ro = ro
 	port.wo = wo
+	port.rwake = rwake
+	port.wwake = wwake
 
 	return port, nil
 }
 
 func (p *Port) Close() error {
-	return p.f.Close()
+	err := p.f.Close()
+	syscall.CloseHandle(p.rwake)
+	syscall.CloseHandle(p.wwake)
+	return err
+}
+
+// Sets the deadline for future Read calls and any currently-blocked Read.
+// A zero value for t means Read will not time out.
+func (p *Port) SetReadDeadline(t time.Time) error {
+	p.dl.Lock()
+	p.rdl = t
+	p.dl.Unlock()
+	return setEvent(p.rwake)
+}
+
+// Sets the deadline for future Write calls and any currently-blocked Write.
+func (p *Port) SetWriteDeadline(t time.Time) error {
+	p.dl.Lock()
+	p.wdl = t
+	p.dl.Unlock()
+	return setEvent(p.wwake)
+}
+
+// Sets the read and write deadlines.
+func (p *Port) SetDeadline(t time.Time) error {
+	if err := p.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return p.SetWriteDeadline(t)
+}
+
+// wait waits for the overlapped operation o to complete. wake is signalled
+// when the deadline returned by deadline changes, the operation is
+// cancelled once it passed.
+func (p *Port) wait(o *syscall.Overlapped, wake syscall.Handle, deadline func() time.Time) (int, error) {
+	for {
+		ms := uint32(syscall.INFINITE)
+		if d := deadline(); !d.IsZero() {
+			left := time.Until(d)
+			if left <= 0 {
+				syscall.CancelIoEx(p.fd, o)
+				n, err := getOverlappedResult(p.fd, o)
+				if err == syscall.ERROR_OPERATION_ABORTED {
+					return n, os.ErrDeadlineExceeded
+				}
+				return n, err
+			}
+			ms = syscall.INFINITE - 1
+			if n := (left + time.Millisecond - 1) / time.Millisecond; n < time.Duration(ms) {
+				ms = uint32(n)
+			}
+		}
+
+		r, err := waitForMultipleObjects([]syscall.Handle{o.HEvent, wake}, ms)
+		if err != nil {
+			return 0, err
+		}
+		if r == syscall.WAIT_OBJECT_0 {
+			return getOverlappedResult(p.fd, o)
+		}
+		// the deadline changed or passed
+	}
+}
+
+func (p *Port) readDeadline() time.Time {
+	p.dl.Lock()
+	defer p.dl.Unlock()
+	return p.rdl
+}
+
+func (p *Port) writeDeadline() time.Time {
+	p.dl.Lock()
+	defer p.dl.Unlock()
+	return p.wdl
+}
+
+// Changes the line settings of the open port, c.Name is ignored.
+func (p *Port) Configure(c *Config) error {
+	if c.RS485 != nil {
+		return fmt.Errorf("RS-485 mode not supported - %v", ErrNotSupported)
+	}
+	if err := c.check(); err != nil {
+		return err
+	}
+	if err := setCommState(p.fd, c); err != nil {
+		return err
+	}
+	return setCommTimeouts(p.fd, c.ReadTimeout)
 }
 
 func (p *Port) Write(buf []byte) (int, error) {
@@ -105,7 +218,7 @@ func (p *Port) Write(buf []byte) (int, error) {
 	if err != nil && err != syscall.ERROR_IO_PENDING {
 		return int(n), err
 	}
-	return getOverlappedResult(p.fd, p.wo)
+	return p.wait(p.wo, p.wwake, p.writeDeadline)
 }
 
 func (p *Port) Read(buf []byte) (int, error) {
@@ -124,7 +237,7 @@ func (p *Port) Read(buf []byte) (int, error) {
 	if err != nil && err != syscall.ERROR_IO_PENDING {
 		return int(done), err
 	}
-	return getOverlappedResult(p.fd, p.ro)
+	return p.wait(p.ro, p.rwake, p.readDeadline)
 }
 
 // Discards data written to the port but not transmitted,
@@ -133,6 +246,76 @@ func (p *Port) Flush() error {
 	return purgeComm(p.fd)
 }
 
+// Holds the line in the BREAK condition for d
+func (p *Port) SendBreak(d time.Duration) error {
+	if err := p.SetBreak(true); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return p.SetBreak(false)
+}
+
+// Sets or clears the BREAK condition
+func (p *Port) SetBreak(on bool) error {
+	fn := nClearCommBreak
+	if on {
+		fn = nSetCommBreak
+	}
+	if err := commBreak(fn, p.fd); err != nil {
+		return fmt.Errorf("Break not supported by the driver - %v", err)
+	}
+	return nil
+}
+
+// Sets or clears the DTR line
+func (p *Port) SetDTR(on bool) error {
+	const SETDTR = 5
+	const CLRDTR = 6
+	if on {
+		return escapeCommFunction(p.fd, SETDTR)
+	}
+	return escapeCommFunction(p.fd, CLRDTR)
+}
+
+// Sets or clears the RTS line
+func (p *Port) SetRTS(on bool) error {
+	const SETRTS = 3
+	const CLRRTS = 4
+	if on {
+		return escapeCommFunction(p.fd, SETRTS)
+	}
+	return escapeCommFunction(p.fd, CLRRTS)
+}
+
+// Returns the state of the CTS, DSR, DCD and RI lines
+func (p *Port) GetModemStatus() (ModemStatus, error) {
+	const MS_CTS_ON = 0x0010
+	const MS_DSR_ON = 0x0020
+	const MS_RING_ON = 0x0040
+	const MS_RLSD_ON = 0x0080
+
+	bits, err := getCommModemStatus(p.fd)
+	if err != nil {
+		return ModemStatus{}, err
+	}
+	return ModemStatus{
+		CTS: bits&MS_CTS_ON != 0,
+		DSR: bits&MS_DSR_ON != 0,
+		DCD: bits&MS_RLSD_ON != 0,
+		RI:  bits&MS_RING_ON != 0,
+	}, nil
+}
+
+// Blocks until one of the CTS, DSR, DCD or RI lines changes and returns the
+// new state. The lines are polled every ModemPollInterval.
+func (p *Port) WaitForModemStatusChange(ctx context.Context) (ModemStatus, error) {
+	before, err := p.GetModemStatus()
+	if err != nil {
+		return ModemStatus{}, err
+	}
+	return pollModemStatus(ctx, before, p.GetModemStatus)
+}
+
 var (
 	nSetCommState,
 	nSetCommTimeouts,
@@ -142,6 +325,12 @@ var (
 	nCreateEvent,
 	nResetEvent,
 	nPurgeComm,
+	nEscapeCommFunction,
+	nSetCommBreak,
+	nClearCommBreak,
+	nGetCommModemStatus,
+	nSetEvent,
+	nWaitForMultipleObjects,
 	nFlushFileBuffers uintptr
 )
 
@@ -160,6 +349,12 @@ func init() {
 	nCreateEvent = getProcAddr(k32, "CreateEventW")
 	nResetEvent = getProcAddr(k32, "ResetEvent")
 	nPurgeComm = getProcAddr(k32, "PurgeComm")
+	nEscapeCommFunction = getProcAddr(k32, "EscapeCommFunction")
+	nSetCommBreak = getProcAddr(k32, "SetCommBreak")
+	nClearCommBreak = getProcAddr(k32, "ClearCommBreak")
+	nGetCommModemStatus = getProcAddr(k32, "GetCommModemStatus")
+	nSetEvent = getProcAddr(k32, "SetEvent")
+	nWaitForMultipleObjects = getProcAddr(k32, "WaitForMultipleObjects")
 	nFlushFileBuffers = getProcAddr(k32, "FlushFileBuffers")
 }
 
@@ -171,15 +366,37 @@ func getProcAddr(lib syscall.Handle, name string) uintptr {
 	return addr
 }
 
-func setCommState(h syscall.Handle, baud int) error {
+func setCommState(h syscall.Handle, c *Config) error {
 	var params structDCB
 	params.DCBlength = uint32(unsafe.Sizeof(params))
 
 	params.flags[0] = 0x01  // fBinary
 	params.flags[0] |= 0x10 // Assert DSR
 
-	params.BaudRate = uint32(baud)
-	params.ByteSize = 8
+	params.BaudRate = uint32(c.Baud)
+	params.ByteSize = byte(c.dataBits())
+
+	// DCB parity values: 0-4 = none, odd, even, mark, space
+	params.Parity = byte(c.Parity)
+	if c.Parity != ParityNone {
+		params.flags[0] |= 0x02 // fParity
+	}
+
+	// DCB stop bits values: 0-2 = 1, 1.5, 2
+	params.StopBits = byte(c.StopBits)
+
+	if c.RTSCTS {
+		params.flags[0] |= 0x04 // fOutxCtsFlow
+		params.flags[1] |= 0x20 // fRtsControl = RTS_CONTROL_HANDSHAKE
+	}
+	if c.XONXOFF {
+		params.flags[1] |= 0x01 // fOutX
+		params.flags[1] |= 0x02 // fInX
+		params.XonChar = 0x11
+		params.XoffChar = 0x13
+		params.XonLim = 16
+		params.XoffLim = 16
+	}
 
 	r, _, err := syscall.Syscall(nSetCommState, 2, uintptr(h), uintptr(unsafe.Pointer(&params)), 0)
 	if r == 0 {
@@ -277,16 +494,73 @@ func purgeComm(h syscall.Handle) error {
 	return nil
 }
 
+func commBreak(fn uintptr, h syscall.Handle) error {
+	r, _, err := syscall.Syscall(fn, 1, uintptr(h), 0, 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func escapeCommFunction(h syscall.Handle, fn uint32) error {
+	r, _, err := syscall.Syscall(nEscapeCommFunction, 2, uintptr(h), uintptr(fn), 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func getCommModemStatus(h syscall.Handle) (uint32, error) {
+	var status uint32
+	r, _, err := syscall.Syscall(nGetCommModemStatus, 2, uintptr(h), uintptr(unsafe.Pointer(&status)), 0)
+	if r == 0 {
+		return 0, err
+	}
+	return status, nil
+}
+
 func newOverlapped() (*syscall.Overlapped, error) {
 	var overlapped syscall.Overlapped
-	r, _, err := syscall.Syscall6(nCreateEvent, 4, 0, 1, 0, 0, 0, 0)
-	if r == 0 {
+	h, err := newEvent(true)
+	if err != nil {
 		return nil, err
 	}
-	overlapped.HEvent = syscall.Handle(r)
+	overlapped.HEvent = h
 	return &overlapped, nil
 }
 
+func newEvent(manualReset bool) (syscall.Handle, error) {
+	var manual uintptr
+	if manualReset {
+		manual = 1
+	}
+	r, _, err := syscall.Syscall6(nCreateEvent, 4, 0, manual, 0, 0, 0, 0)
+	if r == 0 {
+		return 0, err
+	}
+	return syscall.Handle(r), nil
+}
+
+func setEvent(h syscall.Handle) error {
+	r, _, err := syscall.Syscall(nSetEvent, 1, uintptr(h), 0, 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func waitForMultipleObjects(handles []syscall.Handle, ms uint32) (uint32, error) {
+	const WAIT_FAILED = 0xFFFFFFFF
+	r, _, err := syscall.Syscall6(nWaitForMultipleObjects, 4,
+		uintptr(len(handles)),
+		uintptr(unsafe.Pointer(&handles[0])),
+		0, uintptr(ms), 0, 0)
+	if uint32(r) == WAIT_FAILED {
+		return 0, err
+	}
+	return uint32(r), nil
+}
+
 func getOverlappedResult(h syscall.Handle, overlapped *syscall.Overlapped) (int, error) {
 	var n int
 	r, _, err := syscall.Syscall6(nGetOverlappedResult, 4,
@@ -0,0 +1,455 @@
+package serial
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Directions of a TapRecord
+const (
+	TAP_RX = "rx" // read from the port
+	TAP_TX = "tx" // written to the port
+)
+
+// Most rx records held back while a write is in progress. A write blocked
+// for longer lets the reads after them through ahead of it.
+const TAP_MAX_HELD = 256
+
+/*
+TapRecord is one read or write seen by a Tap. A capture file holds one
+record per line in JSON:
+
+	{"t":1520331,"dir":"tx","data":"41540d"}
+	{"t":9311042,"dir":"rx","data":"0d0a4f4b0d0a"}
+	{"t":9402213,"dir":"rx","err":"EOF"}
+
+t is the monotonic time in nanoseconds since the tap was created, dir is
+"rx" or "tx", data the bytes in hex and err the error returned with them,
+if any. Read timeouts aren't recorded.
+*/
+type TapRecord struct {
+	Time int64  `json:"t"`
+	Dir  string `json:"dir"`
+	Data string `json:"data,omitempty"`
+	Err  string `json:"err,omitempty"`
+}
+
+// Bytes decodes the data of the record.
+func (r *TapRecord) Bytes() ([]byte, error) {
+	return hex.DecodeString(r.Data)
+}
+
+// Tap wraps a port and records every read and write. It can be used
+// wherever the port is, e.g. NewSerialPortFrom(NewTap(port, f)).
+type Tap struct {
+	port  io.ReadWriteCloser
+	start time.Time
+
+	lock    sync.Mutex
+	capture *json.Encoder
+	dump    io.Writer
+	writing int         // writes in progress
+	held    []TapRecord // rx records waiting for the writes
+	err     error       // first error writing the capture or the dump
+}
+
+// NewTap records the traffic of port to capture, which may be nil when
+// only the live dump is wanted.
+func NewTap(port io.ReadWriteCloser, capture io.Writer) *Tap {
+	t := &Tap{port: port, start: time.Now()}
+	if capture != nil {
+		t.capture = json.NewEncoder(capture)
+	}
+	return t
+}
+
+// SetDump writes a live hex+ASCII dump of the traffic to w, nil stops it.
+func (t *Tap) SetDump(w io.Writer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.dump = w
+}
+
+// newRecord returns the record of a read or write, nil when there is
+// nothing to record.
+func newRecord(tm time.Duration, dir string, data []byte, err error) *TapRecord {
+	if len(data) == 0 && (err == nil || isTimeout(err)) {
+		return nil
+	}
+
+	rec := &TapRecord{Time: int64(tm), Dir: dir, Data: hex.EncodeToString(data)}
+	if err != nil && !isTimeout(err) {
+		rec.Err = err.Error()
+	}
+	return rec
+}
+
+// Err returns the first error writing the capture or the dump. The port
+// keeps working regardless.
+func (t *Tap) Err() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.err
+}
+
+// emit writes rec to the capture and the dump, t.lock held.
+func (t *Tap) emit(rec *TapRecord) {
+	var err error
+	if t.capture != nil {
+		err = t.capture.Encode(rec)
+	}
+	if t.dump != nil {
+		if derr := DumpRecord(t.dump, rec); err == nil {
+			err = derr
+		}
+	}
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// flush emits the held records, t.lock held.
+func (t *Tap) flush() {
+	for i := range t.held {
+		t.emit(&t.held[i])
+	}
+	t.held = nil
+}
+
+func (t *Tap) Read(b []byte) (int, error) {
+	n, err := t.port.Read(b)
+	rec := newRecord(time.Since(t.start), TAP_RX, b[:n], err)
+	if rec == nil {
+		return n, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.writing > 0 && len(t.held) < TAP_MAX_HELD {
+		t.held = append(t.held, *rec)
+	} else {
+		t.flush()
+		t.emit(rec)
+	}
+	return n, err
+}
+
+// Write records the data actually written, with the error if any. Reads
+// recorded while a write is in progress are held back until it is, the
+// answer of a fast peer mustn't land in the capture ahead of the command,
+// up to TAP_MAX_HELD of them.
+func (t *Tap) Write(b []byte) (int, error) {
+	start := time.Since(t.start)
+	t.lock.Lock()
+	t.writing++
+	t.lock.Unlock()
+
+	n, err := t.port.Write(b)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.writing--
+	if rec := newRecord(start, TAP_TX, b[:n], err); rec != nil {
+		t.emit(rec)
+	}
+	if t.writing == 0 {
+		t.flush()
+	}
+	return n, err
+}
+
+func (t *Tap) Close() error {
+	return t.port.Close()
+}
+
+func (t *Tap) SetReadDeadline(tm time.Time) error {
+	if d, ok := t.port.(Deadliner); ok {
+		return d.SetReadDeadline(tm)
+	}
+	return ErrNotSupported
+}
+
+func (t *Tap) SetWriteDeadline(tm time.Time) error {
+	if d, ok := t.port.(Deadliner); ok {
+		return d.SetWriteDeadline(tm)
+	}
+	return ErrNotSupported
+}
+
+func (t *Tap) SetDTR(on bool) error {
+	if m, ok := t.port.(ModemLines); ok {
+		return m.SetDTR(on)
+	}
+	return ErrNotSupported
+}
+
+func (t *Tap) SetRTS(on bool) error {
+	if m, ok := t.port.(ModemLines); ok {
+		return m.SetRTS(on)
+	}
+	return ErrNotSupported
+}
+
+func (t *Tap) GetModemStatus() (ModemStatus, error) {
+	if m, ok := t.port.(ModemLines); ok {
+		return m.GetModemStatus()
+	}
+	return ModemStatus{}, ErrNotSupported
+}
+
+func (t *Tap) WaitForModemStatusChange(ctx context.Context) (ModemStatus, error) {
+	if m, ok := t.port.(ModemLines); ok {
+		return m.WaitForModemStatusChange(ctx)
+	}
+	return ModemStatus{}, ErrNotSupported
+}
+
+func (t *Tap) SendBreak(d time.Duration) error {
+	if b, ok := t.port.(BreakSender); ok {
+		return b.SendBreak(d)
+	}
+	return ErrNotSupported
+}
+
+func (t *Tap) SetBreak(on bool) error {
+	if b, ok := t.port.(BreakSetter); ok {
+		return b.SetBreak(on)
+	}
+	return ErrNotSupported
+}
+
+// DumpRecord writes rec as a header line and a hex+ASCII dump:
+//
+//	+1.520331 tx 3 bytes
+//	00000000  41 54 0d                                          |AT.|
+func DumpRecord(w io.Writer, rec *TapRecord) error {
+	data, err := rec.Bytes()
+	if err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf("+%.6f %s %d bytes", time.Duration(rec.Time).Seconds(), rec.Dir, len(data))
+	if rec.Err != "" {
+		header += " (" + rec.Err + ")"
+	}
+	if _, err := fmt.Fprintln(w, header); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		_, err = io.WriteString(w, hex.Dump(data))
+	}
+	return err
+}
+
+// ReadCapture loads every record of a capture file.
+func ReadCapture(r io.Reader) ([]TapRecord, error) {
+	records := []TapRecord{}
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<24)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+
+		var rec TapRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("Capture line %d: %s", line, err)
+		}
+		if rec.Dir != TAP_RX && rec.Dir != TAP_TX {
+			return nil, fmt.Errorf("Capture line %d: bad direction %q", line, rec.Dir)
+		}
+		if _, err := rec.Bytes(); err != nil {
+			return nil, fmt.Errorf("Capture line %d: %s", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, s.Err()
+}
+
+var ErrReplayEnd = errors.New("End of capture")
+
+// ReplayMismatchError is returned by ReplayPort.Write when the data
+// written isn't what the capture recorded.
+type ReplayMismatchError struct {
+	Record   int // index of the tx record
+	Expected []byte
+	Got      []byte
+}
+
+func (e *ReplayMismatchError) Error() string {
+	return fmt.Sprintf("Replay record %d: expected write %q, got %q", e.Record, e.Expected, e.Got)
+}
+
+/*
+ReplayPort plays a capture back as a port. Reads return the recorded rx
+data in order, writes must match the recorded tx data. A read reached
+before the writes preceding it in the capture blocks until they are done,
+and a write waits for the recorded reads before it to be consumed, so the
+replay follows the conversation whatever the caller's timing. Once
+the capture is exhausted reads return io.EOF and writes ErrReplayEnd.
+*/
+type ReplayPort struct {
+	// Sleep for the recorded delay before returning each rx record.
+	RealTime bool
+
+	records []TapRecord
+	lock    sync.Mutex
+	cond    *sync.Cond
+	index   int    // current record
+	pending []byte // unconsumed part of the current record
+	last    int64  // time of the last record played
+	closed  bool
+}
+
+func NewReplayPort(records []TapRecord) *ReplayPort {
+	p := &ReplayPort{records: records, index: -1}
+	p.cond = sync.NewCond(&p.lock)
+	p.next()
+	return p
+}
+
+// OpenReplay loads a capture file for replay.
+func OpenReplay(r io.Reader) (*ReplayPort, error) {
+	records, err := ReadCapture(r)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayPort(records), nil
+}
+
+// next moves to the following record, p.lock held.
+func (p *ReplayPort) next() {
+	p.index++
+	p.pending = nil
+	if p.index < len(p.records) {
+		p.pending, _ = p.records[p.index].Bytes()
+	}
+	p.cond.Broadcast()
+}
+
+func (p *ReplayPort) current() *TapRecord {
+	if p.index < len(p.records) {
+		return &p.records[p.index]
+	}
+	return nil
+}
+
+// Done reports whether the whole capture was played.
+func (p *ReplayPort) Done() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.index >= len(p.records)
+}
+
+func (p *ReplayPort) Read(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for {
+		if p.closed {
+			return 0, ErrPortClosed
+		}
+		rec := p.current()
+		if rec == nil {
+			return 0, io.EOF
+		}
+		if rec.Dir == TAP_RX {
+			break
+		}
+		p.cond.Wait()
+	}
+
+	rec := p.current()
+	if p.RealTime && rec.Time > p.last {
+		delay := time.Duration(rec.Time - p.last)
+		p.last = rec.Time
+		p.lock.Unlock()
+		time.Sleep(delay)
+		p.lock.Lock()
+		if p.closed {
+			return 0, ErrPortClosed
+		}
+	}
+
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	if len(p.pending) > 0 {
+		return n, nil
+	}
+
+	var err error
+	if rec.Err != "" {
+		err = replayError(rec.Err)
+	}
+	p.next()
+	return n, err
+}
+
+func replayError(s string) error {
+	switch s {
+	case io.EOF.Error():
+		return io.EOF
+	case ErrPortClosed.Error():
+		return ErrPortClosed
+	}
+	return errors.New(s)
+}
+
+func (p *ReplayPort) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		if p.closed {
+			return written, ErrPortClosed
+		}
+		rec := p.current()
+		if rec == nil {
+			return written, ErrReplayEnd
+		}
+		if rec.Dir == TAP_RX {
+			// the peer spoke first, wait for the reader to take it
+			p.cond.Wait()
+			continue
+		}
+
+		n := len(p.pending)
+		if n > len(b) {
+			n = len(b)
+		}
+		if string(b[:n]) != string(p.pending[:n]) {
+			expected, _ := rec.Bytes()
+			return written, &ReplayMismatchError{Record: p.index, Expected: expected, Got: append([]byte(nil), b...)}
+		}
+
+		written += n
+		b = b[n:]
+		p.pending = p.pending[n:]
+		p.last = rec.Time
+		if len(p.pending) == 0 {
+			p.next()
+			// the recorded write failed after its data
+			if rec.Err != "" {
+				return written, replayError(rec.Err)
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (p *ReplayPort) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+	return nil
+}
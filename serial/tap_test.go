@@ -0,0 +1,252 @@
+package serial
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xiqingping/golibs/serial/virtual"
+)
+
+// converse sends AT commands and returns the lines answered, up to OK.
+func converse(t *testing.T, sp *SerialPort, cmds ...string) []string {
+	t.Helper()
+	lines := []string{}
+	for _, cmd := range cmds {
+		if _, err := sp.Write([]byte(cmd + "\r")); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			l, err := sp.ReadLineContext(ctx)
+			cancel()
+			if err != nil {
+				t.Fatalf("%s: %v", cmd, err)
+			}
+			if l = strings.TrimSpace(l); l != "" {
+				lines = append(lines, l)
+			}
+			if l == "OK" {
+				break
+			}
+		}
+	}
+	return lines
+}
+
+func TestTapCaptureReplay(t *testing.T) {
+	dev, port := net.Pipe()
+	sim := virtual.NewSimulator(dev)
+	sim.On(`^AT$`).Reply("\r\nOK\r\n")
+	sim.On(`^AT\+CSQ$`).Reply("\r\n+CSQ: 20,99\r\n").Delay(10 * time.Millisecond).Reply("\r\nOK\r\n")
+	sim.Start()
+	defer sim.Close()
+
+	var capture bytes.Buffer
+	var dump bytes.Buffer
+	tap := NewTap(port, &capture)
+	tap.SetDump(&dump)
+
+	sp := NewSerialPortFrom(tap)
+	sp.StartRecv()
+	want := converse(t, sp, "AT", "AT+CSQ")
+	sp.Close()
+
+	if !strings.Contains(dump.String(), "|AT+CSQ.|") {
+		t.Fatalf("dump:\n%s", dump.String())
+	}
+
+	records, err := ReadCapture(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := NewReplayPort(records)
+	sp = NewSerialPortFrom(replay)
+	sp.StartRecv()
+	defer sp.Close()
+	if got := converse(t, sp, "AT", "AT+CSQ"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replay answered %q, want %q", got, want)
+	}
+
+	// the capture ends with the close
+	if _, err := sp.Write([]byte("ATI\r")); err == nil {
+		t.Fatal("unrecorded write accepted")
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	replay := NewReplayPort([]TapRecord{
+		{Dir: TAP_TX, Data: "41540d"},
+		{Dir: TAP_RX, Data: "4f4b0d0a"},
+	})
+
+	_, err := replay.Write([]byte("ATI\r"))
+	var mismatch *ReplayMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Record != 0 || string(mismatch.Expected) != "AT\r" {
+		t.Fatalf("Write error %v", err)
+	}
+}
+
+// shortPort accepts at most max bytes per write and then fails.
+type shortPort struct {
+	max     int
+	written []byte
+	release chan struct{} // when set, writes wait for it
+	rx      chan []byte
+}
+
+var errShort = errors.New("short write")
+
+func (p *shortPort) Read(b []byte) (int, error) {
+	data, ok := <-p.rx
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, data), nil
+}
+
+func (p *shortPort) Write(b []byte) (int, error) {
+	if p.release != nil {
+		<-p.release
+	}
+	if len(b) > p.max {
+		p.written = append(p.written, b[:p.max]...)
+		return p.max, errShort
+	}
+	p.written = append(p.written, b...)
+	return len(b), nil
+}
+
+func (p *shortPort) Close() error { return nil }
+
+func TestTapPartialWrite(t *testing.T) {
+	var capture bytes.Buffer
+	port := &shortPort{max: 3}
+	tap := NewTap(port, &capture)
+
+	if n, err := tap.Write([]byte("AT+CSQ\r")); n != 3 || err != errShort {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if n, err := tap.Write(nil); n != 0 || err != nil {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+
+	records, err := ReadCapture(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Dir != TAP_TX || records[0].Data != "41542b" || records[0].Err != errShort.Error() {
+		t.Fatalf("records %+v", records)
+	}
+
+	// the replay fails the same way
+	replay := NewReplayPort(records)
+	if n, err := replay.Write([]byte("AT+CSQ\r")); n != 3 || err == nil || err.Error() != errShort.Error() {
+		t.Fatalf("replay Write = %d, %v", n, err)
+	}
+}
+
+// An answer read while the command is still being written is recorded
+// after it.
+func TestTapOrder(t *testing.T) {
+	var capture bytes.Buffer
+	port := &shortPort{max: 64, release: make(chan struct{}), rx: make(chan []byte, 1)}
+	tap := NewTap(port, &capture)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tap.Write([]byte("AT\r"))
+	}()
+	for {
+		tap.lock.Lock()
+		writing := tap.writing
+		tap.lock.Unlock()
+		if writing > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	port.rx <- []byte("OK\r\n")
+	if _, err := tap.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	close(port.release)
+	<-done
+
+	records, err := ReadCapture(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Dir != TAP_TX || records[1].Dir != TAP_RX {
+		t.Fatalf("records %+v", records)
+	}
+}
+
+// A write that doesn't return holds back only TAP_MAX_HELD reads.
+func TestTapHeldLimit(t *testing.T) {
+	var capture bytes.Buffer
+	port := &shortPort{max: 64, release: make(chan struct{}), rx: make(chan []byte, 1)}
+	tap := NewTap(port, &capture)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tap.Write([]byte("ATD\r"))
+	}()
+	for {
+		tap.lock.Lock()
+		writing := tap.writing
+		tap.lock.Unlock()
+		if writing > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i <= TAP_MAX_HELD; i++ {
+		port.rx <- []byte("x")
+		if _, err := tap.Read(make([]byte, 16)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tap.lock.Lock()
+	held := len(tap.held)
+	tap.lock.Unlock()
+	if held != 0 || strings.Count(capture.String(), "\n") != TAP_MAX_HELD+1 {
+		t.Fatalf("%d records held, capture %q", held, capture.String())
+	}
+
+	close(port.release)
+	<-done
+	records, err := ReadCapture(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != TAP_MAX_HELD+2 || records[TAP_MAX_HELD+1].Dir != TAP_TX {
+		t.Fatalf("%d records", len(records))
+	}
+}
+
+type failWriter struct{}
+
+var errCapture = errors.New("disk full")
+
+func (failWriter) Write(b []byte) (int, error) { return 0, errCapture }
+
+func TestTapCaptureError(t *testing.T) {
+	tap := NewTap(&shortPort{max: 64}, failWriter{})
+	if _, err := tap.Write([]byte("AT\r")); err != nil {
+		t.Fatal(err)
+	}
+	if tap.Err() != errCapture {
+		t.Fatalf("Err %v, want %v", tap.Err(), errCapture)
+	}
+}
@@ -0,0 +1,67 @@
+// +build linux,386 linux,amd64 linux,arm linux,arm64 linux,riscv64 linux,loong64 linux,s390x
+
+package serial
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// termios2 ioctls and c_cflag bits from <asm-generic/termbits.h>, as used by
+// x86, arm, arm64, riscv64, loong64 and s390x. Other architectures (mips,
+// ppc, sparc...) number them differently and get termios2_other.go.
+const (
+	_TCGETS2 = 0x802c542a
+	_TCSETS2 = 0x402c542b
+	_CBAUD   = 0x0000100f
+	_BOTHER  = 0x00001000
+	_IBSHIFT = 16
+)
+
+type termios2 struct {
+	Iflag  uint32
+	Oflag  uint32
+	Cflag  uint32
+	Lflag  uint32
+	Line   uint8
+	Cc     [19]uint8
+	Ispeed uint32
+	Ospeed uint32
+}
+
+// termios2Ioctl is a variable so that drivers rounding the rate can be
+// simulated.
+var termios2Ioctl = ioctl
+
+// setCustomBaud sets any integer baud rate with TCSETS2 and BOTHER.
+// The rate is read back and rejected when the driver could not get within
+// 3% of it.
+func setCustomBaud(fd uintptr, baud int) error {
+	var t termios2
+
+	if err := termios2Ioctl(fd, _TCGETS2, unsafe.Pointer(&t)); err != nil {
+		return fmt.Errorf("Baud rate %d not supported - TCGETS2 %v", baud, err)
+	}
+
+	t.Cflag &^= _CBAUD | _CBAUD<<_IBSHIFT
+	t.Cflag |= _BOTHER | _BOTHER<<_IBSHIFT
+	t.Ispeed = uint32(baud)
+	t.Ospeed = uint32(baud)
+
+	if err := termios2Ioctl(fd, _TCSETS2, unsafe.Pointer(&t)); err != nil {
+		return fmt.Errorf("Baud rate %d not supported - TCSETS2 %v", baud, err)
+	}
+
+	if err := termios2Ioctl(fd, _TCGETS2, unsafe.Pointer(&t)); err != nil {
+		return fmt.Errorf("Baud rate %d not supported - TCGETS2 %v", baud, err)
+	}
+
+	diff := int(t.Ospeed) - baud
+	if diff < 0 {
+		diff = -diff
+	}
+	if t.Ospeed == 0 || diff*100 > baud*3 {
+		return fmt.Errorf("Baud rate %d not supported - driver set %d", baud, t.Ospeed)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// +build linux,386 linux,amd64 linux,arm linux,arm64 linux,riscv64 linux,loong64 linux,s390x
+
+package serial
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func getTermios2(t *testing.T, p *Port) termios2 {
+	var t2 termios2
+	err := p.control(func(fd uintptr) error {
+		return ioctl(fd, _TCGETS2, unsafe.Pointer(&t2))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return t2
+}
+
+// A rate without a Bxxx constant is set with BOTHER.
+func TestCustomBaud(t *testing.T) {
+	p := openPtyPort(t)
+	if err := p.Configure(&Config{Baud: 250000}); err != nil {
+		t.Fatal(err)
+	}
+	t2 := getTermios2(t, p)
+	if t2.Cflag&_CBAUD != _BOTHER || t2.Ospeed != 250000 || t2.Ispeed != 250000 {
+		t.Fatalf("cflag %#x, speed %d/%d", t2.Cflag, t2.Ispeed, t2.Ospeed)
+	}
+
+	// a standard rate goes back to its Bxxx constant
+	if err := p.Configure(&Config{Baud: 115200}); err != nil {
+		t.Fatal(err)
+	}
+	if t2 := getTermios2(t, p); t2.Cflag&_CBAUD == _BOTHER || t2.Ospeed != 115200 {
+		t.Fatalf("cflag %#x, speed %d", t2.Cflag, t2.Ospeed)
+	}
+}
+
+// Rates the driver can't get within 3% of are rejected.
+func TestCustomBaudRejected(t *testing.T) {
+	p := openPtyPort(t)
+	saved := termios2Ioctl
+	defer func() { termios2Ioctl = saved }()
+
+	for _, c := range []struct {
+		baud, driver int
+		ok           bool
+	}{
+		{250000, 250000, true},
+		{250000, 245000, true},
+		{250000, 256000, true},
+		{250000, 240000, false},
+		{3500000, 3000000, false},
+		{250000, 0, false},
+	} {
+		set := false
+		termios2Ioctl = func(fd uintptr, req uint, arg unsafe.Pointer) error {
+			err := ioctl(fd, req, arg)
+			switch {
+			case req == _TCSETS2:
+				set = true
+			case set:
+				(*termios2)(arg).Ospeed = uint32(c.driver)
+			}
+			return err
+		}
+		err := p.control(func(fd uintptr) error { return setCustomBaud(fd, c.baud) })
+		if (err == nil) != c.ok {
+			t.Errorf("%d, driver sets %d: error %v", c.baud, c.driver, err)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+// +build !linux,!windows linux,!386,!amd64,!arm,!arm64,!riscv64,!loong64,!s390x
+
+package serial
+
+import "fmt"
+
+func setCustomBaud(fd uintptr, baud int) error {
+	return fmt.Errorf("Unknown baud rate %v", baud)
+}
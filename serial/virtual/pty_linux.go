@@ -0,0 +1,121 @@
+package virtual
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func ioctl(fd int, req uint, arg unsafe.Pointer) error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// OpenPair creates a pty pair. The slave is put in raw mode so that data
+// goes through untouched even before a serial port opens it.
+func OpenPair() (*Pair, error) {
+	fd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var unlock int32
+	if err := ioctl(fd, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	var n uint32
+	if err := ioctl(fd, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	name := fmt.Sprintf("/dev/pts/%d", n)
+
+	// Holding the slave open keeps the master from reading EIO while the
+	// port under test is closed or not opened yet.
+	sfd, err := syscall.Open(name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	var st syscall.Termios
+	if err := ioctl(sfd, syscall.TCGETS, unsafe.Pointer(&st)); err != nil {
+		syscall.Close(sfd)
+		syscall.Close(fd)
+		return nil, err
+	}
+	st.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	st.Oflag &^= syscall.OPOST
+	st.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	st.Cflag &^= syscall.CSIZE | syscall.PARENB
+	st.Cflag |= syscall.CS8
+	st.Cc[syscall.VMIN] = 1
+	st.Cc[syscall.VTIME] = 0
+	if err := ioctl(sfd, syscall.TCSETS, unsafe.Pointer(&st)); err != nil {
+		syscall.Close(sfd)
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	return &Pair{
+		master: os.NewFile(uintptr(fd), "/dev/ptmx"),
+		slave:  os.NewFile(uintptr(sfd), name),
+		name:   name,
+	}, nil
+}
+
+/*
+Pair is a linked pty pair. Name is the device the code under test opens
+with serial.NewSerialPort, the Pair itself is the other end of the cable:
+what it writes is read from the port and the other way round.
+*/
+type Pair struct {
+	master *os.File
+	slave  *os.File
+	name   string
+}
+
+// Name returns the device node of the port side, e.g. /dev/pts/3.
+func (p *Pair) Name() string {
+	return p.name
+}
+
+func (p *Pair) Read(b []byte) (int, error) {
+	return p.master.Read(b)
+}
+
+func (p *Pair) Write(b []byte) (int, error) {
+	return p.master.Write(b)
+}
+
+func (p *Pair) SetReadDeadline(t time.Time) error {
+	return p.master.SetReadDeadline(t)
+}
+
+func (p *Pair) SetWriteDeadline(t time.Time) error {
+	return p.master.SetWriteDeadline(t)
+}
+
+// Hangup simulates the device being unplugged, the port side reads EOF or
+// EIO from now on. The Pair can't be used anymore except for Close.
+func (p *Pair) Hangup() error {
+	p.slave.Close()
+	return p.master.Close()
+}
+
+// Close closes both ends.
+func (p *Pair) Close() error {
+	p.slave.Close()
+	err := p.master.Close()
+	if errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
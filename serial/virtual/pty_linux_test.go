@@ -0,0 +1,62 @@
+package virtual
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPair(t *testing.T) {
+	pair, err := OpenPair()
+	if err != nil {
+		t.Skip("no pty:", err)
+	}
+	defer pair.Close()
+
+	f, err := os.OpenFile(pair.Name(), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Raw mode: \r and \n go through unchanged
+	if _, err := pair.Write([]byte("a\rb\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := f.Read(buf)
+	if err != nil || string(buf[:n]) != "a\rb\n" {
+		t.Fatalf("port read %q, %v", buf[:n], err)
+	}
+
+	if _, err := f.Write([]byte("c\n")); err != nil {
+		t.Fatal(err)
+	}
+	pair.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err = pair.Read(buf)
+	if err != nil || string(buf[:n]) != "c\n" {
+		t.Fatalf("pair read %q, %v", buf[:n], err)
+	}
+}
+
+func TestPairHangup(t *testing.T) {
+	pair, err := OpenPair()
+	if err != nil {
+		t.Skip("no pty:", err)
+	}
+	defer pair.Close()
+
+	f, err := os.OpenFile(pair.Name(), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := pair.Hangup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 16)); err == nil {
+		t.Fatal("read succeeded after hangup")
+	}
+}
@@ -0,0 +1,45 @@
+// +build !linux
+
+package virtual
+
+import (
+	"errors"
+	"time"
+)
+
+var errNoPty = errors.New("Virtual serial ports are only supported on Linux")
+
+// OpenPair creates a pty pair, only supported on Linux.
+func OpenPair() (*Pair, error) {
+	return nil, errNoPty
+}
+
+type Pair struct{}
+
+func (p *Pair) Name() string {
+	return ""
+}
+
+func (p *Pair) Read(b []byte) (int, error) {
+	return 0, errNoPty
+}
+
+func (p *Pair) Write(b []byte) (int, error) {
+	return 0, errNoPty
+}
+
+func (p *Pair) SetReadDeadline(t time.Time) error {
+	return errNoPty
+}
+
+func (p *Pair) SetWriteDeadline(t time.Time) error {
+	return errNoPty
+}
+
+func (p *Pair) Hangup() error {
+	return errNoPty
+}
+
+func (p *Pair) Close() error {
+	return nil
+}
@@ -0,0 +1,351 @@
+/*
+Package virtual provides virtual serial ports for tests: a linked pty pair
+that serial.NewSerialPort can open like a real device, and a Simulator
+playing the device on the other end from request/response rules.
+
+	pair, _ := virtual.OpenPair()
+	sim := virtual.NewSimulator(pair)
+	sim.On(`^AT$`).Reply("\r\nOK\r\n")
+	sim.On(`^AT\+CSQ$`).Delay(50 * time.Millisecond).Reply("\r\n+CSQ: 20,99\r\n\r\nOK\r\n")
+	sim.Start()
+	defer sim.Close()
+
+	port, _ := serial.NewSerialPort(pair.Name(), 115200)
+*/
+package virtual
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrWaitTimeout = errors.New("Timeout waiting for request")
+	ErrClosed      = errors.New("Simulator closed")
+)
+
+// reply is one chunk sent back for a request.
+type reply struct {
+	delay  time.Duration
+	data   string
+	expand bool
+	fn     func(req string, match []string) string
+}
+
+// Rule answers the requests matching its pattern. The methods add to the
+// rule and return it, so a rule is built in one expression. They are safe
+// to call while the simulator runs.
+type Rule struct {
+	lock    *sync.Mutex // the lock of the simulator
+	re      *regexp.Regexp
+	replies []reply
+	delay   time.Duration // for the next reply added
+	times   int           // uses left, negative for unlimited
+}
+
+// Delay waits d before sending the next reply added to the rule.
+func (r *Rule) Delay(d time.Duration) *Rule {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.delay += d
+	return r
+}
+
+// Reply sends data as it is.
+func (r *Rule) Reply(data string) *Rule {
+	return r.add(reply{data: data})
+}
+
+// ReplyExpand sends template, in which $1 or ${name} are replaced by the
+// submatches of the pattern as in regexp.Expand; $$ sends a $.
+func (r *Rule) ReplyExpand(template string) *Rule {
+	return r.add(reply{data: template, expand: true})
+}
+
+// Do sends what fn returns for the request, fn is given the request and
+// the submatches of the pattern.
+func (r *Rule) Do(fn func(req string, match []string) string) *Rule {
+	return r.add(reply{fn: fn})
+}
+
+func (r *Rule) add(rp reply) *Rule {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rp.delay = r.delay
+	r.replies = append(r.replies, rp)
+	r.delay = 0
+	return r
+}
+
+// Times limits how often the rule answers, later requests go to the next
+// matching rule.
+func (r *Rule) Times(n int) *Rule {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.times = n
+	return r
+}
+
+/*
+Simulator plays a device on rw, usually a Pair. Incoming bytes are split
+into requests at any of Delims, and each request is answered by the first
+matching rule that has uses left. Requests are served one after the other,
+so with delays the timing seen by the code under test is deterministic.
+*/
+type Simulator struct {
+	// Echo sends every received byte back, like a modem in ATE1.
+	Echo bool
+	// Delims terminate a request and are stripped from it, default
+	// "\r\n\x1a" which suits AT commands and PDUs ended by Ctrl-Z.
+	Delims string
+	// Unmatched is sent for requests no rule matches, default
+	// "\r\nERROR\r\n". Set it to "" before Start for silence.
+	Unmatched string
+
+	rw    io.ReadWriter
+	wlock sync.Mutex
+
+	lock     sync.Mutex
+	rules    []*Rule
+	requests []string
+	changed  chan struct{} // closed and renewed on every request
+	err      error
+	started  bool
+	closed   bool
+	stop     chan struct{} // closed by Close
+	done     chan struct{} // closed when serve returns
+}
+
+func NewSimulator(rw io.ReadWriter) *Simulator {
+	return &Simulator{
+		Delims:    "\r\n\x1a",
+		Unmatched: "\r\nERROR\r\n",
+		rw:        rw,
+		changed:   make(chan struct{}),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// On adds a rule for requests matching the regular expression pattern.
+// Rules can be added while the simulator runs.
+func (s *Simulator) On(pattern string) *Rule {
+	r := &Rule{lock: &s.lock, re: regexp.MustCompile(pattern), times: -1}
+	s.lock.Lock()
+	s.rules = append(s.rules, r)
+	s.lock.Unlock()
+	return r
+}
+
+// Start serves requests in a goroutine until rw fails or Close. Starting
+// twice or after Close does nothing.
+func (s *Simulator) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started || s.closed {
+		return
+	}
+	s.started = true
+	go s.serve()
+}
+
+// Send writes unsolicited data such as an URC.
+func (s *Simulator) Send(data string) error {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	_, err := io.WriteString(s.rw, data)
+	return err
+}
+
+// Requests returns the requests received so far.
+func (s *Simulator) Requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// WaitFor waits until a request matching pattern has been received and
+// returns it.
+func (s *Simulator) WaitFor(pattern string, timeout time.Duration) (string, error) {
+	re := regexp.MustCompile(pattern)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.lock.Lock()
+		for _, req := range s.requests {
+			if re.MatchString(req) {
+				s.lock.Unlock()
+				return req, nil
+			}
+		}
+		changed := s.changed
+		s.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-s.done:
+			return "", s.Err()
+		case <-timer.C:
+			return "", ErrWaitTimeout
+		}
+	}
+}
+
+// Err returns why the simulator stopped.
+func (s *Simulator) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// Close closes rw if it is an io.Closer and waits for the simulator to
+// stop. The simulator stops even if rw can't be closed, a Read pending on
+// it is then left behind.
+func (s *Simulator) Close() error {
+	s.lock.Lock()
+	started := s.started
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+	}
+	s.lock.Unlock()
+
+	var err error
+	if c, ok := s.rw.(io.Closer); ok {
+		err = c.Close()
+	}
+	if started {
+		<-s.done
+	}
+	return err
+}
+
+// read passes what is read from rw to serve until it fails or Close.
+func (s *Simulator) read(chunks chan<- []byte) {
+	defer close(chunks)
+	for {
+		buf := make([]byte, 1024)
+		n, err := s.rw.Read(buf)
+		if err != nil {
+			s.lock.Lock()
+			if s.err == nil {
+				s.err = err
+			}
+			s.lock.Unlock()
+			return
+		}
+		select {
+		case chunks <- buf[:n]:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Simulator) serve() {
+	defer close(s.done)
+
+	chunks := make(chan []byte)
+	go s.read(chunks)
+
+	req := []byte{}
+	for {
+		var b []byte
+		var ok bool
+		select {
+		case b, ok = <-chunks:
+		case <-s.stop:
+		}
+		if !ok {
+			s.lock.Lock()
+			if s.err == nil {
+				s.err = ErrClosed
+			}
+			s.lock.Unlock()
+			return
+		}
+
+		if s.Echo {
+			s.wlock.Lock()
+			s.rw.Write(b)
+			s.wlock.Unlock()
+		}
+
+		for _, c := range b {
+			if strings.IndexByte(s.Delims, c) < 0 {
+				req = append(req, c)
+				continue
+			}
+			if len(req) > 0 {
+				s.handle(string(req))
+				req = req[:0]
+			}
+		}
+	}
+}
+
+func (s *Simulator) handle(req string) {
+	s.lock.Lock()
+	s.requests = append(s.requests, req)
+	close(s.changed)
+	s.changed = make(chan struct{})
+
+	var rule *Rule
+	var match []int
+	for _, r := range s.rules {
+		if r.times == 0 {
+			continue
+		}
+		if match = r.re.FindStringSubmatchIndex(req); match != nil {
+			rule = r
+			if r.times > 0 {
+				r.times--
+			}
+			break
+		}
+	}
+	var replies []reply
+	if rule != nil {
+		replies = rule.replies
+	}
+	s.lock.Unlock()
+
+	if rule == nil {
+		if s.Unmatched != "" {
+			s.Send(s.Unmatched)
+		}
+		return
+	}
+
+	for _, r := range replies {
+		if r.delay > 0 {
+			time.Sleep(r.delay)
+		}
+
+		var data string
+		if r.fn != nil {
+			groups := []string{}
+			for i := 0; i+1 < len(match); i += 2 {
+				if match[i] < 0 {
+					groups = append(groups, "")
+				} else {
+					groups = append(groups, req[match[i]:match[i+1]])
+				}
+			}
+			data = r.fn(req, groups)
+		} else if r.expand {
+			data = string(rule.re.ExpandString(nil, r.data, req, match))
+		} else {
+			data = r.data
+		}
+
+		if data != "" {
+			s.Send(data)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package virtual
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSimulator(t *testing.T) (*Simulator, net.Conn) {
+	dev, port := net.Pipe()
+	s := NewSimulator(dev)
+	t.Cleanup(func() {
+		port.Close()
+		s.Close()
+	})
+	return s, port
+}
+
+// readUntil reads from c until the data read ends with want.
+func readUntil(t *testing.T, c net.Conn, want string) string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := []byte{}
+	buf := make([]byte, 256)
+	for !strings.HasSuffix(string(got), want) {
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("read %q: %v", got, err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	return string(got)
+}
+
+func TestSimulatorRules(t *testing.T) {
+	s, port := newTestSimulator(t)
+	s.On(`^AT\+CPIN=(\d+)$`).ReplyExpand("\r\nPIN $1 $$\r\n").Reply("\r\nOK\r\n")
+	s.On(`^AT\+PRICE=(\d+)$`).Reply("\r\n$1 ${1} $$\r\n")
+	s.On(`^AT$`).Times(1).Reply("first\r\n")
+	s.On(`^AT$`).Reply("again\r\n")
+	s.On(`^AT\+ECHO=(.*)$`).Do(func(req string, match []string) string {
+		return fmt.Sprintf("%s|%s\r\n", req, match[1])
+	})
+	s.Start()
+
+	tests := []struct {
+		req  string
+		want string
+	}{
+		{"AT+CPIN=1234\r", "\r\nPIN 1234 $\r\n\r\nOK\r\n"},
+		{"AT+PRICE=5\r", "\r\n$1 ${1} $$\r\n"},
+		{"AT\r", "first\r\n"},
+		{"AT\r", "again\r\n"},
+		{"AT+ECHO=x\r", "AT+ECHO=x|x\r\n"},
+		{"AT+NONE\r", "\r\nERROR\r\n"},
+	}
+	for _, tt := range tests {
+		if _, err := port.Write([]byte(tt.req)); err != nil {
+			t.Fatal(err)
+		}
+		if got := readUntil(t, port, tt.want); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.req, got, tt.want)
+		}
+	}
+
+	want := []string{"AT+CPIN=1234", "AT+PRICE=5", "AT", "AT", "AT+ECHO=x", "AT+NONE"}
+	if got := s.Requests(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("requests %q, want %q", got, want)
+	}
+}
+
+func TestSimulatorDelay(t *testing.T) {
+	s, port := newTestSimulator(t)
+	s.On(`^AT$`).Delay(100 * time.Millisecond).Reply("OK\r\n")
+	s.Start()
+
+	start := time.Now()
+	port.Write([]byte("AT\r"))
+	readUntil(t, port, "OK\r\n")
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("reply after %v", d)
+	}
+}
+
+func TestSimulatorWaitFor(t *testing.T) {
+	s, port := newTestSimulator(t)
+	s.Unmatched = ""
+	s.Start()
+
+	go port.Write([]byte("AT+CMGS=20\rdata\x1a"))
+	req, err := s.WaitFor(`^data$`, 5*time.Second)
+	if err != nil || req != "data" {
+		t.Fatalf("WaitFor = %q, %v", req, err)
+	}
+	if _, err := s.WaitFor(`^ATZ$`, 50*time.Millisecond); err != ErrWaitTimeout {
+		t.Fatalf("WaitFor error %v, want %v", err, ErrWaitTimeout)
+	}
+
+	port.Close()
+	if _, err := s.WaitFor(`^ATZ$`, 5*time.Second); err == nil {
+		t.Fatal("WaitFor succeeded after the simulator stopped")
+	}
+}
+
+// Rules may be built while requests are served, run with -race.
+func TestSimulatorBuildWhileRunning(t *testing.T) {
+	s, port := newTestSimulator(t)
+	s.Unmatched = ""
+	r := s.On(`^AT$`).Reply("OK\r\n")
+	s.Start()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 256)
+		for {
+			if _, err := port.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	stop := make(chan struct{})
+	built := make(chan struct{})
+	go func() {
+		defer close(built)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			r.Times(-1)
+			if i < 100 {
+				s.On(fmt.Sprintf(`^AT%d$`, i)).Delay(0).Reply("OK\r\n")
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		port.Write([]byte(fmt.Sprintf("AT\rAT%d\r", i)))
+	}
+	close(stop)
+	<-built
+	if _, err := s.WaitFor(`^AT99$`, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	port.Close()
+	<-done
+}
+
+// onlyReadWriter hides Close from the simulator.
+type onlyReadWriter struct{ io.ReadWriter }
+
+func TestSimulatorClose(t *testing.T) {
+	// never started
+	dev, port := net.Pipe()
+	defer port.Close()
+	if err := NewSimulator(dev).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// rw can't be closed
+	dev, port = net.Pipe()
+	defer dev.Close()
+	defer port.Close()
+	s := NewSimulator(onlyReadWriter{dev})
+	s.On(`^AT$`).Reply("OK\r\n")
+	s.Start()
+	port.Write([]byte("AT\r"))
+	readUntil(t, port, "OK\r\n")
+
+	closed := make(chan error, 1)
+	go func() { closed <- s.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked")
+	}
+	if s.Err() != ErrClosed {
+		t.Fatalf("Err %v, want %v", s.Err(), ErrClosed)
+	}
+}